@@ -1,188 +1,11410 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
+	"cmp"
+	"compress/gzip"
+	"container/list"
+	"context"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"errors"
+	"flag"
 	"fmt"
+	"hash/fnv"
+	"html/template"
 	"io"
 	"log"
+	"maps"
+	"math"
 	"mime/multipart"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/tabwriter"
 	"time"
+	"unicode/utf16"
+	"unicode/utf8"
 )
 
-type WhatsAppChecker struct {
-	apiKey     string
+// Version is the client version reported in the default User-Agent.
+const Version = "1.0.0"
+
+const defaultUserAgent = "wachecker-go/" + Version
+
+// Checker is the client core shared by every checknumber.ai service: uploads,
+// polling, retries and result handling only differ in the base URL.
+type Checker struct {
+	apiKey      string
+	service     string
+	baseURL     string
+	httpClient  *http.Client
+	rateLimiter *RateLimiter
+
+	// downloadClient fetches result files. It has no timeout, since large
+	// exports can take longer than an API call.
+	downloadClient *http.Client
+
+	allowSequential  bool
+	maxSequentialRun int
+
+	onUploadProgress func(sent, total int64)
+
+	taskStore   *TaskStore
+	reuseWithin time.Duration
+
+	jobCeiling     int
+	jobTimeBox     time.Duration
+	parallelChunks int
+
+	metrics  *Metrics
+	adaptive bool
+	dedupe   bool
+
+	onProgress     func(ProgressEvent)
+	statusOut      io.Writer
+	maxPolls       int
+	stallPolls     int
+	cancelStalled  bool
+	heartbeatEvery time.Duration
+	heartbeatURL   string
+
+	notifiers   []Notifier
+	events      []Events
+	resultSinks []ResultSink
+
+	resultCache ResultCache
+	enricher    Enricher
+
+	credentials    CredentialProvider
+	encryptionKeys CredentialProvider
+	auth           func(*http.Request)
+	keyPool        *KeyPool
+	endpoints      *EndpointPool
+	breaker        *CircuitBreaker
+
+	retries      int
+	retryBackoff time.Duration
+
+	gzipUpload   bool
+	gzipRejected atomic.Bool
+
+	userAgent      string
+	defaultHeaders http.Header
+
+	requestHooks  []func(*http.Request)
+	responseHooks []func(*http.Response)
+
+	rateLimitMu sync.Mutex
+	rateLimit   RateLimitInfo
+
+	accountURL  string
+	realtimeURL string
+
+	batchStatusURL   string
+	batchUnavailable atomic.Bool
+
+	// statusETags holds the last ETag and response per task, so polls can
+	// be conditional.
+	statusETags  sync.Map
+	lowBalance   float64
+	onLowBalance func(*Usage)
+
+	pricePerNumber float64
+	maxCost        float64
+
+	dryRun bool
+
+	piiSalt []byte
+
+	audit *AuditLog
+}
+
+// WhatsAppChecker and TelegramChecker name the service a Checker was built
+// for; WhatsAppChecker is also the historical name of the type.
+type (
+	WhatsAppChecker = Checker
+	TelegramChecker = Checker
+)
+
+type Option func(*Checker)
+
+// WithBaseURL points the checker at a different tasks endpoint, e.g. a
+// staging environment or a service not covered by NewServiceChecker.
+func WithBaseURL(url string) Option {
+	return func(wc *Checker) {
+		wc.baseURL = strings.TrimSuffix(url, "/")
+	}
+}
+
+func WithRateLimit(rps float64, burst int) Option {
+	return func(wc *Checker) {
+		wc.rateLimiter = NewRateLimiter(rps, burst)
+	}
+}
+
+// WithRateLimiter shares an existing limiter, so several checkers stay
+// within one account-wide request budget.
+func WithRateLimiter(rl *RateLimiter) Option {
+	return func(wc *Checker) {
+		wc.rateLimiter = rl
+	}
+}
+
+// WithSequentialOverride disables the sequential-range guardrail. Only use it
+// for lists that are genuinely contiguous, such as a company's own DID block.
+func WithSequentialOverride() Option {
+	return func(wc *Checker) {
+		wc.allowSequential = true
+	}
+}
+
+func WithMaxSequentialRun(n int) Option {
+	return func(wc *Checker) {
+		wc.maxSequentialRun = n
+	}
+}
+
+func WithUploadProgress(fn func(sent, total int64)) Option {
+	return func(wc *Checker) {
+		wc.onUploadProgress = fn
+	}
+}
+
+func WithTaskStore(ts *TaskStore) Option {
+	return func(wc *Checker) {
+		wc.taskStore = ts
+	}
+}
+
+// WithReuseExisting returns the stored task instead of re-uploading when the
+// same input content was uploaded within maxAge. It requires WithTaskStore.
+func WithReuseExisting(maxAge time.Duration) Option {
+	return func(wc *Checker) {
+		wc.reuseWithin = maxAge
+	}
+}
+
+// WithJobCeiling caps how many numbers a single RunJob may submit, protecting
+// against runaway costs when an input is unexpectedly large.
+func WithJobCeiling(maxNumbers int) Option {
+	return func(wc *Checker) {
+		wc.jobCeiling = maxNumbers
+	}
+}
+
+// WithJobTimeBox stops RunJob from submitting new chunks after d has elapsed.
+// Chunks already submitted are still polled to completion.
+func WithJobTimeBox(d time.Duration) Option {
+	return func(wc *Checker) {
+		wc.jobTimeBox = d
+	}
+}
+
+// WithAdaptiveTuning widens request timeouts and poll intervals from the
+// observed latency histograms when the provider is slow, instead of failing.
+func WithAdaptiveTuning() Option {
+	return func(wc *Checker) {
+		wc.adaptive = true
+	}
+}
+
+// WithParallelChunks lets RunJob upload and poll up to n chunks at a time
+// instead of one after the other.
+func WithParallelChunks(n int) Option {
+	return func(wc *Checker) {
+		wc.parallelChunks = n
+	}
+}
+
+// WithDedupe drops repeated numbers before upload, keeping the first
+// occurrence, so messy exports are not billed twice for the same number.
+func WithDedupe() Option {
+	return func(wc *Checker) {
+		wc.dedupe = true
+	}
+}
+
+// WithPIIHashing replaces phone numbers with salted hashes (see HashNumber)
+// in everything the checker writes: exported and downloaded results, reject
+// files, logs and the task store's input hashes. Raw numbers stay in the
+// caller's memory; use NumberIndex to map hashes back.
+func WithPIIHashing(salt []byte) Option {
+	return func(wc *Checker) {
+		wc.piiSalt = salt
+	}
+}
+
+// WithAuditLog records every API call and result download to log.
+func WithAuditLog(log *AuditLog) Option {
+	return func(wc *Checker) {
+		wc.audit = log
+	}
+}
+
+// WithProgress calls fn after every status poll with the task's progress,
+// throughput and estimated time to completion.
+func WithProgress(fn func(ProgressEvent)) Option {
+	return func(wc *Checker) {
+		wc.onProgress = fn
+	}
+}
+
+// WithStatusOutput sets where poll status lines are printed (default
+// stdout), e.g. os.Stderr when results are streamed to stdout, or io.Discard.
+func WithStatusOutput(w io.Writer) Option {
+	return func(wc *Checker) {
+		wc.statusOut = w
+	}
+}
+
+// WithMaxPolls stops polling a task with ErrPollLimit after n status checks.
+func WithMaxPolls(n int) Option {
+	return func(wc *Checker) {
+		wc.maxPolls = n
+	}
+}
+
+// WithStallDetection fails polling with ErrTaskStalled once success has not
+// increased for polls consecutive status checks of a processing task with
+// numbers left. Pending tasks and tasks waiting for export never count as
+// stalled, and a status change restarts the count. With cancel set the stalled
+// task is also cancelled, so it is not billed when it eventually resumes.
+func WithStallDetection(polls int, cancel bool) Option {
+	return func(wc *Checker) {
+		wc.stallPolls = polls
+		wc.cancelStalled = cancel
+	}
+}
+
+var (
+	ErrPollLimit   = errors.New("poll limit reached before task finished")
+	ErrTaskStalled = errors.New("task stalled, no progress")
+)
+
+// WithHeartbeat emits a heartbeat every interval while a task is being
+// polled: a log line, the wachecker_last_heartbeat_timestamp_seconds gauge,
+// and, when url is set, a ping compatible with healthchecks.io. Heartbeats
+// are withheld once the task's status and success count have not changed
+// for two intervals (and at least three polls), so a hung job is detectable
+// even though the process is alive and polling.
+func WithHeartbeat(interval time.Duration, url string) Option {
+	return func(wc *Checker) {
+		wc.heartbeatEvery = interval
+		wc.heartbeatURL = url
+	}
+}
+
+func WithNotifier(n Notifier) Option {
+	return func(wc *Checker) {
+		wc.notifiers = append(wc.notifiers, n)
+	}
+}
+
+// WithEvents adds e to the receivers of task lifecycle events.
+func WithEvents(e Events) Option {
+	return func(wc *Checker) {
+		wc.events = append(wc.events, e)
+	}
+}
+
+// WithResultSinks fans the results of CheckNumbers and of a Pipeline out to
+// sinks, e.g. a file, a database and a webhook, in one pass.
+func WithResultSinks(sinks ...ResultSink) Option {
+	return func(wc *Checker) {
+		wc.resultSinks = append(wc.resultSinks, sinks...)
+	}
+}
+
+// WithResultCache lets CheckNumbers answer recently checked numbers from
+// cache and submit only unknown or expired ones.
+func WithResultCache(c ResultCache) Option {
+	return func(wc *Checker) {
+		wc.resultCache = c
+	}
+}
+
+// WithEnricher runs e over every parsed result set, e.g. to add carrier and
+// line type. Enrichment errors are logged and the results returned as-is.
+func WithEnricher(e Enricher) Option {
+	return func(wc *Checker) {
+		wc.enricher = e
+	}
+}
+
+// WithAPIKey sets the key sent in the X-API-Key header, replacing the key
+// passed to the constructor.
+func WithAPIKey(key string) Option {
+	return func(wc *Checker) {
+		wc.apiKey = key
+		wc.auth = nil
+	}
+}
+
+// WithBearerToken authenticates with "Authorization: Bearer <token>" instead
+// of the X-API-Key header, for accounts migrated to token auth.
+func WithBearerToken(token string) Option {
+	return WithAuthProvider(func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+token)
+	})
+}
+
+// WithAuthProvider replaces the built-in X-API-Key authentication: fn is
+// called on every API request to add whatever credentials the API expects.
+func WithAuthProvider(fn func(*http.Request)) Option {
+	return func(wc *Checker) {
+		wc.auth = fn
+	}
+}
+
+// WithCredentials loads the API key from p instead of the key passed to
+// NewWhatsAppChecker. The key is cached for five minutes, so rotated secrets
+// are picked up without restarting.
+func WithCredentials(p CredentialProvider) Option {
+	return func(wc *Checker) {
+		wc.credentials = &cachedCredentials{provider: p, ttl: 5 * time.Minute}
+	}
+}
+
+// WithEncryption encrypts downloaded and exported result files at rest with
+// AES-256-GCM. keys supplies the 32-byte key, base64 or hex encoded, e.g.
+// EnvCredentials("WACHECKER_ENCRYPTION_KEY") or SecretsManagerCredentials.
+func WithEncryption(keys CredentialProvider) Option {
+	return func(wc *Checker) {
+		wc.encryptionKeys = &cachedCredentials{provider: keys, ttl: 5 * time.Minute}
+	}
+}
+
+// WithKeyPool spreads requests across several API keys, failing over to the
+// next healthy key when one is rejected or out of quota.
+func WithKeyPool(p *KeyPool) Option {
+	return func(wc *Checker) {
+		wc.keyPool = p
+	}
+}
+
+var ErrNoHealthyKeys = errors.New("all API keys are unhealthy")
+
+// KeyPool hands out keys round-robin. A key answered with 401/403 or 402 is
+// benched for an hour; one answered with 429 is benched for Retry-After, or
+// Cooldown when the header is missing.
+type KeyPool struct {
+	Cooldown time.Duration
+
+	mu   sync.Mutex
+	keys []*pooledKey
+	next int
+}
+
+type pooledKey struct {
+	key            string
+	requests       int
+	unhealthyUntil time.Time
+	reason         string
+}
+
+type KeyStatus struct {
+	Key            string    `json:"key"`
+	Healthy        bool      `json:"healthy"`
+	Requests       int       `json:"requests"`
+	UnhealthyUntil time.Time `json:"unhealthy_until,omitzero"`
+	Reason         string    `json:"reason,omitempty"`
+}
+
+func NewKeyPool(keys ...string) *KeyPool {
+	p := &KeyPool{Cooldown: time.Minute}
+	for _, key := range keys {
+		if key = strings.TrimSpace(key); key != "" {
+			p.keys = append(p.keys, &pooledKey{key: key})
+		}
+	}
+	return p
+}
+
+func (p *KeyPool) pick() (string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for i := 0; i < len(p.keys); i++ {
+		k := p.keys[(p.next+i)%len(p.keys)]
+		if now.Before(k.unhealthyUntil) {
+			continue
+		}
+		p.next = (p.next + i + 1) % len(p.keys)
+		k.requests++
+		return k.key, nil
+	}
+	return "", ErrNoHealthyKeys
+}
+
+func (p *KeyPool) markUnhealthy(key, reason string, cooldown time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, k := range p.keys {
+		if k.key == key {
+			k.unhealthyUntil = time.Now().Add(cooldown)
+			k.reason = reason
+			log.Printf("API key %s marked unhealthy for %s: %s", maskKey(key), cooldown, reason)
+		}
+	}
+}
+
+// Status reports each key with all but its last four characters masked.
+func (p *KeyPool) Status() []KeyStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	statuses := make([]KeyStatus, len(p.keys))
+	for i, k := range p.keys {
+		statuses[i] = KeyStatus{Key: maskKey(k.key), Healthy: !now.Before(k.unhealthyUntil), Requests: k.requests}
+		if !statuses[i].Healthy {
+			statuses[i].UnhealthyUntil, statuses[i].Reason = k.unhealthyUntil, k.reason
+		}
+	}
+	return statuses
+}
+
+func maskKey(key string) string {
+	if len(key) <= 4 {
+		return "****"
+	}
+	return "****" + key[len(key)-4:]
+}
+
+// keyFailure classifies responses that say the key, not the request, is the
+// problem.
+func keyFailure(resp *http.Response, cooldown time.Duration) (string, time.Duration) {
+	switch resp.StatusCode {
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return "unauthorized", time.Hour
+	case http.StatusPaymentRequired:
+		return "quota exhausted", time.Hour
+	case http.StatusTooManyRequests:
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			cooldown = time.Duration(secs) * time.Second
+		}
+		return "rate limited", cooldown
+	}
+	return "", 0
+}
+
+// WithEndpointPool sends API calls to the fastest healthy base URL of p,
+// failing over to the next one on network errors and 5xx responses. All
+// URLs must front the same backend, since a task created through one is
+// polled through whichever is picked next.
+func WithEndpointPool(p *EndpointPool) Option {
+	return func(wc *Checker) {
+		wc.endpoints = p
+		if len(p.endpoints) > 0 {
+			wc.baseURL = p.endpoints[0].url
+		}
+	}
+}
+
+var ErrNoHealthyEndpoints = errors.New("all API endpoints are unhealthy")
+
+// EndpointPool tracks regional base URLs of the API. Requests go to the
+// healthy endpoint with the lowest smoothed latency; every tenth request
+// goes to the least recently used one instead, so a recovered or faster
+// region is noticed. A failing endpoint is benched for Cooldown.
+type EndpointPool struct {
+	Cooldown time.Duration
+
+	mu        sync.Mutex
+	endpoints []*endpoint
+	picks     int
+}
+
+type endpoint struct {
+	url            string
+	latency        time.Duration // exponentially weighted moving average
+	requests       int
+	failures       int
+	lastUsed       time.Time
+	unhealthyUntil time.Time
+	reason         string
+}
+
+type EndpointStatus struct {
+	URL            string        `json:"url"`
+	Healthy        bool          `json:"healthy"`
+	Latency        time.Duration `json:"latency"`
+	Requests       int           `json:"requests"`
+	Failures       int           `json:"failures"`
+	UnhealthyUntil time.Time     `json:"unhealthy_until,omitzero"`
+	Reason         string        `json:"reason,omitempty"`
+}
+
+func NewEndpointPool(baseURLs ...string) *EndpointPool {
+	p := &EndpointPool{Cooldown: 30 * time.Second}
+	for _, u := range baseURLs {
+		if u = strings.TrimSuffix(strings.TrimSpace(u), "/"); u != "" {
+			p.endpoints = append(p.endpoints, &endpoint{url: u})
+		}
+	}
+	return p
+}
+
+// pick returns the endpoint for the next attempt, skipping those already
+// tried for this request.
+func (p *EndpointPool) pick(tried map[*endpoint]bool) (*endpoint, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	p.picks++
+	explore := p.picks%10 == 0
+
+	var best *endpoint
+	for _, e := range p.endpoints {
+		if tried[e] || now.Before(e.unhealthyUntil) {
+			continue
+		}
+		switch {
+		case best == nil:
+			best = e
+		case explore && e.lastUsed.Before(best.lastUsed):
+			best = e
+		case !explore && e.latency < best.latency:
+			best = e
+		}
+	}
+	if best == nil {
+		return nil, ErrNoHealthyEndpoints
+	}
+	best.requests++
+	best.lastUsed = now
+	return best, nil
+}
+
+func (p *EndpointPool) observe(e *endpoint, latency time.Duration, failure string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if failure != "" {
+		e.failures++
+		e.unhealthyUntil = time.Now().Add(p.Cooldown)
+		e.reason = failure
+		// Measured afresh once it is back.
+		e.latency = 0
+		log.Printf("API endpoint %s marked unhealthy for %s: %s", e.url, p.Cooldown, failure)
+		return
+	}
+	if e.latency == 0 {
+		e.latency = latency
+	} else {
+		e.latency = (7*e.latency + 3*latency) / 10
+	}
+}
+
+func (p *EndpointPool) Status() []EndpointStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	statuses := make([]EndpointStatus, len(p.endpoints))
+	for i, e := range p.endpoints {
+		statuses[i] = EndpointStatus{URL: e.url, Healthy: !now.Before(e.unhealthyUntil), Latency: e.latency, Requests: e.requests, Failures: e.failures}
+		if !statuses[i].Healthy {
+			statuses[i].UnhealthyUntil, statuses[i].Reason = e.unhealthyUntil, e.reason
+		}
+	}
+	return statuses
+}
+
+// sendFailover sends req through the endpoint pool, moving on to the next
+// endpoint when one fails. Requests that may have reached the API, other
+// than reads, only fail over on 502, 503 and 504, which gateways send
+// without passing the request on.
+func (wc *Checker) sendFailover(op string, req *http.Request) (*http.Response, error) {
+	if wc.endpoints == nil || !strings.HasPrefix(req.URL.String(), wc.baseURL) {
+		return wc.send(op, req)
+	}
+
+	rest := strings.TrimPrefix(req.URL.String(), wc.baseURL)
+	idempotent := req.Method == http.MethodGet || req.Method == http.MethodHead
+	tried := make(map[*endpoint]bool)
+	var lastResp *http.Response
+	var lastErr error
+	for {
+		e, err := wc.endpoints.pick(tried)
+		if err != nil && len(tried) > 0 {
+			return lastResp, lastErr
+		}
+		if err != nil {
+			return nil, err
+		}
+		if lastResp != nil {
+			lastResp.Body.Close()
+		}
+		tried[e] = true
+
+		attempt := req.Clone(req.Context())
+		if attempt.URL, err = url.Parse(e.url + rest); err != nil {
+			return nil, fmt.Errorf("invalid endpoint %s: %v", e.url, err)
+		}
+		attempt.Host = ""
+		if req.Body != nil && len(tried) > 1 {
+			if req.GetBody == nil {
+				return nil, fmt.Errorf("cannot fail over %s request with a one-shot body", op)
+			}
+			if attempt.Body, err = req.GetBody(); err != nil {
+				return nil, fmt.Errorf("failed to rewind request body: %v", err)
+			}
+		}
+
+		start := time.Now()
+		resp, err := wc.send(op, attempt)
+		var failure string
+		switch {
+		case err != nil && req.Context().Err() == nil && (idempotent || notSent(err)):
+			failure = err.Error()
+		case err == nil && (resp.StatusCode == http.StatusBadGateway || resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout):
+			failure = fmt.Sprintf("HTTP %d", resp.StatusCode)
+		case err == nil && idempotent && resp.StatusCode >= 500:
+			failure = fmt.Sprintf("HTTP %d", resp.StatusCode)
+		}
+		wc.endpoints.observe(e, time.Since(start), failure)
+		if failure == "" {
+			return resp, err
+		}
+		lastResp, lastErr = resp, err
+		log.Printf("%s request %s failed on %s (%s), failing over", op, req.Header.Get(requestIDHeader), e.url, failure)
+	}
+}
+
+// WithUserAgent prefixes the default User-Agent with product, e.g.
+// "billing-sync/2.3 wachecker-go/1.0.0", so the library version is always
+// reported.
+func WithUserAgent(product string) Option {
+	return func(wc *Checker) {
+		wc.userAgent = product + " " + defaultUserAgent
+	}
+}
+
+// WithHeader adds a header to every API request, unless the request already
+// sets it. Repeat it to add several headers or values.
+func WithHeader(key, value string) Option {
+	return func(wc *Checker) {
+		if wc.defaultHeaders == nil {
+			wc.defaultHeaders = http.Header{}
+		}
+		wc.defaultHeaders.Add(key, value)
+	}
+}
+
+// WithRequestHook runs fn on every API request just before it is sent, after
+// authentication headers are set. Hooks run in the order they were added.
+func WithRequestHook(fn func(*http.Request)) Option {
+	return func(wc *Checker) {
+		wc.requestHooks = append(wc.requestHooks, fn)
+	}
+}
+
+// WithResponseHook runs fn on every API response before it is decoded. A hook
+// that reads the body must replace it so the checker can still decode it.
+func WithResponseHook(fn func(*http.Response)) Option {
+	return func(wc *Checker) {
+		wc.responseHooks = append(wc.responseHooks, fn)
+	}
+}
+
+// WithAccountURL overrides the account endpoint used by GetUsage, which
+// otherwise sits next to the tasks endpoint at ".../simple/account".
+func WithAccountURL(url string) Option {
+	return func(wc *Checker) {
+		wc.accountURL = url
+	}
+}
+
+// WithRealtimeURL overrides the single-number endpoint used by CheckSingle,
+// which otherwise sits next to the tasks endpoint at ".../simple/check".
+func WithRealtimeURL(url string) Option {
+	return func(wc *Checker) {
+		wc.realtimeURL = url
+	}
+}
+
+// WithBatchStatusURL overrides the endpoint CheckTaskStatuses uses to fetch
+// many tasks in one call, otherwise the tasks endpoint itself with a
+// task_ids parameter.
+func WithBatchStatusURL(url string) Option {
+	return func(wc *Checker) {
+		wc.batchStatusURL = url
+	}
+}
+
+// WithLowBalanceAlert calls fn whenever GetUsage sees a balance below
+// threshold.
+func WithLowBalanceAlert(threshold float64, fn func(*Usage)) Option {
+	return func(wc *Checker) {
+		wc.lowBalance = threshold
+		wc.onLowBalance = fn
+	}
+}
+
+// WithPricing sets the price charged per checked number, used by
+// EstimateCost and WithMaxCost.
+func WithPricing(perNumber float64) Option {
+	return func(wc *Checker) {
+		wc.pricePerNumber = perNumber
+	}
+}
+
+// WithMaxCost refuses uploads and jobs whose estimated cost exceeds max with
+// ErrCostExceeded. It requires WithPricing.
+func WithMaxCost(max float64) Option {
+	return func(wc *Checker) {
+		wc.maxCost = max
+	}
+}
+
+// WithDryRun plans jobs without submitting anything: RunJob returns the plan
+// in JobResult.Plan, and uploads fail with ErrDryRun.
+func WithDryRun() Option {
+	return func(wc *Checker) {
+		wc.dryRun = true
+	}
+}
+
+// WithTransport sends API calls and result downloads through rt, e.g. a
+// Cassette, a proxy-aware transport or a test server's client transport.
+func WithTransport(rt http.RoundTripper) Option {
+	return func(wc *Checker) {
+		wc.httpClient.Transport = rt
+		wc.downloadClient = &http.Client{Transport: rt}
+	}
+}
+
+// TransportOptions tunes connection reuse for high-throughput deployments.
+// Zero fields keep http.DefaultTransport's settings.
+type TransportOptions struct {
+	MaxIdleConns          int
+	MaxIdleConnsPerHost   int
+	MaxConnsPerHost       int
+	IdleConnTimeout       time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	DisableKeepAlives     bool
+
+	// ForceHTTP2 requires HTTP/2 on TLS connections instead of negotiating
+	// down to HTTP/1.1.
+	ForceHTTP2 bool
+}
+
+// WithTransportOptions builds the API and download transport from a clone
+// of http.DefaultTransport with opts applied, like WithTransport.
+func WithTransportOptions(opts TransportOptions) Option {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	if opts.MaxIdleConns > 0 {
+		t.MaxIdleConns = opts.MaxIdleConns
+	}
+	if opts.MaxIdleConnsPerHost > 0 {
+		t.MaxIdleConnsPerHost = opts.MaxIdleConnsPerHost
+	}
+	if opts.MaxConnsPerHost > 0 {
+		t.MaxConnsPerHost = opts.MaxConnsPerHost
+	}
+	if opts.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = opts.IdleConnTimeout
+	}
+	if opts.TLSHandshakeTimeout > 0 {
+		t.TLSHandshakeTimeout = opts.TLSHandshakeTimeout
+	}
+	if opts.ResponseHeaderTimeout > 0 {
+		t.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+	}
+	t.DisableKeepAlives = opts.DisableKeepAlives
+	if opts.ForceHTTP2 {
+		t.Protocols = new(http.Protocols)
+		t.Protocols.SetHTTP2(true)
+	}
+	return WithTransport(t)
+}
+
+// WithCircuitBreaker fails calls fast with ErrCircuitOpen while the API is
+// down. Share one breaker between checkers that talk to the same API.
+func WithCircuitBreaker(cb *CircuitBreaker) Option {
+	return func(wc *Checker) {
+		wc.breaker = cb
+	}
+}
+
+// WithGzipUpload gzip-compresses upload bodies, sent with Content-Encoding:
+// gzip. If the API rejects the encoding (415, or a 400 saying the encoding
+// is unsupported) the upload is repeated uncompressed and later uploads from
+// this checker skip compression.
+func WithGzipUpload() Option {
+	return func(wc *Checker) {
+		wc.gzipUpload = true
+	}
+}
+
+func gzipBytes(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to compress upload: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to compress upload: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// gzipUnsupported reports whether resp rejects the Content-Encoding rather
+// than the upload itself, which would fail uncompressed too. resp.Body stays
+// readable for the caller.
+func gzipUnsupported(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusUnsupportedMediaType:
+		return true
+	case http.StatusBadRequest:
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		msg := strings.ToLower(string(body))
+		return strings.Contains(msg, "encoding") && (strings.Contains(msg, "unsupported") || strings.Contains(msg, "not supported"))
+	}
+	return false
+}
+
+// WithRetryPolicy sets how often a request failing with a transient transport
+// error (see IsRetryable) is retried, waiting backoff, 2*backoff, ... between
+// attempts. The default is 2 retries from 500ms; retries 0 disables it.
+func WithRetryPolicy(retries int, backoff time.Duration) Option {
+	return func(wc *Checker) {
+		wc.retries = retries
+		wc.retryBackoff = backoff
+	}
+}
+
+// IsRetryable reports whether err is a transient transport failure worth
+// retrying: connection resets and refusals, unexpected EOFs, timeouts and DNS
+// lookup failures other than "no such host". Caller cancellation and errors
+// the API reported deliberately are not retryable.
+func IsRetryable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNABORTED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// notSent reports whether a failed request never reached the server, so even
+// a non-idempotent request like an upload can be replayed safely.
+func notSent(err error) bool {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) || errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+var ErrCircuitOpen = errors.New("circuit breaker open, API calls suspended")
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "half-open"
+)
+
+// CircuitBreaker opens after Threshold consecutive failures (network errors
+// or 5xx responses). After OpenFor it lets up to Probes requests through;
+// if they all succeed the circuit closes, and any failure reopens it.
+type CircuitBreaker struct {
+	Threshold int
+	OpenFor   time.Duration
+	Probes    int
+
+	mu        sync.Mutex
+	state     string
+	failures  int
+	openedAt  time.Time
+	inFlight  int
+	successes int
+}
+
+func NewCircuitBreaker(threshold int, openFor time.Duration) *CircuitBreaker {
+	return &CircuitBreaker{Threshold: threshold, OpenFor: openFor, Probes: 1, state: CircuitClosed}
+}
+
+func (cb *CircuitBreaker) State() string {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == CircuitOpen && time.Since(cb.openedAt) >= cb.OpenFor {
+		return CircuitHalfOpen
+	}
+	if cb.state == "" {
+		return CircuitClosed
+	}
+	return cb.state
+}
+
+func (cb *CircuitBreaker) allow() error {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case CircuitOpen:
+		if time.Since(cb.openedAt) < cb.OpenFor {
+			return ErrCircuitOpen
+		}
+		cb.state, cb.inFlight, cb.successes = CircuitHalfOpen, 0, 0
+		log.Printf("Circuit breaker half-open, probing API")
+		fallthrough
+	case CircuitHalfOpen:
+		if cb.inFlight >= cb.probes() {
+			return ErrCircuitOpen
+		}
+		cb.inFlight++
+	}
+	return nil
+}
+
+func (cb *CircuitBreaker) record(success bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	switch cb.state {
+	case CircuitHalfOpen:
+		cb.inFlight--
+		if !success {
+			cb.trip()
+			return
+		}
+		if cb.successes++; cb.successes >= cb.probes() {
+			cb.state, cb.failures = CircuitClosed, 0
+			log.Printf("Circuit breaker closed, API recovered")
+		}
+	default:
+		if success {
+			cb.failures = 0
+			return
+		}
+		if cb.failures++; cb.failures >= cb.Threshold {
+			cb.trip()
+		}
+	}
+}
+
+func (cb *CircuitBreaker) release() {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	if cb.state == CircuitHalfOpen {
+		cb.inFlight--
+	}
+}
+
+func (cb *CircuitBreaker) probes() int {
+	if cb.Probes < 1 {
+		return 1
+	}
+	return cb.Probes
+}
+
+func (cb *CircuitBreaker) trip() {
+	cb.state, cb.openedAt = CircuitOpen, time.Now()
+	log.Printf("Circuit breaker open for %s after repeated API failures", cb.OpenFor)
+}
+
+type CredentialProvider interface {
+	APIKey(ctx context.Context) (string, error)
+}
+
+type cachedCredentials struct {
+	provider CredentialProvider
+	ttl      time.Duration
+
+	mu      sync.Mutex
+	key     string
+	fetched time.Time
+}
+
+func (c *cachedCredentials) APIKey(ctx context.Context) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.key != "" && time.Since(c.fetched) < c.ttl {
+		return c.key, nil
+	}
+	key, err := c.provider.APIKey(ctx)
+	if err != nil {
+		return "", err
+	}
+	if key = strings.TrimSpace(key); key == "" {
+		return "", errors.New("credential provider returned an empty key")
+	}
+	c.key, c.fetched = key, time.Now()
+	return key, nil
+}
+
+// EnvCredentials reads the key from the named environment variable.
+type EnvCredentials string
+
+func (e EnvCredentials) APIKey(ctx context.Context) (string, error) {
+	key := os.Getenv(string(e))
+	if key == "" {
+		return "", fmt.Errorf("%s is not set", string(e))
+	}
+	return key, nil
+}
+
+// FileCredentials reads the key from a file, such as a mounted Kubernetes or
+// Docker secret. Files readable by other users are rejected.
+type FileCredentials string
+
+func (f FileCredentials) APIKey(ctx context.Context) (string, error) {
+	info, err := os.Stat(string(f))
+	if err != nil {
+		return "", fmt.Errorf("failed to stat key file: %v", err)
+	}
+	if info.Mode().Perm()&0o007 != 0 {
+		return "", fmt.Errorf("key file %s is readable by other users (mode %v)", f, info.Mode().Perm())
+	}
+	data, err := os.ReadFile(string(f))
+	if err != nil {
+		return "", fmt.Errorf("failed to read key file: %v", err)
+	}
+	return string(data), nil
+}
+
+// KeyringCredentials reads the key from the OS keychain through the platform
+// CLI: "security" on macOS and "secret-tool" (libsecret) on Linux.
+type KeyringCredentials struct {
+	Service string
+	Account string
+}
+
+func (k KeyringCredentials) APIKey(ctx context.Context) (string, error) {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		cmd = exec.CommandContext(ctx, "security", "find-generic-password", "-s", k.Service, "-a", k.Account, "-w")
+	case "linux", "freebsd", "openbsd":
+		cmd = exec.CommandContext(ctx, "secret-tool", "lookup", "service", k.Service, "account", k.Account)
+	default:
+		return "", fmt.Errorf("OS keyring is not supported on %s", runtime.GOOS)
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to read keyring entry %s/%s: %v", k.Service, k.Account, err)
+	}
+	return string(out), nil
+}
+
+// SecretsManagerCredentials reads the key from AWS Secrets Manager, using AWS
+// credentials from the environment. Field selects a key inside a JSON secret;
+// leave it empty for plain-text secrets.
+type SecretsManagerCredentials struct {
+	SecretID string
+	Field    string
+}
+
+func (sm SecretsManagerCredentials) APIKey(ctx context.Context) (string, error) {
+	region := os.Getenv("AWS_REGION")
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint := os.Getenv("AWS_ENDPOINT_URL_SECRETS_MANAGER")
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://secretsmanager.%s.amazonaws.com", region)
+	}
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey == "" || secretKey == "" {
+		return "", errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+
+	body, _ := json.Marshal(map[string]string{"SecretId": sm.SecretID})
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "secretsmanager.GetSecretValue")
+	bodyHash := sha256.Sum256(body)
+	signAWSV4(req, "secretsmanager", region, accessKey, secretKey, os.Getenv("AWS_SESSION_TOKEN"), hex.EncodeToString(bodyHash[:]), time.Now())
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("GetSecretValue failed: HTTP %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+
+	var out struct {
+		SecretString string `json:"SecretString"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("failed to decode secret: %v", err)
+	}
+	return secretField(out.SecretString, sm.Field)
+}
+
+// VaultCredentials reads the key from a HashiCorp Vault KV secret, e.g.
+// Path "secret/data/wachecker" (KV v2) with Field "api_key". Addr and Token
+// default to VAULT_ADDR and VAULT_TOKEN.
+type VaultCredentials struct {
+	Addr  string
+	Token string
+	Path  string
+	Field string
+}
+
+func (v VaultCredentials) APIKey(ctx context.Context) (string, error) {
+	addr, token := v.Addr, v.Token
+	if addr == "" {
+		addr = os.Getenv("VAULT_ADDR")
+	}
+	if token == "" {
+		token = os.Getenv("VAULT_TOKEN")
+	}
+	if addr == "" || token == "" {
+		return "", errors.New("vault address and token are required")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", strings.TrimSuffix(addr, "/")+"/v1/"+strings.TrimPrefix(v.Path, "/"), nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("vault read %s failed: HTTP %d", v.Path, resp.StatusCode)
+	}
+
+	var out struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return "", fmt.Errorf("failed to decode secret: %v", err)
+	}
+	// KV v2 nests the secret under data.data; KV v1 returns it directly.
+	data := out.Data
+	if nested, ok := data["data"]; ok {
+		if err := json.Unmarshal(nested, &data); err != nil {
+			return "", fmt.Errorf("failed to decode secret: %v", err)
+		}
+	}
+	field := v.Field
+	if field == "" {
+		field = "api_key"
+	}
+	var key string
+	if err := json.Unmarshal(data[field], &key); err != nil {
+		return "", fmt.Errorf("secret %s has no string field %q", v.Path, field)
+	}
+	return key, nil
+}
+
+func secretField(secret, field string) (string, error) {
+	if field == "" {
+		return secret, nil
+	}
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(secret), &fields); err != nil {
+		return "", fmt.Errorf("secret is not a JSON object: %v", err)
+	}
+	value, ok := fields[field].(string)
+	if !ok {
+		return "", fmt.Errorf("secret has no string field %q", field)
+	}
+	return value, nil
+}
+
+// credentialsFromEnv picks a provider from WHATSAPP_API_KEY_FILE,
+// WHATSAPP_API_KEY_SECRET (AWS Secrets Manager ID, optionally "id#field"),
+// WHATSAPP_API_KEY_VAULT ("path#field") or WHATSAPP_API_KEY_KEYRING
+// ("service/account"), so the key itself never has to be exported.
+func credentialsFromEnv() CredentialProvider {
+	return providerFromEnv("WHATSAPP_API_KEY")
+}
+
+// encryptionKeysFromEnv reads the result encryption key from
+// WACHECKER_ENCRYPTION_KEY, or from the same _FILE, _SECRET, _VAULT and
+// _KEYRING variants as the API key.
+func encryptionKeysFromEnv() CredentialProvider {
+	if os.Getenv("WACHECKER_ENCRYPTION_KEY") != "" {
+		return EnvCredentials("WACHECKER_ENCRYPTION_KEY")
+	}
+	return providerFromEnv("WACHECKER_ENCRYPTION_KEY")
+}
+
+func providerFromEnv(prefix string) CredentialProvider {
+	if path := os.Getenv(prefix + "_FILE"); path != "" {
+		return FileCredentials(path)
+	}
+	if spec := os.Getenv(prefix + "_SECRET"); spec != "" {
+		id, field, _ := strings.Cut(spec, "#")
+		return SecretsManagerCredentials{SecretID: id, Field: field}
+	}
+	if spec := os.Getenv(prefix + "_VAULT"); spec != "" {
+		path, field, _ := strings.Cut(spec, "#")
+		return VaultCredentials{Path: path, Field: field}
+	}
+	if spec := os.Getenv(prefix + "_KEYRING"); spec != "" {
+		service, account, _ := strings.Cut(spec, "/")
+		return KeyringCredentials{Service: service, Account: account}
+	}
+	return nil
+}
+
+var ErrNoEncryptionKey = errors.New("no encryption key configured")
+
+// ParseEncryptionKey decodes a base64 or hex encoded AES-256 key, as
+// generated by "openssl rand -base64 32".
+func ParseEncryptionKey(encoded string) ([]byte, error) {
+	encoded = strings.TrimSpace(encoded)
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(key) != 32 {
+		key, err = hex.DecodeString(encoded)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, errors.New("encryption key must be 32 bytes, base64 or hex encoded")
+	}
+	return key, nil
+}
+
+// encryptionKey returns nil when encryption is not configured.
+func (wc *Checker) encryptionKey(ctx context.Context) ([]byte, error) {
+	if wc.encryptionKeys == nil {
+		return nil, nil
+	}
+	encoded, err := wc.encryptionKeys.APIKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get encryption key: %v", err)
+	}
+	return ParseEncryptionKey(encoded)
+}
+
+// Encrypted files start with encryptionMagic and a random nonce prefix,
+// followed by segments of at most encryptionSegment plaintext bytes. Each
+// segment is a flag byte (1 on the last one), its ciphertext length and
+// the AES-GCM ciphertext, sealed with the prefix, a segment counter and the
+// flag as nonce, so reordered, truncated or extended files fail to decrypt.
+const (
+	encryptionMagic   = "WAENC1"
+	encryptionSegment = 64 << 10
+)
+
+type encryptWriter struct {
+	w      io.Writer
+	aead   cipher.AEAD
+	prefix []byte
+	seq    uint32
+	buf    []byte
+}
+
+// NewEncryptWriter encrypts everything written to it onto w. Close writes
+// the final segment and must be called; it does not close w.
+func NewEncryptWriter(w io.Writer, key []byte) (io.WriteCloser, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, aead.NonceSize()-5)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	if _, err := io.WriteString(w, encryptionMagic); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(prefix); err != nil {
+		return nil, err
+	}
+	return &encryptWriter{w: w, aead: aead, prefix: prefix, buf: make([]byte, 0, encryptionSegment)}, nil
+}
+
+func (ew *encryptWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		if len(ew.buf) == cap(ew.buf) {
+			if err := ew.seal(0); err != nil {
+				return written, err
+			}
+		}
+		n := copy(ew.buf[len(ew.buf):cap(ew.buf)], p)
+		ew.buf = ew.buf[:len(ew.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (ew *encryptWriter) Close() error {
+	return ew.seal(1)
+}
+
+func (ew *encryptWriter) seal(flag byte) error {
+	if ew.seq == math.MaxUint32 {
+		return errors.New("encrypted file too large")
+	}
+	ciphertext := ew.aead.Seal(nil, segmentNonce(ew.prefix, ew.seq, flag), ew.buf, nil)
+	header := []byte{flag, byte(len(ciphertext) >> 24), byte(len(ciphertext) >> 16), byte(len(ciphertext) >> 8), byte(len(ciphertext))}
+	if _, err := ew.w.Write(header); err != nil {
+		return err
+	}
+	if _, err := ew.w.Write(ciphertext); err != nil {
+		return err
+	}
+	ew.seq++
+	ew.buf = ew.buf[:0]
+	return nil
+}
+
+type decryptReader struct {
+	r      io.Reader
+	aead   cipher.AEAD
+	prefix []byte
+	seq    uint32
+	buf    []byte
+	done   bool
+}
+
+// NewDecryptReader reads a file written by NewEncryptWriter. Reads fail
+// if the file was truncated or tampered with, so a successful read to EOF
+// means the whole file was authentic.
+func NewDecryptReader(r io.Reader, key []byte) (io.Reader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(encryptionMagic)+aead.NonceSize()-5)
+	if _, err := io.ReadFull(r, header); err != nil || string(header[:len(encryptionMagic)]) != encryptionMagic {
+		return nil, errors.New("not an encrypted results file")
+	}
+	return &decryptReader{r: r, aead: aead, prefix: header[len(encryptionMagic):]}, nil
+}
+
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.buf) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+		if err := dr.open(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, dr.buf)
+	dr.buf = dr.buf[n:]
+	return n, nil
+}
+
+func (dr *decryptReader) open() error {
+	var header [5]byte
+	if _, err := io.ReadFull(dr.r, header[:]); err != nil {
+		return errors.New("encrypted file is truncated")
+	}
+	size := int(header[1])<<24 | int(header[2])<<16 | int(header[3])<<8 | int(header[4])
+	if header[0] > 1 || size > encryptionSegment+dr.aead.Overhead() {
+		return errors.New("encrypted file is corrupt")
+	}
+	ciphertext := make([]byte, size)
+	if _, err := io.ReadFull(dr.r, ciphertext); err != nil {
+		return errors.New("encrypted file is truncated")
+	}
+	plaintext, err := dr.aead.Open(ciphertext[:0], segmentNonce(dr.prefix, dr.seq, header[0]), ciphertext, nil)
+	if err != nil {
+		return errors.New("decryption failed: wrong key or corrupt file")
+	}
+	dr.seq++
+	dr.buf = plaintext
+	if header[0] == 1 {
+		dr.done = true
+		if n, _ := dr.r.Read(make([]byte, 1)); n > 0 {
+			return errors.New("encrypted file has trailing data")
+		}
+	}
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+func segmentNonce(prefix []byte, seq uint32, flag byte) []byte {
+	nonce := append([]byte{}, prefix...)
+	return append(nonce, byte(seq>>24), byte(seq>>16), byte(seq>>8), byte(seq), flag)
+}
+
+// HashNumber returns a keyed hash of the normalized number, so the same
+// number always hashes the same under one salt but cannot be recovered or
+// brute-forced without it. Values that are already hashes are returned
+// unchanged, so results can safely be redacted twice.
+func HashNumber(number string, salt []byte) string {
+	if strings.HasPrefix(number, "h:") {
+		return number
+	}
+	mac := hmac.New(sha256.New, salt)
+	mac.Write([]byte(cmp.Or(NormalizeNumber(number), strings.TrimSpace(number))))
+	return "h:" + hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// Hashed returns a copy of the results with every number replaced by its
+// HashNumber.
+func (rs Results) Hashed(salt []byte) Results {
+	hashed := make(Results, len(rs))
+	for i, r := range rs {
+		r.Number = HashNumber(r.Number, salt)
+		hashed[i] = r
+	}
+	return hashed
+}
+
+// Hashed returns a copy of the report with raw and repaired values replaced
+// by their HashNumber.
+func (r *ValidationReport) Hashed(salt []byte) *ValidationReport {
+	hashed := *r
+	hashed.Issues = make([]ValidationIssue, len(r.Issues))
+	for i, issue := range r.Issues {
+		issue.Raw = HashNumber(issue.Raw, salt)
+		if issue.Repaired != "" {
+			issue.Repaired = HashNumber(issue.Repaired, salt)
+		}
+		hashed.Issues[i] = issue
+	}
+	return &hashed
+}
+
+// NumberIndex maps hashes back to the raw numbers they were made from. It
+// is built from the caller's own input and never persisted.
+type NumberIndex map[string]string
+
+func NewNumberIndex(numbers []string, salt []byte) NumberIndex {
+	index := make(NumberIndex, len(numbers))
+	for _, number := range numbers {
+		index[HashNumber(number, salt)] = number
+	}
+	return index
+}
+
+// Restore returns a copy of hashed results with the raw numbers put back;
+// results whose hash is not in the index keep it.
+func (ix NumberIndex) Restore(results Results) Results {
+	restored := make(Results, len(results))
+	for i, r := range results {
+		if number, ok := ix[r.Number]; ok {
+			r.Number = number
+		}
+		restored[i] = r
+	}
+	return restored
+}
+
+// redact returns the value to write to logs and files for a number.
+func (wc *Checker) redact(number string) string {
+	if wc.piiSalt == nil {
+		return number
+	}
+	return HashNumber(number, wc.piiSalt)
+}
+
+func (wc *Checker) redactResults(results Results) Results {
+	if wc.piiSalt == nil {
+		return results
+	}
+	return results.Hashed(wc.piiSalt)
+}
+
+// sealBytes encrypts data as WithEncryption does for result files, or
+// returns it unchanged when encryption is not configured.
+func (wc *Checker) sealBytes(data []byte) ([]byte, error) {
+	key, err := wc.encryptionKey(context.Background())
+	if err != nil || key == nil {
+		return data, err
+	}
+	var buf bytes.Buffer
+	ew, err := NewEncryptWriter(&buf, key)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := ew.Write(data); err != nil {
+		return nil, fmt.Errorf("failed to encrypt: %v", err)
+	}
+	if err := ew.Close(); err != nil {
+		return nil, fmt.Errorf("failed to encrypt: %v", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// DecryptFile decrypts src, written by a Checker with WithEncryption, to
+// dst. dst is only created once the whole file has been authenticated.
+func DecryptFile(src, dst string, key []byte) error {
+	file, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+	r, err := NewDecryptReader(bufio.NewReader(file), key)
+	if err != nil {
+		return err
+	}
+	plaintext, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(dst, plaintext, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %v", dst, err)
+	}
+	return nil
+}
+
+type progressReader struct {
+	r          io.Reader
+	sent       int64
+	total      int64
+	onProgress func(sent, total int64)
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	if n > 0 {
+		pr.sent += int64(n)
+		pr.onProgress(pr.sent, pr.total)
+	}
+	return n, err
+}
+
+// RateLimiter is a token bucket refilled at rps tokens per second. A rate
+// that is not positive, or infinite, means no limit.
+type RateLimiter struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(rps float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &RateLimiter{
+		rate:   rps,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+func (rl *RateLimiter) Wait(ctx context.Context) error {
+	if !(rl.rate > 0) || math.IsInf(rl.rate, 1) {
+		return nil
+	}
+	for {
+		rl.mu.Lock()
+		now := time.Now()
+		rl.tokens = math.Min(rl.burst, rl.tokens+now.Sub(rl.last).Seconds()*rl.rate)
+		rl.last = now
+		if rl.tokens >= 1 {
+			rl.tokens--
+			rl.mu.Unlock()
+			return nil
+		}
+		wait := time.Duration((1 - rl.tokens) / rl.rate * float64(time.Second))
+		rl.mu.Unlock()
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+type WhatsAppResponse struct {
+	CreatedAt Timestamp  `json:"created_at"`
+	UpdatedAt Timestamp  `json:"updated_at"`
+	TaskID    string     `json:"task_id"`
+	UserID    string     `json:"user_id"`
+	Status    TaskStatus `json:"status"`
+	Total     int        `json:"total"`
+	Success   int        `json:"success"`
+	Failure   int        `json:"failure"`
+	ResultURL string     `json:"result_url,omitempty"`
+
+	// RateLimit is the quota reported with this response, if any.
+	RateLimit *RateLimitInfo `json:"-"`
+}
+
+// RateLimitInfo mirrors the X-RateLimit-* response headers. Fields the API
+// did not send are left at -1 (counts) or zero (Reset).
+type RateLimitInfo struct {
+	Limit     int       `json:"limit"`
+	Remaining int       `json:"remaining"`
+	Reset     time.Time `json:"reset,omitzero"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func parseRateLimit(h http.Header) (RateLimitInfo, bool) {
+	info := RateLimitInfo{Limit: -1, Remaining: -1}
+	found := false
+	if n, err := strconv.Atoi(h.Get("X-RateLimit-Limit")); err == nil {
+		info.Limit, found = n, true
+	}
+	if n, err := strconv.Atoi(h.Get("X-RateLimit-Remaining")); err == nil {
+		info.Remaining, found = n, true
+	}
+	// Reset is sent either as a Unix timestamp or as seconds from now.
+	if n, err := strconv.ParseInt(h.Get("X-RateLimit-Reset"), 10, 64); err == nil {
+		if n > 1e9 {
+			info.Reset = time.Unix(n, 0)
+		} else {
+			info.Reset = time.Now().Add(time.Duration(n) * time.Second)
+		}
+		found = true
+	}
+	info.UpdatedAt = time.Now()
+	return info, found
+}
+
+// Duration is the task runtime so far, or zero when either timestamp is
+// missing or unparseable.
+func (r *WhatsAppResponse) Duration() time.Duration {
+	if r.CreatedAt.IsZero() || r.UpdatedAt.IsZero() {
+		return 0
+	}
+	return r.UpdatedAt.Sub(r.CreatedAt.Time)
+}
+
+// Timestamp keeps the raw API value alongside the parsed time, since the
+// API does not document a single layout.
+type Timestamp struct {
+	time.Time
+	Raw string
+}
+
+var timestampLayouts = []string{
+	time.RFC3339Nano,
+	"2006-01-02T15:04:05.999999999",
+	"2006-01-02 15:04:05.999999999Z07:00",
+	"2006-01-02 15:04:05.999999999",
+}
+
+func (t *Timestamp) UnmarshalJSON(data []byte) error {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return fmt.Errorf("invalid timestamp %s: %v", data, err)
+	}
+
+	switch v := raw.(type) {
+	case string:
+		t.Raw = v
+		for _, layout := range timestampLayouts {
+			if parsed, err := time.Parse(layout, v); err == nil {
+				t.Time = parsed
+				break
+			}
+		}
+	case float64:
+		t.Raw = strconv.FormatFloat(v, 'f', -1, 64)
+		sec, frac := math.Modf(v)
+		t.Time = time.Unix(int64(sec), int64(frac*1e9)).UTC()
+	}
+	return nil
+}
+
+func (t Timestamp) MarshalJSON() ([]byte, error) {
+	if t.Raw == "" && !t.IsZero() {
+		return json.Marshal(t.Time.Format(time.RFC3339Nano))
+	}
+	return json.Marshal(t.Raw)
+}
+
+type TaskStatus string
+
+// StatusCompleted means checking finished but the result file is not yet
+// exported, so it is not terminal: polling continues until StatusExported.
+const (
+	StatusPending    TaskStatus = "pending"
+	StatusProcessing TaskStatus = "processing"
+	StatusCompleted  TaskStatus = "completed"
+	StatusExported   TaskStatus = "exported"
+	StatusFailed     TaskStatus = "failed"
+)
+
+func (s TaskStatus) IsTerminal() bool {
+	return s == StatusExported || s == StatusFailed
+}
+
+func (s TaskStatus) IsKnown() bool {
+	switch s {
+	case StatusPending, StatusProcessing, StatusCompleted, StatusExported, StatusFailed:
+		return true
+	}
+	return false
+}
+
+// UnmarshalJSON never fails on unexpected values, so new API states are
+// treated as non-terminal instead of aborting a poll.
+func (s *TaskStatus) UnmarshalJSON(data []byte) error {
+	var raw interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		*s = TaskStatus(strings.Trim(string(data), `"`))
+		return nil
+	}
+
+	switch v := raw.(type) {
+	case string:
+		*s = TaskStatus(strings.ToLower(strings.TrimSpace(v)))
+	case nil:
+		*s = ""
+	default:
+		*s = TaskStatus(fmt.Sprint(v))
+	}
+	return nil
+}
+
+// NumberResult is one row of a result file. Country and Region are derived
+// from the number's calling code when results are parsed; Carrier and
+// LineType are filled in by an Enricher, if one is configured.
+type NumberResult struct {
+	Number   string `json:"number"`
+	WhatsApp string `json:"whatsapp"`
+	Country  string `json:"country,omitempty"`
+	Region   string `json:"region,omitempty"`
+	Carrier  string `json:"carrier,omitempty"`
+	LineType string `json:"line_type,omitempty"`
+}
+
+// Placeholder values used when a number was not sent to the API.
+const (
+	ResultUnchecked = "unchecked"
+	ResultInvalid   = "invalid"
+)
+
+// Unchecked reports whether the remote check was skipped for this number.
+func (r NumberResult) Unchecked() bool {
+	return r.WhatsApp == ResultUnchecked
+}
+
+// Failed reports whether the check itself errored, as opposed to the number
+// simply not being on WhatsApp.
+func (r NumberResult) Failed() bool {
+	switch strings.ToLower(r.WhatsApp) {
+	case "yes", "no":
+		return false
+	}
+	return true
+}
+
+type Results []NumberResult
+
+// ResultPredicate selects results for Filter and Partition.
+type ResultPredicate func(NumberResult) bool
+
+// Filter returns the results matching every predicate, in order.
+func Filter(results Results, preds ...ResultPredicate) Results {
+	matched, _ := Partition(results, preds...)
+	return matched
+}
+
+// Partition splits results into those matching every predicate and the
+// rest, keeping their order.
+func Partition(results Results, preds ...ResultPredicate) (matched, rest Results) {
+	for _, r := range results {
+		if matchesAll(r, preds) {
+			matched = append(matched, r)
+		} else {
+			rest = append(rest, r)
+		}
+	}
+	return matched, rest
+}
+
+func matchesAll(r NumberResult, preds []ResultPredicate) bool {
+	for _, pred := range preds {
+		if !pred(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// OnlyWhatsApp matches numbers that are on WhatsApp.
+func OnlyWhatsApp() ResultPredicate {
+	return func(r NumberResult) bool { return strings.EqualFold(r.WhatsApp, "yes") }
+}
+
+// OnlyFailed matches numbers whose check errored or was skipped.
+func OnlyFailed() ResultPredicate {
+	return NumberResult.Failed
+}
+
+// ByCountry matches numbers from one of the given ISO 3166 countries, using
+// the parsed Country or else the number's calling code.
+func ByCountry(countries ...string) ResultPredicate {
+	want := make(map[string]bool, len(countries))
+	for _, c := range countries {
+		want[strings.ToUpper(c)] = true
+	}
+	return func(r NumberResult) bool {
+		country := r.Country
+		if country == "" {
+			country = CountryForNumber(NormalizeNumber(r.Number))
+		}
+		return want[country]
+	}
+}
+
+// ResultConflict is a number that got different answers in the sets given
+// to MergeResults. Values lists them in set order; Kept is the one merged.
+type ResultConflict struct {
+	Number string
+	Values []string
+	Kept   string
+}
+
+// MergeResults combines the results of several tasks, such as the chunks of
+// one job, into one entry per number. Sets are taken as oldest first, so a
+// later answer replaces an earlier one, except that a failed or skipped
+// check never replaces a definitive yes or no. Numbers keep the position
+// they were first seen at.
+func MergeResults(sets ...[]NumberResult) (Results, []ResultConflict) {
+	var merged Results
+	index := make(map[string]int)
+	values := make(map[string][]string)
+	for _, set := range sets {
+		for _, r := range set {
+			key := cmp.Or(NormalizeNumber(r.Number), r.Number)
+			i, seen := index[key]
+			if !seen {
+				index[key] = len(merged)
+				merged = append(merged, r)
+				values[key] = []string{r.WhatsApp}
+				continue
+			}
+			values[key] = append(values[key], r.WhatsApp)
+			if !r.Failed() || merged[i].Failed() {
+				merged[i] = r
+			}
+		}
+	}
+
+	var conflicts []ResultConflict
+	for _, r := range merged {
+		key := cmp.Or(NormalizeNumber(r.Number), r.Number)
+		for _, v := range values[key][1:] {
+			if !strings.EqualFold(v, values[key][0]) {
+				conflicts = append(conflicts, ResultConflict{Number: r.Number, Values: values[key], Kept: r.WhatsApp})
+				break
+			}
+		}
+	}
+	return merged, conflicts
+}
+
+// ResultColumns is a columnar view of results for fast filtering over large
+// sets. It is not an Arrow record batch: building one needs the arrow module,
+// which the example does not import, but each slice can be copied into one
+// string column of a batch with a builder's AppendValues.
+type ResultColumns struct {
+	Number   []string
+	WhatsApp []string
+}
+
+func (rs Results) Columns() ResultColumns {
+	cols := ResultColumns{
+		Number:   make([]string, len(rs)),
+		WhatsApp: make([]string, len(rs)),
+	}
+	for i, r := range rs {
+		cols.Number[i] = r.Number
+		cols.WhatsApp[i] = r.WhatsApp
+	}
+	return cols
+}
+
+func (c ResultColumns) Len() int {
+	return len(c.Number)
+}
+
+// Results converts the columns back into rows. Only the number and whatsapp
+// columns are carried, so derived fields such as Country are left empty.
+func (c ResultColumns) Results() Results {
+	rs := make(Results, c.Len())
+	for i := range rs {
+		rs[i] = NumberResult{Number: c.Number[i], WhatsApp: c.WhatsApp[i]}
+	}
+	return rs
+}
+
+// Select returns the row indexes whose whatsapp column equals value, without
+// materialising intermediate results.
+func (c ResultColumns) Select(value string) []int {
+	var idx []int
+	for i, v := range c.WhatsApp {
+		if v == value {
+			idx = append(idx, i)
+		}
+	}
+	return idx
+}
+
+// ResultDiff compares two runs over the same numbers. Gained and Lost hold
+// the newer results whose WhatsApp status flipped; numbers whose check failed
+// in either run are counted as Inconclusive rather than treated as a change.
+type ResultDiff struct {
+	Gained       Results `json:"gained"`
+	Lost         Results `json:"lost"`
+	Added        Results `json:"added"`
+	Removed      Results `json:"removed"`
+	Unchanged    int     `json:"unchanged"`
+	Inconclusive int     `json:"inconclusive"`
+}
+
+// DiffResults matches numbers by their normalized form, so "+31 6 1234" and
+// "+316 1234" in different exports are recognised as the same number.
+func DiffResults(old, new Results) *ResultDiff {
+	before := make(map[string]NumberResult, len(old))
+	for _, r := range old {
+		before[NormalizeNumber(r.Number)] = r
+	}
+
+	diff := &ResultDiff{}
+	seen := make(map[string]bool, len(new))
+	for _, r := range new {
+		key := NormalizeNumber(r.Number)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		prev, ok := before[key]
+		switch {
+		case !ok:
+			diff.Added = append(diff.Added, r)
+		case prev.Failed() || r.Failed():
+			diff.Inconclusive++
+		case strings.EqualFold(prev.WhatsApp, r.WhatsApp):
+			diff.Unchanged++
+		case strings.EqualFold(r.WhatsApp, "yes"):
+			diff.Gained = append(diff.Gained, r)
+		default:
+			diff.Lost = append(diff.Lost, r)
+		}
+	}
+	for _, r := range old {
+		key := NormalizeNumber(r.Number)
+		if !seen[key] {
+			seen[key] = true
+			diff.Removed = append(diff.Removed, r)
+		}
+	}
+	return diff
+}
+
+type StatusCounts struct {
+	Total        int     `json:"total"`
+	Yes          int     `json:"yes"`
+	No           int     `json:"no"`
+	Failed       int     `json:"failed"`
+	Unchecked    int     `json:"unchecked,omitempty"`
+	FailureRatio float64 `json:"failure_ratio"`
+}
+
+func (c *StatusCounts) add(r NumberResult) {
+	c.Total++
+	switch {
+	case r.Unchecked():
+		c.Unchecked++
+	case r.Failed():
+		c.Failed++
+	case strings.EqualFold(r.WhatsApp, "yes"):
+		c.Yes++
+	default:
+		c.No++
+	}
+	c.FailureRatio = float64(c.Failed) / float64(c.Total)
+}
+
+// ResultSummary aggregates a result set. ByStatus keeps the raw whatsapp
+// values, so unexpected failure reasons stay visible.
+type ResultSummary struct {
+	StatusCounts
+	ByStatus  map[string]int           `json:"by_status"`
+	ByCountry map[string]*StatusCounts `json:"by_country"`
+}
+
+func Summarize(results Results) *ResultSummary {
+	s := &ResultSummary{
+		ByStatus:  make(map[string]int),
+		ByCountry: make(map[string]*StatusCounts),
+	}
+	for _, r := range results {
+		s.add(r)
+		s.ByStatus[strings.ToLower(r.WhatsApp)]++
+
+		country := CountryForNumber(NormalizeNumber(r.Number))
+		if s.ByCountry[country] == nil {
+			s.ByCountry[country] = &StatusCounts{}
+		}
+		s.ByCountry[country].add(r)
+	}
+	return s
+}
+
+func (s *ResultSummary) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
+
+func (s *ResultSummary) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Total:\t%d\n", s.Total)
+	fmt.Fprintf(tw, "WhatsApp:\t%d\n", s.Yes)
+	fmt.Fprintf(tw, "Not on WhatsApp:\t%d\n", s.No)
+	fmt.Fprintf(tw, "Failed:\t%d (%.1f%%)\n", s.Failed, 100*s.FailureRatio)
+	if s.Unchecked > 0 {
+		fmt.Fprintf(tw, "Unchecked:\t%d (no API key, remote check skipped)\n", s.Unchecked)
+	}
+
+	fmt.Fprintln(tw, "\nSTATUS\tCOUNT")
+	for _, status := range sortedKeys(s.ByStatus) {
+		fmt.Fprintf(tw, "%s\t%d\n", status, s.ByStatus[status])
+	}
+
+	fmt.Fprintln(tw, "\nCOUNTRY\tTOTAL\tYES\tNO\tFAILED\tFAILURE RATIO")
+	for _, country := range sortedKeys(s.ByCountry) {
+		c := s.ByCountry[country]
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%.1f%%\n", country, c.Total, c.Yes, c.No, c.Failed, 100*c.FailureRatio)
+	}
+	return tw.Flush()
+}
+
+// WriteHTML renders the summary as a self-contained HTML page, with inline
+// styles and no scripts, that can be attached to an email or shared as-is.
+func (s *ResultSummary) WriteHTML(w io.Writer, title string) error {
+	type bar struct {
+		Label   string
+		Count   int
+		Percent float64
+		Color   string
+	}
+	type country struct {
+		Code string
+		*StatusCounts
+	}
+	data := struct {
+		Title     string
+		Generated string
+		*ResultSummary
+		Bars      []bar
+		Countries []country
+	}{Title: title, Generated: time.Now().Format(time.RFC1123), ResultSummary: s}
+
+	colors := map[string]string{"yes": "#25d366", "no": "#8696a0", ResultUnchecked: "#53bdeb"}
+	for _, status := range sortedKeys(s.ByStatus) {
+		b := bar{Label: status, Count: s.ByStatus[status], Color: colors[status]}
+		if b.Color == "" {
+			b.Color = "#ea0038"
+		}
+		if s.Total > 0 {
+			b.Percent = 100 * float64(b.Count) / float64(s.Total)
+		}
+		data.Bars = append(data.Bars, b)
+	}
+	for _, code := range sortedKeys(s.ByCountry) {
+		data.Countries = append(data.Countries, country{code, s.ByCountry[code]})
+	}
+	return htmlReport.Execute(w, data)
+}
+
+var htmlReport = template.Must(template.New("report").Funcs(template.FuncMap{
+	"pct": func(f float64) string { return strconv.FormatFloat(100*f, 'f', 1, 64) + "%" },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>{{.Title}}</title>
+<style>
+body { font-family: -apple-system, "Segoe UI", Helvetica, Arial, sans-serif; color: #111b21; margin: 2rem auto; max-width: 56rem; padding: 0 1rem; }
+h1 { font-size: 1.5rem; margin-bottom: 0.25rem; }
+.meta { color: #667781; margin-top: 0; }
+table { border-collapse: collapse; width: 100%; margin: 1rem 0 2rem; }
+th, td { padding: 0.4rem 0.75rem; border-bottom: 1px solid #e9edef; text-align: right; }
+th:first-child, td:first-child { text-align: left; }
+th { background: #f0f2f5; }
+.chart td { border: none; }
+.track { background: #f0f2f5; width: 60%; }
+.fill { height: 1rem; }
+</style>
+</head>
+<body>
+<h1>{{.Title}}</h1>
+<p class="meta">Generated {{.Generated}}</p>
+
+<h2>Summary</h2>
+<table>
+<tr><th>Total</th><th>WhatsApp</th><th>Not on WhatsApp</th><th>Failed</th>{{if .Unchecked}}<th>Unchecked</th>{{end}}<th>Failure ratio</th></tr>
+<tr><td>{{.Total}}</td><td>{{.Yes}}</td><td>{{.No}}</td><td>{{.Failed}}</td>{{if .Unchecked}}<td>{{.Unchecked}}</td>{{end}}<td>{{pct .FailureRatio}}</td></tr>
+</table>
+
+<h2>Status breakdown</h2>
+<table class="chart">
+{{range .Bars}}<tr><td>{{.Label}}</td><td class="track"><div class="fill" style="width: {{printf "%.1f" .Percent}}%; background: {{.Color}}"></div></td><td>{{.Count}}</td><td>{{printf "%.1f" .Percent}}%</td></tr>
+{{end}}</table>
+
+<h2>By country</h2>
+<table>
+<tr><th>Country</th><th>Total</th><th>WhatsApp</th><th>Not on WhatsApp</th><th>Failed</th><th>Failure ratio</th></tr>
+{{range .Countries}}<tr><td>{{.Code}}</td><td>{{.Total}}</td><td>{{.Yes}}</td><td>{{.No}}</td><td>{{.Failed}}</td><td>{{pct .FailureRatio}}</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+func (rs Results) ExportCSV(w io.Writer) error {
+	return rs.exportCSV(w, true)
+}
+
+func (rs Results) exportCSV(w io.Writer, header bool) error {
+	cw := csv.NewWriter(w)
+	if header {
+		if err := cw.Write([]string{"number", "whatsapp"}); err != nil {
+			return fmt.Errorf("failed to write csv: %v", err)
+		}
+	}
+	for _, r := range rs {
+		if err := cw.Write([]string{r.Number, r.WhatsApp}); err != nil {
+			return fmt.Errorf("failed to write csv: %v", err)
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (rs Results) ExportJSON(w io.Writer) error {
+	if rs == nil {
+		rs = Results{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(rs); err != nil {
+		return fmt.Errorf("failed to write json: %v", err)
+	}
+	return nil
+}
+
+func (rs Results) ExportNDJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	for _, r := range rs {
+		if err := encoder.Encode(r); err != nil {
+			return fmt.Errorf("failed to write ndjson: %v", err)
+		}
+	}
+	return nil
+}
+
+// Codec wraps an output stream with a compressor.
+type Codec func(w io.Writer) (io.WriteCloser, error)
+
+var (
+	codecsMu sync.RWMutex
+	codecs   = map[string]Codec{
+		"gzip": func(w io.Writer) (io.WriteCloser, error) { return gzip.NewWriter(w), nil },
+	}
+	codecExtensions = map[string]string{".gz": "gzip", ".gzip": "gzip", ".zst": "zstd", ".zstd": "zstd"}
+)
+
+// RegisterCodec makes a compression codec available by name. Only gzip is
+// built in: the standard library has no zstd encoder, so .zst and .zstd
+// outputs fail until a "zstd" codec is registered, e.g. one wrapping
+// github.com/klauspost/compress/zstd.
+func RegisterCodec(name string, codec Codec) {
+	codecsMu.Lock()
+	defer codecsMu.Unlock()
+	codecs[name] = codec
+}
+
+func lookupCodec(name string) (Codec, error) {
+	codecsMu.RLock()
+	defer codecsMu.RUnlock()
+	codec, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("compression codec %q is not registered; only gzip is built in, add others with RegisterCodec", name)
+	}
+	return codec, nil
+}
+
+// Exporter writes results in a format added with RegisterExporter.
+type Exporter func(rs Results, w io.Writer) error
+
+var (
+	exportersMu sync.RWMutex
+	exporters   = map[string]Exporter{}
+)
+
+// RegisterExporter makes an export format available to Export and
+// ExportFile by name, e.g. "parquet" from
+// whatsapp_checker_go_integrations.go.
+func RegisterExporter(format string, export Exporter) {
+	exportersMu.Lock()
+	defer exportersMu.Unlock()
+	exporters[format] = export
+}
+
+func lookupExporter(format string) (Exporter, bool) {
+	exportersMu.RLock()
+	defer exportersMu.RUnlock()
+	export, ok := exporters[format]
+	return export, ok
+}
+
+// Export writes results in format ("csv", "json", "ndjson" or a registered
+// format such as "parquet"), compressed with codec unless codec is empty.
+func (rs Results) Export(w io.Writer, format, codec string) error {
+	out := w
+	var cw io.WriteCloser
+	if codec != "" {
+		newWriter, err := lookupCodec(codec)
+		if err != nil {
+			return err
+		}
+		if cw, err = newWriter(w); err != nil {
+			return fmt.Errorf("failed to create %s writer: %v", codec, err)
+		}
+		out = cw
+	}
+
+	var err error
+	switch format {
+	case "csv":
+		err = rs.ExportCSV(out)
+	case "json":
+		err = rs.ExportJSON(out)
+	case "ndjson", "jsonl":
+		err = rs.ExportNDJSON(out)
+	default:
+		if export, ok := lookupExporter(format); ok {
+			err = export(rs, out)
+		} else {
+			err = fmt.Errorf("unsupported export format: %q", format)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if cw != nil {
+		if err := cw.Close(); err != nil {
+			return fmt.Errorf("failed to finish %s stream: %v", codec, err)
+		}
+	}
+	return nil
+}
+
+// ExportFile picks format and compression from the file name, so
+// "results.csv.gz" writes gzip-compressed CSV. The file is written to a
+// temporary name and renamed into place once complete.
+func (rs Results) ExportFile(path string) error {
+	return rs.exportFile(path, nil)
+}
+
+// ExportResultsFile is Results.ExportFile, encrypting the file when the
+// checker was created WithEncryption and hashing numbers WithPIIHashing.
+func (wc *Checker) ExportResultsFile(results Results, path string) error {
+	key, err := wc.encryptionKey(context.Background())
+	if err != nil {
+		return err
+	}
+	return wc.redactResults(results).exportFile(path, key)
+}
+
+func (rs Results) exportFile(path string, key []byte) error {
+	format, codec := exportFormatFromPath(path)
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	var out io.Writer = tmp
+	var ew io.WriteCloser
+	if key != nil {
+		if ew, err = NewEncryptWriter(tmp, key); err != nil {
+			tmp.Close()
+			return err
+		}
+		out = ew
+	}
+	if err := rs.Export(out, format, codec); err != nil {
+		tmp.Close()
+		return err
+	}
+	if ew != nil {
+		if err := ew.Close(); err != nil {
+			tmp.Close()
+			return fmt.Errorf("failed to write output: %v", err)
+		}
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close output: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace output: %v", err)
+	}
+	return nil
+}
+
+func exportFormatFromPath(path string) (format, codec string) {
+	name := strings.TrimSuffix(strings.ToLower(filepath.Base(path)), ".enc")
+	ext := filepath.Ext(name)
+	if c, ok := codecExtensions[ext]; ok {
+		codec = c
+		name = strings.TrimSuffix(name, ext)
+		ext = filepath.Ext(name)
+	}
+	return strings.TrimPrefix(ext, "."), codec
+}
+
+// SharedOutput merges results from many concurrent tasks into one CSV or
+// NDJSON file. A single goroutine performs all writes so batches are never
+// interleaved, and the data only replaces the target file, via rename, once
+// the last user closes it.
+type SharedOutput struct {
+	path   string
+	tmp    *os.File
+	ndjson bool
+	header bool
+	refs   int
+	writes chan sharedWrite
+	done   chan struct{}
+
+	mu     sync.RWMutex // guards closed against sends on writes
+	closed bool
+}
+
+// ErrSharedOutputClosed is returned by Append and Close once the output has
+// been committed.
+var ErrSharedOutputClosed = errors.New("shared output is closed")
+
+type sharedWrite struct {
+	results Results
+	ack     chan error
+}
+
+var (
+	sharedOutputsMu sync.Mutex
+	sharedOutputs   = make(map[string]*SharedOutput)
+)
+
+// OpenSharedOutput returns the shared writer for path, creating it on first
+// use. Every call must be paired with Close. Existing content is preserved.
+func OpenSharedOutput(path string) (*SharedOutput, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to resolve path: %v", err)
+	}
+
+	sharedOutputsMu.Lock()
+	defer sharedOutputsMu.Unlock()
+
+	if out, ok := sharedOutputs[abs]; ok {
+		out.refs++
+		return out, nil
+	}
+
+	var ndjson bool
+	switch strings.ToLower(filepath.Ext(abs)) {
+	case ".csv":
+	case ".ndjson", ".jsonl":
+		ndjson = true
+	default:
+		return nil, fmt.Errorf("unsupported shared output format: %s", filepath.Ext(abs))
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(abs), "."+filepath.Base(abs)+".*.tmp")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp file: %v", err)
+	}
+
+	header := !ndjson
+	if existing, err := os.Open(abs); err == nil {
+		_, err = io.Copy(tmp, existing)
+		existing.Close()
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+			return nil, fmt.Errorf("failed to copy existing output: %v", err)
+		}
+		header = false
+	}
+
+	out := &SharedOutput{
+		path:   abs,
+		tmp:    tmp,
+		ndjson: ndjson,
+		header: header,
+		refs:   1,
+		writes: make(chan sharedWrite),
+		done:   make(chan struct{}),
+	}
+	go out.loop()
+	sharedOutputs[abs] = out
+	return out, nil
+}
+
+func (o *SharedOutput) loop() {
+	defer close(o.done)
+	for w := range o.writes {
+		var err error
+		if o.ndjson {
+			err = w.results.ExportNDJSON(o.tmp)
+		} else {
+			err = w.results.exportCSV(o.tmp, o.header)
+			o.header = false
+		}
+		w.ack <- err
+	}
+}
+
+// Append writes results to the shared file. It fails once the last user
+// has closed the output.
+func (o *SharedOutput) Append(results Results) error {
+	o.mu.RLock()
+	if o.closed {
+		o.mu.RUnlock()
+		return ErrSharedOutputClosed
+	}
+	ack := make(chan error, 1)
+	o.writes <- sharedWrite{results: results, ack: ack}
+	o.mu.RUnlock()
+	return <-ack
+}
+
+// Close commits the file once the last user closes it. The registry lock is
+// held until the rename completes, so a concurrent Open of the same path
+// starts from the committed content.
+func (o *SharedOutput) Close() error {
+	sharedOutputsMu.Lock()
+	defer sharedOutputsMu.Unlock()
+
+	o.mu.Lock()
+	if o.closed {
+		o.mu.Unlock()
+		return ErrSharedOutputClosed
+	}
+	o.refs--
+	if o.refs > 0 {
+		o.mu.Unlock()
+		return nil
+	}
+	o.closed = true
+	close(o.writes)
+	o.mu.Unlock()
+	delete(sharedOutputs, o.path)
+	<-o.done
+
+	if err := o.tmp.Sync(); err != nil {
+		o.tmp.Close()
+		os.Remove(o.tmp.Name())
+		return fmt.Errorf("failed to sync output: %v", err)
+	}
+	if err := o.tmp.Close(); err != nil {
+		os.Remove(o.tmp.Name())
+		return fmt.Errorf("failed to close output: %v", err)
+	}
+	if err := os.Rename(o.tmp.Name(), o.path); err != nil {
+		os.Remove(o.tmp.Name())
+		return fmt.Errorf("failed to replace output: %v", err)
+	}
+	return nil
+}
+
+type InputRange struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+func (r InputRange) String() string {
+	return fmt.Sprintf("lines %d-%d", r.Start+1, r.End)
+}
+
+type ChunkResult struct {
+	Range    InputRange
+	Response *WhatsAppResponse
+	Err      error
+}
+
+type JobResult struct {
+	Chunks  []ChunkResult
+	Partial bool
+	Missing []InputRange
+
+	// Truncated is the tail of the input that was never submitted because
+	// the job ceiling or time box was reached.
+	Truncated      *InputRange
+	TruncateReason string
+
+	// Duplicates counts numbers dropped by WithDedupe. Ranges then refer to
+	// positions in the deduplicated input.
+	Duplicates int
+
+	// RemoteSkipped is set when no API key is configured: the input was
+	// validated and deduplicated but no chunks were submitted.
+	RemoteSkipped bool
+
+	// Interrupted is set when the context was cancelled mid-job. Chunks
+	// whose task was submitted but not finished keep their upload response
+	// and carry the context error, so they can be resumed by task ID.
+	Interrupted bool
+
+	// Plan is set in dry-run mode instead of Chunks.
+	Plan *JobPlan
+}
+
+// JobPlan describes what RunJob would submit. Ranges refer to positions in
+// the input after deduplication, as in JobResult.
+type JobPlan struct {
+	Numbers        int          `json:"numbers"`
+	Duplicates     int          `json:"duplicates"`
+	Invalid        int          `json:"invalid"`
+	Chunks         []InputRange `json:"chunks"`
+	Truncated      *InputRange  `json:"truncated,omitempty"`
+	TruncateReason string       `json:"truncate_reason,omitempty"`
+	Cost           float64      `json:"cost"`
+	ExceedsMaxCost bool         `json:"exceeds_max_cost"`
+}
+
+func (p *JobPlan) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Numbers to upload:\t%d\n", p.Numbers)
+	fmt.Fprintf(tw, "Duplicates dropped:\t%d\n", p.Duplicates)
+	fmt.Fprintf(tw, "Invalid numbers:\t%d\n", p.Invalid)
+	fmt.Fprintf(tw, "Chunks:\t%d\n", len(p.Chunks))
+	for i, c := range p.Chunks {
+		fmt.Fprintf(tw, "  chunk %d:\t%s (%d numbers)\n", i+1, c, c.End-c.Start)
+	}
+	if p.Truncated != nil {
+		fmt.Fprintf(tw, "Not submitted:\t%s, %s\n", p.Truncated, p.TruncateReason)
+	}
+	if p.Cost > 0 {
+		fmt.Fprintf(tw, "Estimated cost:\t%.2f\n", p.Cost)
+	}
+	if p.ExceedsMaxCost {
+		fmt.Fprintln(tw, "WARNING:\testimated cost exceeds the configured maximum")
+	}
+	return tw.Flush()
+}
+
+// Service identifiers as used in the checknumber.ai endpoint paths.
+const (
+	ServiceWhatsApp = "wa"
+	ServiceTelegram = "tg"
+)
+
+func NewWhatsAppChecker(apiKey string, opts ...Option) *WhatsAppChecker {
+	return NewServiceChecker(ServiceWhatsApp, apiKey, opts...)
+}
+
+func NewTelegramChecker(apiKey string, opts ...Option) *TelegramChecker {
+	return NewServiceChecker(ServiceTelegram, apiKey, opts...)
+}
+
+// NewServiceChecker returns a checker for any checknumber.ai service that
+// follows the simple-tasks API at https://api.checknumber.ai/<service>/api/simple/tasks.
+func NewServiceChecker(service, apiKey string, opts ...Option) *Checker {
+	wc := &Checker{
+		apiKey:  apiKey,
+		service: service,
+		baseURL: fmt.Sprintf("https://api.checknumber.ai/%s/api/simple/tasks", service),
+		httpClient: &http.Client{
+			Timeout: 30 * time.Second,
+		},
+		downloadClient:   http.DefaultClient,
+		userAgent:        defaultUserAgent,
+		statusOut:        os.Stdout,
+		maxSequentialRun: 100,
+		retries:          2,
+		retryBackoff:     500 * time.Millisecond,
+		metrics:          NewMetrics(),
+	}
+	for _, opt := range opts {
+		opt(wc)
+	}
+	return wc
+}
+
+// ErrNoAPIKey is returned by calls that need the remote API when the checker
+// was created without a key. High-level helpers run their local steps and
+// skip the remote check instead.
+var ErrNoAPIKey = errors.New("no API key configured, remote check skipped")
+
+func (wc *Checker) LocalOnly() bool {
+	return wc.apiKey == "" && wc.credentials == nil && wc.keyPool == nil && wc.auth == nil
+}
+
+// authorize sets the API key header. With a key pool, do picks the key for
+// each attempt instead.
+func (wc *Checker) authorize(req *http.Request) error {
+	if wc.auth != nil {
+		wc.auth(req)
+		return nil
+	}
+	if wc.keyPool != nil {
+		return nil
+	}
+	key := wc.apiKey
+	if wc.credentials != nil {
+		var err error
+		if key, err = wc.credentials.APIKey(req.Context()); err != nil {
+			return fmt.Errorf("failed to load API key: %v", err)
+		}
+	}
+	req.Header.Set("X-API-Key", key)
+	return nil
+}
+
+// do sends an API call. Every call gets a request ID, kept across retries
+// and key failover, that is quoted in errors, logs and the audit log.
+func (wc *Checker) do(op string, req *http.Request) (*http.Response, error) {
+	if req.Header.Get(requestIDHeader) == "" {
+		req.Header.Set(requestIDHeader, newRequestID())
+	}
+	if id := correlationIDFromContext(req.Context()); id != "" {
+		req.Header.Set(correlationIDHeader, id)
+	}
+
+	start := time.Now()
+	resp, err := wc.doRequest(op, req)
+	wc.audit.Record(op, req, resp, err, start)
+	if err != nil {
+		return nil, fmt.Errorf("%w (request %s)", err, req.Header.Get(requestIDHeader))
+	}
+	return resp, nil
+}
+
+func (wc *Checker) doRequest(op string, req *http.Request) (*http.Response, error) {
+	if wc.keyPool == nil || wc.auth != nil {
+		return wc.sendRetrying(op, req)
+	}
+
+	for attempt := 0; ; attempt++ {
+		key, err := wc.keyPool.pick()
+		if err != nil {
+			return nil, err
+		}
+		if attempt > 0 {
+			next := req.Clone(req.Context())
+			if req.Body != nil && req.GetBody != nil {
+				if next.Body, err = req.GetBody(); err != nil {
+					return nil, fmt.Errorf("failed to rewind request body: %v", err)
+				}
+			}
+			req = next
+		}
+		req.Header.Set("X-API-Key", key)
+
+		resp, err := wc.sendRetrying(op, req)
+		if err != nil {
+			return nil, err
+		}
+		reason, cooldown := keyFailure(resp, wc.keyPool.Cooldown)
+		if reason == "" {
+			return resp, nil
+		}
+		wc.keyPool.markUnhealthy(key, reason, cooldown)
+		if req.Body != nil && req.GetBody == nil {
+			return resp, nil
+		}
+		resp.Body.Close()
+	}
+}
+
+// AuditEntry is one line of the audit log: who called which operation on
+// which task, when, and with what outcome.
+type AuditEntry struct {
+	Time          time.Time `json:"time"`
+	RequestID     string    `json:"request_id"`
+	CorrelationID string    `json:"correlation_id,omitempty"`
+	Actor         string    `json:"actor"`
+	Credential    string    `json:"credential,omitempty"`
+	Operation     string    `json:"operation"`
+	Method        string    `json:"method"`
+	TaskID        string    `json:"task_id,omitempty"`
+	UserID        string    `json:"user_id,omitempty"`
+	Status        int       `json:"status,omitempty"`
+	Result        string    `json:"result"`
+	Error         string    `json:"error,omitempty"`
+	DurationMS    int64     `json:"duration_ms"`
+}
+
+// AuditLog appends an AuditEntry per API operation as JSON lines, so
+// security can reconcile usage against billing and access policies. A nil
+// *AuditLog records nothing.
+type AuditLog struct {
+	mu    sync.Mutex
+	w     io.Writer
+	actor string
+}
+
+// NewAuditLog writes entries to w, attributed to the OS user and host.
+func NewAuditLog(w io.Writer) *AuditLog {
+	actor := cmp.Or(os.Getenv("USER"), os.Getenv("USERNAME"), "unknown")
+	if host, err := os.Hostname(); err == nil {
+		actor += "@" + host
+	}
+	return &AuditLog{w: w, actor: actor}
+}
+
+// OpenAuditLog opens path for appending, creating it readable by the owner
+// only. Existing entries are never rewritten.
+func OpenAuditLog(path string) (*AuditLog, *os.File, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open audit log: %v", err)
+	}
+	return NewAuditLog(file), file, nil
+}
+
+func (a *AuditLog) Record(op string, req *http.Request, resp *http.Response, err error, start time.Time) {
+	if a == nil {
+		return
+	}
+	entry := AuditEntry{
+		Time:          start.UTC(),
+		RequestID:     req.Header.Get(requestIDHeader),
+		CorrelationID: req.Header.Get(correlationIDHeader),
+		Actor:         a.actor,
+		Credential:    credentialFingerprint(req),
+		Operation:     op,
+		Method:        req.Method,
+		UserID:        req.URL.Query().Get("user_id"),
+		Result:        "ok",
+		DurationMS:    time.Since(start).Milliseconds(),
+	}
+	if op == "status" || op == "cancel" {
+		entry.TaskID = path.Base(req.URL.Path)
+	}
+	switch {
+	case err != nil:
+		entry.Result, entry.Error = "error", err.Error()
+	case resp.StatusCode >= 400:
+		entry.Status, entry.Result = resp.StatusCode, "error"
+	default:
+		entry.Status = resp.StatusCode
+		if op == "upload" {
+			// The task ID is only known from the response, so peek at it
+			// and hand the caller an unread copy.
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+			resp.Body.Close()
+			resp.Body = io.NopCloser(bytes.NewReader(body))
+			var task struct {
+				TaskID string `json:"task_id"`
+				UserID string `json:"user_id"`
+			}
+			json.Unmarshal(body, &task)
+			entry.TaskID, entry.UserID = task.TaskID, cmp.Or(task.UserID, entry.UserID)
+		}
+	}
+
+	line, _ := json.Marshal(entry)
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, err := a.w.Write(append(line, '\n')); err != nil {
+		log.Printf("Failed to write audit log: %v", err)
+	}
+}
+
+// credentialFingerprint identifies the API key or token used without
+// revealing it.
+func credentialFingerprint(req *http.Request) string {
+	secret := cmp.Or(req.Header.Get("X-API-Key"), req.Header.Get("Authorization"))
+	if secret == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(secret))
+	return "sha256:" + hex.EncodeToString(sum[:6])
+}
+
+// sendRetrying retries send on transient transport errors. GETs are always
+// replayed; other methods only when the request never left the machine and
+// its body can be rewound.
+func (wc *Checker) sendRetrying(op string, req *http.Request) (*http.Response, error) {
+	backoff := wc.retryBackoff
+	for attempt := 0; ; attempt++ {
+		resp, err := wc.sendFailover(op, req)
+		if err == nil || attempt >= wc.retries || !IsRetryable(err) || req.Context().Err() != nil {
+			return resp, err
+		}
+		if req.Method != http.MethodGet && req.Method != http.MethodHead && !notSent(err) {
+			return resp, err
+		}
+		if req.Body != nil {
+			if req.GetBody == nil {
+				return resp, err
+			}
+			body, berr := req.GetBody()
+			if berr != nil {
+				return resp, err
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+
+		log.Printf("%s request %s failed (%v), retrying in %v", op, req.Header.Get(requestIDHeader), err, backoff)
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (wc *Checker) send(op string, req *http.Request) (*http.Response, error) {
+	if wc.breaker != nil {
+		if err := wc.breaker.allow(); err != nil {
+			return nil, err
+		}
+	}
+	if wc.rateLimiter != nil {
+		if err := wc.rateLimiter.Wait(req.Context()); err != nil {
+			if wc.breaker != nil {
+				wc.breaker.release()
+			}
+			return nil, fmt.Errorf("rate limiter: %v", err)
+		}
+	}
+
+	client := wc.httpClient
+	if wc.adaptive && client.Timeout > 0 {
+		if p95 := wc.metrics.Histogram(op).Quantile(0.95); 3*p95 > client.Timeout {
+			adjusted := *client
+			adjusted.Timeout = minDuration(3*p95, 5*client.Timeout)
+			client = &adjusted
+		}
+	}
+
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", wc.userAgent)
+	}
+	for key, values := range wc.defaultHeaders {
+		if _, ok := req.Header[key]; !ok {
+			req.Header[key] = append([]string(nil), values...)
+		}
+	}
+	for _, hook := range wc.requestHooks {
+		hook(req)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	wc.metrics.Observe(op, time.Since(start))
+	if err == nil {
+		wc.recordRateLimit(resp.Header)
+		for _, hook := range wc.responseHooks {
+			hook(resp)
+		}
+	}
+	if wc.breaker != nil {
+		if req.Context().Err() != nil {
+			// Cancelled by the caller: says nothing about the API.
+			wc.breaker.release()
+		} else {
+			wc.breaker.record(err == nil && resp.StatusCode < 500)
+		}
+	}
+	return resp, err
+}
+
+func (wc *Checker) recordRateLimit(h http.Header) {
+	info, ok := parseRateLimit(h)
+	if !ok {
+		return
+	}
+	wc.rateLimitMu.Lock()
+	wc.rateLimit = info
+	wc.rateLimitMu.Unlock()
+
+	if info.Remaining >= 0 {
+		wc.metrics.SetGauge("wachecker_ratelimit_remaining", float64(info.Remaining))
+	}
+	if info.Limit >= 0 {
+		wc.metrics.SetGauge("wachecker_ratelimit_limit", float64(info.Limit))
+	}
+	if !info.Reset.IsZero() {
+		wc.metrics.SetGauge("wachecker_ratelimit_reset_timestamp_seconds", float64(info.Reset.Unix()))
+	}
+}
+
+// RateLimit returns the quota from the most recent API response that
+// carried rate-limit headers, and false if none has yet.
+func (wc *Checker) RateLimit() (RateLimitInfo, bool) {
+	wc.rateLimitMu.Lock()
+	defer wc.rateLimitMu.Unlock()
+	return wc.rateLimit, !wc.rateLimit.UpdatedAt.IsZero()
+}
+
+func (wc *Checker) Service() string {
+	return wc.service
+}
+
+func (wc *Checker) Metrics() *Metrics {
+	return wc.metrics
+}
+
+func (wc *Checker) pollInterval(interval time.Duration) time.Duration {
+	if !wc.adaptive {
+		return interval
+	}
+	if tuned := 4 * wc.metrics.Histogram("status").Quantile(0.5); tuned > interval {
+		return minDuration(tuned, 10*interval)
+	}
+	return interval
+}
+
+// ProgressEvent describes a task after one status poll. Rate and ETA are
+// measured from the polls so far and stay zero until success has moved.
+type ProgressEvent struct {
+	TaskID   string
+	Status   TaskStatus
+	Success  int
+	Failure  int
+	Total    int
+	Elapsed  time.Duration
+	Rate     float64 // numbers per second
+	ETA      time.Duration
+	NextPoll time.Duration
+}
+
+type progressTracker struct {
+	start        time.Time
+	startSuccess int
+	lastSuccess  int
+	lastStatus   TaskStatus
+	polls        int
+	stalled      int // consecutive processing polls without success increasing
+}
+
+// observe turns a status response into a ProgressEvent and picks the next
+// poll interval: a quarter of the ETA, so small tasks are picked up within
+// seconds and huge ones are not polled needlessly, kept between
+// min(base, 1s) and 10*base.
+func (pt *progressTracker) observe(resp *WhatsAppResponse, base time.Duration) ProgressEvent {
+	now := time.Now()
+	switch {
+	case pt.start.IsZero():
+		pt.start, pt.startSuccess, pt.lastSuccess, pt.lastStatus = now, resp.Success, resp.Success, resp.Status
+	case resp.Success > pt.lastSuccess || resp.Status != pt.lastStatus:
+		pt.lastSuccess, pt.lastStatus, pt.stalled = resp.Success, resp.Status, 0
+	case resp.Status == StatusProcessing && resp.Success < resp.Total:
+		// Queued tasks and finished ones waiting for export are not stalled.
+		pt.stalled++
+	}
+	pt.polls++
+	ev := ProgressEvent{
+		TaskID:   resp.TaskID,
+		Status:   resp.Status,
+		Success:  resp.Success,
+		Failure:  resp.Failure,
+		Total:    resp.Total,
+		Elapsed:  now.Sub(pt.start),
+		NextPoll: base,
+	}
+
+	done := resp.Success - pt.startSuccess
+	if done <= 0 || ev.Elapsed <= 0 || resp.Total <= resp.Success {
+		return ev
+	}
+	ev.Rate = float64(done) / ev.Elapsed.Seconds()
+	ev.ETA = time.Duration(float64(resp.Total-resp.Success) / ev.Rate * float64(time.Second))
+	ev.NextPoll = max(minDuration(ev.ETA/4, 10*base), minDuration(base, time.Second))
+	return ev
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Usage is the account's credit position. The account endpoint is not part
+// of the documented API, so unknown fields are kept in Raw.
+type Usage struct {
+	Balance   float64 `json:"balance"`
+	Used      int64   `json:"used"`
+	Quota     int64   `json:"quota"`
+	Remaining int64   `json:"remaining"`
+	Currency  string  `json:"currency,omitempty"`
+
+	Raw map[string]interface{} `json:"-"`
+}
+
+func (wc *Checker) GetUsage(ctx context.Context) (*Usage, error) {
+	if wc.LocalOnly() {
+		return nil, ErrNoAPIKey
+	}
+
+	endpoint := wc.accountURL
+	if endpoint == "" {
+		endpoint = strings.TrimSuffix(wc.baseURL, "/tasks") + "/account"
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	if err := wc.authorize(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := wc.do("account", req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(resp)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	var usage Usage
+	if err := json.Unmarshal(body, &usage); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+	json.Unmarshal(body, &usage.Raw)
+	if _, ok := usage.Raw["remaining"]; !ok && usage.Quota > 0 {
+		usage.Remaining = usage.Quota - usage.Used
+	}
+
+	wc.metrics.SetGauge("wachecker_account_balance", usage.Balance)
+	if wc.onLowBalance != nil && usage.Balance < wc.lowBalance {
+		wc.onLowBalance(&usage)
+	}
+	return &usage, nil
+}
+
+// PingResult is a successful Ping.
+type PingResult struct {
+	Endpoint string        `json:"endpoint"`
+	Status   int           `json:"status"`
+	Latency  time.Duration `json:"latency"`
+}
+
+// pingTaskID names a task that never exists, so Ping costs nothing.
+const pingTaskID = "wachecker-ping"
+
+// Ping verifies that the API is reachable and accepts the credentials, for
+// readiness probes and startup checks. It looks up a task that does not
+// exist: a valid key gets 404, a rejected one 401 or 403, which is returned
+// as an *APIError like any other unexpected status.
+func (wc *Checker) Ping(ctx context.Context) (*PingResult, error) {
+	if wc.LocalOnly() {
+		return nil, ErrNoAPIKey
+	}
+	endpoint := fmt.Sprintf("%s/%s?user_id=%s", wc.baseURL, pingTaskID, url.QueryEscape(userIDFromContext(ctx)))
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	if err := wc.authorize(req); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	resp, err := wc.do("ping", req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusNotFound && (resp.StatusCode < 200 || resp.StatusCode >= 300) {
+		return nil, newAPIError(resp)
+	}
+	return &PingResult{Endpoint: resp.Request.URL.Host, Status: resp.StatusCode, Latency: time.Since(start)}, nil
+}
+
+// SingleResult is the answer for one number. Realtime is false when the live
+// endpoint was unavailable and the number went through a one-number task.
+type SingleResult struct {
+	Number    string        `json:"number"`
+	WhatsApp  string        `json:"whatsapp"`
+	CheckedAt time.Time     `json:"checked_at"`
+	Latency   time.Duration `json:"latency"`
+	Realtime  bool          `json:"realtime"`
+}
+
+// CheckSingle checks one number with low latency through the realtime
+// endpoint. If the account or service has no realtime endpoint (404/405/501),
+// it falls back to a one-number task polled every second.
+func (wc *Checker) CheckSingle(ctx context.Context, number string) (*SingleResult, error) {
+	number = NormalizeNumber(number)
+	if number == "" {
+		return nil, errors.New("empty number")
+	}
+	if wc.LocalOnly() {
+		return nil, ErrNoAPIKey
+	}
+	if wc.resultCache != nil {
+		if r, ok := wc.cacheGet(number); ok {
+			return &SingleResult{Number: r.Number, WhatsApp: r.WhatsApp, CheckedAt: time.Now()}, nil
+		}
+	}
+
+	start := time.Now()
+	result, err := wc.checkRealtime(ctx, number)
+	if errors.Is(err, errRealtimeUnavailable) {
+		log.Printf("Realtime endpoint unavailable, checking %s as a task", wc.redact(number))
+		var results Results
+		if results, err = wc.checkNumbers([]string{number}, time.Second); err == nil {
+			if len(results) != 1 {
+				return nil, fmt.Errorf("expected 1 result, got %d", len(results))
+			}
+			result = &SingleResult{Number: results[0].Number, WhatsApp: results[0].WhatsApp}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	result.CheckedAt, result.Latency = time.Now(), time.Since(start)
+	if wc.resultCache != nil && !(NumberResult{Number: number, WhatsApp: result.WhatsApp}).Failed() {
+		wc.cacheSet(number, NumberResult{Number: result.Number, WhatsApp: result.WhatsApp})
+	}
+	return result, nil
+}
+
+var errRealtimeUnavailable = errors.New("realtime endpoint unavailable")
+
+func (wc *Checker) checkRealtime(ctx context.Context, number string) (*SingleResult, error) {
+	endpoint := wc.realtimeURL
+	if endpoint == "" {
+		endpoint = strings.TrimSuffix(wc.baseURL, "/tasks") + "/check"
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"?number="+url.QueryEscape(number), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	if err := wc.authorize(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := wc.do("realtime", req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return nil, errRealtimeUnavailable
+	default:
+		return nil, newAPIError(resp)
+	}
+
+	// Accept {"whatsapp": "yes"}, {"status": "yes"} or {"exists": true}.
+	var body map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+	result := &SingleResult{Number: number, Realtime: true}
+	if n, ok := body["number"].(string); ok && n != "" {
+		result.Number = n
+	}
+	switch v := firstPresent(body, "whatsapp", wc.service, "status", "exists").(type) {
+	case string:
+		result.WhatsApp = strings.ToLower(v)
+	case bool:
+		result.WhatsApp = map[bool]string{true: "yes", false: "no"}[v]
+	default:
+		return nil, errors.New("response has no status field")
+	}
+	return result, nil
+}
+
+func firstPresent(m map[string]interface{}, keys ...string) interface{} {
+	for _, key := range keys {
+		if v, ok := m[key]; ok && key != "" {
+			return v
+		}
+	}
+	return nil
+}
+
+func (wc *Checker) GetBalance(ctx context.Context) (float64, error) {
+	usage, err := wc.GetUsage(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return usage.Balance, nil
+}
+
+var ErrCostExceeded = errors.New("estimated cost exceeds the configured maximum")
+
+type CostEstimate struct {
+	Numbers        int     `json:"numbers"`
+	Duplicates     int     `json:"duplicates"`
+	PricePerNumber float64 `json:"price_per_number"`
+	Cost           float64 `json:"cost"`
+
+	// Usage is nil when the account endpoint could not be reached.
+	Usage          *Usage `json:"usage,omitempty"`
+	ExceedsBalance bool   `json:"exceeds_balance"`
+	ExceedsQuota   bool   `json:"exceeds_quota"`
+	ExceedsMaxCost bool   `json:"exceeds_max_cost"`
+}
+
+// EstimateCost prices a submission after dropping blanks and duplicates, and
+// compares it with the account's balance and quota when those are available.
+func (wc *Checker) EstimateCost(ctx context.Context, phoneNumbers []string) (*CostEstimate, error) {
+	unique, duplicates := DedupeNumbers(phoneNumbers)
+	est := &CostEstimate{
+		Numbers:        len(unique),
+		Duplicates:     duplicates,
+		PricePerNumber: wc.pricePerNumber,
+		Cost:           float64(len(unique)) * wc.pricePerNumber,
+	}
+	est.ExceedsMaxCost = wc.maxCost > 0 && est.Cost > wc.maxCost
+
+	if wc.LocalOnly() {
+		return est, nil
+	}
+	usage, err := wc.GetUsage(ctx)
+	if err != nil {
+		log.Printf("Cost estimate without account data: %v", err)
+		return est, nil
+	}
+	est.Usage = usage
+	est.ExceedsBalance = wc.pricePerNumber > 0 && est.Cost > usage.Balance
+	est.ExceedsQuota = usage.Quota > 0 && int64(est.Numbers) > usage.Remaining
+	return est, nil
+}
+
+func (wc *Checker) checkCost(count int) error {
+	if wc.maxCost <= 0 || wc.pricePerNumber <= 0 {
+		return nil
+	}
+	if cost := float64(count) * wc.pricePerNumber; cost > wc.maxCost {
+		return fmt.Errorf("%w: %d numbers cost %.2f, maximum is %.2f", ErrCostExceeded, count, cost, wc.maxCost)
+	}
+	return nil
+}
+
+func (wc *Checker) UploadFile(filePath string) (*WhatsAppResponse, error) {
+	return wc.UploadFileContext(context.Background(), filePath)
+}
+
+func (wc *Checker) UploadFileContext(ctx context.Context, filePath string) (*WhatsAppResponse, error) {
+	return wc.UploadFileWithOptions(ctx, filePath, UploadOptions{})
+}
+
+// UploadOptions adds optional form fields to an upload. The named fields cover
+// parameters the API is known to accept; Fields passes anything else through
+// verbatim and wins over the named ones. UserID defaults to the user set on
+// the context with ContextWithUserID. Name and Labels are also kept in the
+// task store; Labels are local only. Lines that cannot be parsed as numbers
+// are written to RejectsFile, when set, and reported to OnValidation.
+type UploadOptions struct {
+	UserID      string
+	CallbackURL string
+	Name        string
+	Priority    string
+	Fields      map[string]string
+	Labels      map[string]string
+
+	RejectsFile  string
+	OnValidation func(*ValidationReport)
+}
+
+func (o UploadOptions) formFields() map[string]string {
+	fields := make(map[string]string, len(o.Fields)+4)
+	for key, value := range map[string]string{"user_id": o.UserID, "callback_url": o.CallbackURL, "name": o.Name, "priority": o.Priority} {
+		if value != "" {
+			fields[key] = value
+		}
+	}
+	for key, value := range o.Fields {
+		fields[key] = value
+	}
+	return fields
+}
+
+type userIDKey struct{}
+
+// ContextWithUserID scopes calls made with ctx to a user or tenant, so one
+// checker can serve several customer accounts: uploads send it as user_id and
+// status checks use it when no user ID is passed.
+func ContextWithUserID(ctx context.Context, userID string) context.Context {
+	return context.WithValue(ctx, userIDKey{}, userID)
+}
+
+func userIDFromContext(ctx context.Context) string {
+	userID, _ := ctx.Value(userIDKey{}).(string)
+	return userID
+}
+
+type correlationIDKey struct{}
+
+// ContextWithCorrelationID tags API calls made with ctx with an ID from the
+// caller's own tracing, sent as X-Correlation-ID next to the per-call
+// X-Request-ID.
+func ContextWithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+func correlationIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+const (
+	requestIDHeader     = "X-Request-ID"
+	correlationIDHeader = "X-Correlation-ID"
+)
+
+func newRequestID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+func (wc *Checker) UploadFileWithOptions(ctx context.Context, filePath string, opts UploadOptions) (*WhatsAppResponse, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
+	return wc.uploadData(ctx, filePath, data, opts)
+}
+
+// UploadFromURL uploads the numbers in a remote object, an http(s) URL or
+// "s3://bucket/key" (credentials from the environment), without writing it
+// to local disk. Text and CSV objects are streamed and only their numbers
+// kept; spreadsheets are reduced to their first column.
+func (wc *Checker) UploadFromURL(ctx context.Context, rawURL string) (*WhatsAppResponse, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid input URL: %v", err)
+	}
+
+	var body io.ReadCloser
+	switch u.Scheme {
+	case "http", "https":
+		req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %v", err)
+		}
+		resp, err := wc.downloadClient.Do(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download input: %v", err)
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("HTTP error: %d", resp.StatusCode)
+		}
+		body = resp.Body
+	case "s3":
+		store, err := NewS3StoreFromEnv(u.Host)
+		if err != nil {
+			return nil, err
+		}
+		if body, err = store.Get(ctx, strings.TrimPrefix(u.Path, "/")); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported input URL scheme: %q", u.Scheme)
+	}
+	defer body.Close()
+
+	name := path.Base(u.Path)
+	numbers, err := numbersFromReader(name, body)
+	if err != nil {
+		return nil, err
+	}
+	name = strings.TrimSuffix(name, path.Ext(name)) + ".txt"
+	return wc.uploadData(ctx, name, []byte(strings.Join(numbers, "\n")), UploadOptions{})
+}
+
+// uploadData normalizes, validates and uploads one number per line from
+// data. name is used for the uploaded file name and in logs.
+func (wc *Checker) uploadData(ctx context.Context, name string, data []byte, opts UploadOptions) (*WhatsAppResponse, error) {
+	if opts.UserID == "" {
+		opts.UserID = userIDFromContext(ctx)
+	}
+
+	text, encoding := DecodeText(data)
+	if encoding != EncodingUTF8 || !bytes.Equal(data, []byte(text)) {
+		log.Printf("Normalized %s from %s to UTF-8 with LF line endings", filepath.Base(name), encoding)
+		data = []byte(text)
+	}
+	lines := strings.Split(text, "\n")
+	report := (NumberLoader{}).validateLines(lines)
+	report.Source = name
+	if opts.OnValidation != nil {
+		opts.OnValidation(report)
+	}
+	if rejected := report.Count(ActionRejected); rejected > 0 {
+		if opts.RejectsFile != "" {
+			rejects := report
+			if wc.piiSalt != nil {
+				rejects = report.Hashed(wc.piiSalt)
+			}
+			if err := rejects.WriteRejectsFile(opts.RejectsFile); err != nil {
+				return nil, err
+			}
+		}
+		log.Printf("%s has %d unparseable lines:", filepath.Base(name), rejected)
+		shown := 0
+		for _, issue := range report.Issues {
+			if issue.Action == ActionRejected && shown < 20 {
+				log.Printf("  line %d: %q: %s", issue.Line, wc.redact(issue.Raw), issue.Reason)
+				shown++
+			}
+		}
+	}
+	if err := wc.checkSequential(lines); err != nil {
+		return nil, err
+	}
+
+	if wc.dedupe {
+		unique, duplicates := DedupeNumbers(lines)
+		if duplicates > 0 {
+			log.Printf("Removed %d duplicate numbers from %s", duplicates, filepath.Base(name))
+			data = []byte(strings.Join(unique, "\n"))
+		}
+	}
+
+	if wc.dryRun {
+		return nil, ErrDryRun
+	}
+	if wc.LocalOnly() {
+		return nil, ErrNoAPIKey
+	}
+	if err := wc.checkCost(countNumbers(string(data))); err != nil {
+		return nil, err
+	}
+
+	sum := sha256.Sum256(data)
+	if wc.piiSalt != nil {
+		mac := hmac.New(sha256.New, wc.piiSalt)
+		mac.Write(data)
+		copy(sum[:], mac.Sum(nil))
+	}
+	inputHash := hex.EncodeToString(sum[:])
+	if wc.taskStore != nil && wc.reuseWithin > 0 {
+		if rec, ok := wc.taskStore.FindByHash(inputHash, wc.reuseWithin); ok {
+			log.Printf("Reusing task %s uploaded at %s for identical input", rec.TaskID, rec.CreatedAt.Format(time.RFC3339))
+			return wc.CheckTaskStatusContext(ctx, rec.TaskID, rec.UserID)
+		}
+	}
+
+	var buf bytes.Buffer
+	writer := multipart.NewWriter(&buf)
+
+	fields := opts.formFields()
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if err := writer.WriteField(key, fields[key]); err != nil {
+			return nil, fmt.Errorf("failed to write form field %s: %v", key, err)
+		}
+	}
+
+	part, err := writer.CreateFormFile("file", filepath.Base(name))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create form file: %v", err)
+	}
+
+	_, err = part.Write(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to copy file: %v", err)
+	}
+
+	err = writer.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to close writer: %v", err)
+	}
+
+	post := func(payload []byte, encoding string) (*http.Response, error) {
+		newBody := func() io.Reader {
+			if wc.onUploadProgress != nil {
+				return &progressReader{r: bytes.NewReader(payload), total: int64(len(payload)), onProgress: wc.onUploadProgress}
+			}
+			return bytes.NewReader(payload)
+		}
+
+		req, err := http.NewRequestWithContext(ctx, "POST", wc.baseURL, newBody())
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %v", err)
+		}
+		req.ContentLength = int64(len(payload))
+		req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(newBody()), nil }
+
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		if err := wc.authorize(req); err != nil {
+			return nil, err
+		}
+
+		resp, err := wc.do("upload", req)
+		if err != nil {
+			return nil, fmt.Errorf("request failed: %w", err)
+		}
+		return resp, nil
+	}
+
+	var resp *http.Response
+	if wc.gzipUpload && !wc.gzipRejected.Load() {
+		compressed, err := gzipBytes(buf.Bytes())
+		if err != nil {
+			return nil, err
+		}
+		if resp, err = post(compressed, "gzip"); err != nil {
+			return nil, err
+		}
+		if gzipUnsupported(resp) {
+			log.Printf("API rejected gzip upload (HTTP %d), sending uncompressed from now on", resp.StatusCode)
+			wc.gzipRejected.Store(true)
+			resp.Body.Close()
+			resp = nil
+		}
+	}
+	if resp == nil {
+		if resp, err = post(buf.Bytes(), ""); err != nil {
+			return nil, err
+		}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(resp)
+	}
+
+	var result WhatsAppResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+	if info, ok := parseRateLimit(resp.Header); ok {
+		result.RateLimit = &info
+	}
+	if result.UserID == "" {
+		result.UserID = opts.UserID
+	}
+
+	if wc.taskStore != nil {
+		rec := TaskRecord{InputHash: inputHash, Name: opts.Name, Labels: maps.Clone(opts.Labels), CreatedAt: time.Now()}
+		rec.addEvent("uploaded", fmt.Sprintf("%s, %d bytes", filepath.Base(name), len(data)))
+		if err := wc.taskStore.Update(&result, rec); err != nil {
+			log.Printf("Failed to record task %s: %v", result.TaskID, err)
+		}
+	}
+	wc.emit(func(e Events) { e.OnTaskCreated(&result) })
+
+	return &result, nil
+}
+
+func (wc *Checker) CheckTaskStatus(taskID, userID string) (*WhatsAppResponse, error) {
+	return wc.CheckTaskStatusContext(context.Background(), taskID, userID)
+}
+
+func (wc *Checker) CheckTaskStatusContext(ctx context.Context, taskID, userID string) (*WhatsAppResponse, error) {
+	if wc.LocalOnly() {
+		return nil, ErrNoAPIKey
+	}
+	if userID == "" {
+		userID = userIDFromContext(ctx)
+	}
+
+	url := fmt.Sprintf("%s/%s?user_id=%s", wc.baseURL, taskID, url.QueryEscape(userID))
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+
+	if err := wc.authorize(req); err != nil {
+		return nil, err
+	}
+	cached, _ := wc.statusETags.Load(taskID)
+	if cached != nil {
+		req.Header.Set("If-None-Match", cached.(*etaggedStatus).etag)
+	}
+
+	resp, err := wc.do("status", req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && cached != nil {
+		result := *cached.(*etaggedStatus).status
+		if info, ok := parseRateLimit(resp.Header); ok {
+			result.RateLimit = &info
+		}
+		return &result, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(resp)
+	}
+
+	var result WhatsAppResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %v", err)
+	}
+	if info, ok := parseRateLimit(resp.Header); ok {
+		result.RateLimit = &info
+	}
+	if etag := resp.Header.Get("ETag"); etag != "" && !result.Status.IsTerminal() {
+		stored := result
+		wc.statusETags.Store(taskID, &etaggedStatus{etag: etag, status: &stored})
+	} else {
+		wc.statusETags.Delete(taskID)
+	}
+
+	if wc.taskStore != nil {
+		if err := wc.taskStore.Update(&result, TaskRecord{}); err != nil {
+			log.Printf("Failed to record task %s: %v", result.TaskID, err)
+		}
+	}
+
+	return &result, nil
+}
+
+// userIDFor falls back to the user ID recorded in the task store when the
+// caller did not provide one.
+func (wc *Checker) userIDFor(taskID, userID string) string {
+	if userID != "" || wc.taskStore == nil {
+		return userID
+	}
+	rec, _ := wc.taskStore.Get(taskID)
+	return rec.UserID
+}
+
+func (wc *Checker) recordEvent(taskID, kind, detail string) {
+	if wc.taskStore == nil || taskID == "" {
+		return
+	}
+	if err := wc.taskStore.AddEvent(taskID, kind, detail); err != nil {
+		log.Printf("Failed to record %s event for task %s: %v", kind, taskID, err)
+	}
+}
+
+func (wc *Checker) PollTaskStatus(taskID, userID string, interval time.Duration) (*WhatsAppResponse, error) {
+	return wc.PollTaskStatusContext(context.Background(), taskID, userID, interval)
+}
+
+func (wc *Checker) PollTaskStatusContext(ctx context.Context, taskID, userID string, interval time.Duration) (resp *WhatsAppResponse, err error) {
+	hb := wc.startHeartbeat("task "+taskID, interval)
+	defer func() { hb.Stop(err) }()
+	defer func() { wc.emitOutcome(taskID, resp, err) }()
+
+	progress := &progressTracker{}
+	for {
+		resp, err = wc.CheckTaskStatusContext(ctx, taskID, userID)
+		if err != nil {
+			wc.recordEvent(taskID, "error", err.Error())
+			return nil, err
+		}
+		hb.Touch(fmt.Sprintf("%s, success %d/%d", resp.Status, resp.Success, resp.Total))
+
+		ev := progress.observe(resp, wc.pollInterval(interval))
+		if ev.ETA > 0 {
+			fmt.Fprintf(wc.statusOut, "Status: %s, Success: %d, Total: %d, ETA: %s\n", resp.Status, resp.Success, resp.Total, ev.ETA.Round(time.Second))
+		} else {
+			fmt.Fprintf(wc.statusOut, "Status: %s, Success: %d, Total: %d\n", resp.Status, resp.Success, resp.Total)
+		}
+		if wc.onProgress != nil {
+			wc.onProgress(ev)
+		}
+		wc.emit(func(e Events) { e.OnProgress(ev) })
+
+		switch resp.Status {
+		case StatusExported:
+			fmt.Fprintf(wc.statusOut, "Results available at: %s\n", resp.ResultURL)
+			wc.notify(resp)
+			return resp, nil
+		case StatusFailed:
+			wc.notify(resp)
+			return nil, ErrTaskFailed
+		default:
+			if wc.maxPolls > 0 && progress.polls >= wc.maxPolls {
+				err = fmt.Errorf("task %s: %w (%d polls, %d/%d)", taskID, ErrPollLimit, progress.polls, resp.Success, resp.Total)
+				wc.recordEvent(taskID, "error", err.Error())
+				return nil, err
+			}
+			if wc.stallPolls > 0 && progress.stalled >= wc.stallPolls {
+				err = fmt.Errorf("task %s: %w for %d polls at %d/%d", taskID, ErrTaskStalled, progress.stalled, resp.Success, resp.Total)
+				wc.recordEvent(taskID, "stalled", err.Error())
+				if wc.cancelStalled {
+					if cerr := wc.CancelTask(ctx, taskID, userID); cerr != nil {
+						log.Printf("Failed to cancel stalled task %s: %v", taskID, cerr)
+					}
+				}
+				return nil, err
+			}
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(ev.NextPoll):
+			}
+		}
+	}
+}
+
+type etaggedStatus struct {
+	etag   string
+	status *WhatsAppResponse
+}
+
+// TaskStatusResult is one task's outcome in CheckTaskStatuses.
+type TaskStatusResult struct {
+	Status *WhatsAppResponse
+	Err    error
+}
+
+var errBatchUnavailable = errors.New("batch status endpoint unavailable")
+
+// maxBatchStatus is the number of task IDs sent per batch status request.
+const maxBatchStatus = 100
+
+// CheckTaskStatuses fetches the status of many tasks owned by userID. The
+// batch endpoint is not part of the documented API: when it turns out to be
+// missing, this and later calls fall back to one request per task.
+func (wc *Checker) CheckTaskStatuses(ctx context.Context, userID string, taskIDs ...string) map[string]TaskStatusResult {
+	results := make(map[string]TaskStatusResult, len(taskIDs))
+	for start := 0; start < len(taskIDs) && !wc.batchUnavailable.Load(); start += maxBatchStatus {
+		batch := taskIDs[start:min(start+maxBatchStatus, len(taskIDs))]
+		statuses, err := wc.checkTaskStatusBatch(ctx, userID, batch)
+		if errors.Is(err, errBatchUnavailable) {
+			log.Printf("Batch status endpoint unavailable, polling tasks one by one")
+			wc.batchUnavailable.Store(true)
+			break
+		}
+		for _, id := range batch {
+			switch status, ok := statuses[id]; {
+			case err != nil:
+				results[id] = TaskStatusResult{Err: err}
+			case ok:
+				results[id] = TaskStatusResult{Status: status}
+			default:
+				results[id] = TaskStatusResult{Err: &APIError{StatusCode: http.StatusNotFound}}
+			}
+		}
+	}
+
+	for _, id := range taskIDs {
+		if _, done := results[id]; !done {
+			status, err := wc.CheckTaskStatusContext(ctx, id, userID)
+			results[id] = TaskStatusResult{Status: status, Err: err}
+		}
+	}
+	return results
+}
+
+func (wc *Checker) checkTaskStatusBatch(ctx context.Context, userID string, taskIDs []string) (map[string]*WhatsAppResponse, error) {
+	if wc.LocalOnly() {
+		return nil, ErrNoAPIKey
+	}
+	endpoint := cmp.Or(wc.batchStatusURL, wc.baseURL)
+	query := url.Values{"task_ids": {strings.Join(taskIDs, ",")}, "user_id": {cmp.Or(userID, userIDFromContext(ctx))}}
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	if err := wc.authorize(req); err != nil {
+		return nil, err
+	}
+
+	resp, err := wc.do("batch_status", req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return nil, errBatchUnavailable
+	default:
+		return nil, newAPIError(resp)
+	}
+
+	// Accept a bare array or {"tasks": [...]}; anything else means the
+	// endpoint is not a batch status call.
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %v", err)
+	}
+	var tasks []WhatsAppResponse
+	if err := json.Unmarshal(body, &tasks); err != nil {
+		var wrapped struct {
+			Tasks []WhatsAppResponse `json:"tasks"`
+		}
+		if err := json.Unmarshal(body, &wrapped); err != nil || wrapped.Tasks == nil {
+			return nil, errBatchUnavailable
+		}
+		tasks = wrapped.Tasks
+	}
+
+	statuses := make(map[string]*WhatsAppResponse, len(tasks))
+	for i := range tasks {
+		task := &tasks[i]
+		statuses[task.TaskID] = task
+		if wc.taskStore != nil {
+			if err := wc.taskStore.Update(task, TaskRecord{}); err != nil {
+				log.Printf("Failed to record task %s: %v", task.TaskID, err)
+			}
+		}
+	}
+	return statuses, nil
+}
+
+// Poller polls many tasks from one goroutine: each round fetches every
+// watched task with CheckTaskStatuses, grouped by user, through the
+// checker's shared rate limiter, and reports to per-task callbacks.
+type Poller struct {
+	checker  *Checker
+	interval time.Duration
+
+	mu    sync.Mutex
+	tasks map[string]*pollerTask
+	wake  chan struct{}
+}
+
+type pollerTask struct {
+	userID   string
+	fn       func(*WhatsAppResponse, error)
+	progress progressTracker
+}
+
+func NewPoller(wc *Checker, interval time.Duration) *Poller {
+	return &Poller{checker: wc, interval: interval, tasks: make(map[string]*pollerTask), wake: make(chan struct{}, 1)}
+}
+
+// Watch adds a task. fn is called after every poll with the task's status,
+// or the error; the task is dropped once it is terminal or an error occurs.
+func (p *Poller) Watch(taskID, userID string, fn func(*WhatsAppResponse, error)) {
+	p.mu.Lock()
+	p.tasks[taskID] = &pollerTask{userID: userID, fn: fn}
+	p.mu.Unlock()
+	select {
+	case p.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (p *Poller) Unwatch(taskID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.tasks, taskID)
+}
+
+// Pending is the number of tasks still being watched.
+func (p *Poller) Pending() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.tasks)
+}
+
+// Run polls until ctx is done. Tasks may be added while it runs.
+func (p *Poller) Run(ctx context.Context) error {
+	return p.run(ctx, false)
+}
+
+// Wait polls until every watched task has finished.
+func (p *Poller) Wait(ctx context.Context) error {
+	return p.run(ctx, true)
+}
+
+func (p *Poller) run(ctx context.Context, untilEmpty bool) error {
+	for {
+		select {
+		case <-p.wake:
+		default:
+		}
+		p.mu.Lock()
+		byUser := make(map[string][]string)
+		for id, task := range p.tasks {
+			byUser[task.userID] = append(byUser[task.userID], id)
+		}
+		p.mu.Unlock()
+		if len(byUser) == 0 && untilEmpty {
+			return nil
+		}
+
+		for userID, ids := range byUser {
+			for id, result := range p.checker.CheckTaskStatuses(ctx, userID, ids...) {
+				p.deliver(id, result)
+			}
+		}
+
+		var next <-chan time.Time
+		if len(byUser) > 0 {
+			next = time.After(p.interval)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-next:
+		case <-p.wake:
+		}
+	}
+}
+
+func (p *Poller) deliver(taskID string, result TaskStatusResult) {
+	p.mu.Lock()
+	task, ok := p.tasks[taskID]
+	if ok && (result.Err != nil || result.Status.Status.IsTerminal()) {
+		delete(p.tasks, taskID)
+	}
+	p.mu.Unlock()
+	if !ok {
+		return
+	}
+	if result.Err == nil {
+		ev := task.progress.observe(result.Status, p.interval)
+		if p.checker.onProgress != nil {
+			p.checker.onProgress(ev)
+		}
+		p.checker.emit(func(e Events) { e.OnProgress(ev) })
+	}
+	if result.Err == nil && result.Status.Status.IsTerminal() {
+		p.checker.notify(result.Status)
+	}
+	if result.Err != nil || result.Status.Status.IsTerminal() {
+		p.checker.emitOutcome(taskID, result.Status, result.Err)
+	}
+	task.fn(result.Status, result.Err)
+}
+
+// CancelTask asks the API to stop a task. Cancellation is not part of the
+// documented API, so this is best effort: a DELETE on the task URL.
+func (wc *Checker) CancelTask(ctx context.Context, taskID, userID string) error {
+	url := fmt.Sprintf("%s/%s?user_id=%s", wc.baseURL, taskID, url.QueryEscape(wc.userIDFor(taskID, userID)))
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, url, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	if err := wc.authorize(req); err != nil {
+		return err
+	}
+
+	resp, err := wc.do("cancel", req)
+	if err != nil {
+		return fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return newAPIError(resp)
+	}
+	wc.recordEvent(taskID, "cancelled", "cancelled by client")
+	return nil
+}
+
+var ErrTaskFailed = errors.New("task failed")
+
+// APIError is returned when the API answers with an unexpected status code.
+type APIError struct {
+	StatusCode int
+	RequestID  string
+}
+
+func (e *APIError) Error() string {
+	if e.RequestID != "" {
+		return fmt.Sprintf("HTTP error: %d (request %s)", e.StatusCode, e.RequestID)
+	}
+	return fmt.Sprintf("HTTP error: %d", e.StatusCode)
+}
+
+// newAPIError describes a failed response, with the ID of the request that
+// produced it for the provider's support.
+func newAPIError(resp *http.Response) *APIError {
+	e := &APIError{StatusCode: resp.StatusCode}
+	if resp.Request != nil {
+		e.RequestID = resp.Request.Header.Get(requestIDHeader)
+	}
+	return e
+}
+
+var ErrDryRun = errors.New("dry run, nothing uploaded")
+
+// PlanJob performs every local step of RunJob (sequential-range guard,
+// deduplication, job ceiling and chunking) and prices the result, without
+// calling the API.
+func (wc *Checker) PlanJob(phoneNumbers []string, chunkSize int) (*JobPlan, error) {
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk size: %d", chunkSize)
+	}
+	if err := wc.checkSequential(phoneNumbers); err != nil {
+		return nil, err
+	}
+
+	plan := &JobPlan{}
+	if wc.dedupe {
+		phoneNumbers, plan.Duplicates = DedupeNumbers(phoneNumbers)
+	}
+	for _, number := range phoneNumbers {
+		if strings.TrimSpace(number) == "" {
+			continue
+		}
+		if fixed, _ := RepairNumber(number, RepairOptions{}); fixed == "" {
+			plan.Invalid++
+		}
+	}
+
+	total := len(phoneNumbers)
+	if wc.jobCeiling > 0 && wc.jobCeiling < total {
+		plan.Truncated = &InputRange{Start: wc.jobCeiling, End: total}
+		plan.TruncateReason = fmt.Sprintf("ceiling of %d numbers reached", wc.jobCeiling)
+		total = wc.jobCeiling
+	}
+	for start := 0; start < total; start += chunkSize {
+		plan.Chunks = append(plan.Chunks, InputRange{Start: start, End: min(start+chunkSize, total)})
+	}
+	plan.Numbers = countNumbers(strings.Join(phoneNumbers[:total], "\n"))
+	plan.Cost = float64(plan.Numbers) * wc.pricePerNumber
+	plan.ExceedsMaxCost = wc.maxCost > 0 && plan.Cost > wc.maxCost
+	return plan, nil
+}
+
+func (wc *Checker) RunJob(phoneNumbers []string, chunkSize int, interval time.Duration) (*JobResult, error) {
+	return wc.RunJobContext(context.Background(), phoneNumbers, chunkSize, interval)
+}
+
+// RunJobContext is RunJob with cancellation. Cancelling ctx stops polling
+// and submitting: submitted tasks keep running on the server and are
+// returned in the job, and the unsubmitted tail is reported as Truncated.
+func (wc *Checker) RunJobContext(ctx context.Context, phoneNumbers []string, chunkSize int, interval time.Duration) (*JobResult, error) {
+	if wc.dryRun {
+		plan, err := wc.PlanJob(phoneNumbers, chunkSize)
+		if err != nil {
+			return nil, err
+		}
+		return &JobResult{Plan: plan, Duplicates: plan.Duplicates}, nil
+	}
+
+	if chunkSize <= 0 {
+		return nil, fmt.Errorf("invalid chunk size: %d", chunkSize)
+	}
+	if err := wc.checkSequential(phoneNumbers); err != nil {
+		return nil, err
+	}
+
+	job := &JobResult{}
+	if wc.dedupe {
+		phoneNumbers, job.Duplicates = DedupeNumbers(phoneNumbers)
+		if job.Duplicates > 0 {
+			log.Printf("Removed %d duplicate numbers", job.Duplicates)
+		}
+	}
+	if wc.LocalOnly() {
+		log.Printf("No API key configured, skipping remote check of %d numbers", len(phoneNumbers))
+		job.RemoteSkipped = true
+		return job, nil
+	}
+	if err := wc.checkCost(countNumbers(strings.Join(phoneNumbers, "\n"))); err != nil {
+		return nil, err
+	}
+	// Chunks run on up to parallelChunks goroutines; a chunk is only started
+	// once a slot is free, so the time box and interrupts are checked
+	// against the actual start of each one.
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var failed []InputRange
+	slots := make(chan struct{}, max(wc.parallelChunks, 1))
+	started := time.Now()
+	for start := 0; start < len(phoneNumbers); start += chunkSize {
+		end := start + chunkSize
+		if end > len(phoneNumbers) {
+			end = len(phoneNumbers)
+		}
+
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		mu.Lock()
+		if ctx.Err() != nil {
+			job.Interrupted = true
+			job.truncate(start, len(phoneNumbers), "interrupted")
+			mu.Unlock()
+			break
+		}
+		if wc.jobTimeBox > 0 && time.Since(started) >= wc.jobTimeBox {
+			job.truncate(start, len(phoneNumbers), fmt.Sprintf("time box of %s reached", wc.jobTimeBox))
+			mu.Unlock()
+			break
+		}
+		mu.Unlock()
+		if wc.jobCeiling > 0 && end > wc.jobCeiling {
+			end = wc.jobCeiling
+			if end <= start {
+				break
+			}
+		}
+
+		wg.Add(1)
+		go func(r InputRange) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			chunk := ChunkResult{Range: r}
+			chunk.Response, chunk.Err = wc.runChunk(ctx, phoneNumbers[r.Start:r.End], interval)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if chunk.Err != nil && ctx.Err() != nil {
+				job.Interrupted = true
+			} else if chunk.Err != nil {
+				log.Printf("Chunk %s failed: %v", chunk.Range, chunk.Err)
+				failed = append(failed, r)
+			}
+			job.Chunks = append(job.Chunks, chunk)
+		}(InputRange{Start: start, End: end})
+	}
+	wg.Wait()
+
+	sort.Slice(job.Chunks, func(i, j int) bool { return job.Chunks[i].Range.Start < job.Chunks[j].Range.Start })
+	sort.Slice(failed, func(i, j int) bool { return failed[i].Start < failed[j].Start })
+	for _, r := range failed {
+		job.addMissing(r)
+	}
+
+	if job.Truncated == nil && wc.jobCeiling > 0 && wc.jobCeiling < len(phoneNumbers) {
+		job.truncate(wc.jobCeiling, len(phoneNumbers), fmt.Sprintf("ceiling of %d numbers reached", wc.jobCeiling))
+	}
+
+	job.Partial = len(job.Missing) > 0 || job.Truncated != nil
+	if len(job.Missing) == 1 && job.Missing[0] == (InputRange{Start: 0, End: len(phoneNumbers)}) {
+		return job, fmt.Errorf("all chunks failed")
+	}
+
+	return job, nil
+}
+
+// runChunk uploads and polls one chunk. When ctx is cancelled while
+// polling, the upload response is returned with the error so the caller
+// can hand the still running task off.
+func (wc *Checker) runChunk(ctx context.Context, phoneNumbers []string, interval time.Duration) (*WhatsAppResponse, error) {
+	uploadResponse, err := wc.uploadNumbers(ctx, phoneNumbers, UploadOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := wc.PollTaskStatusContext(ctx, uploadResponse.TaskID, uploadResponse.UserID, interval)
+	if err != nil && ctx.Err() != nil {
+		wc.recordEvent(uploadResponse.TaskID, "detached", "polling interrupted, task left running")
+		return uploadResponse, err
+	}
+	return resp, err
+}
+
+var ErrNoFailures = errors.New("task has no failed numbers")
+
+// ResubmitFailures uploads the numbers whose check errored in taskID as a new
+// task, and links the new task to its parent in the task store.
+func (wc *Checker) ResubmitFailures(ctx context.Context, taskID string) (*WhatsAppResponse, error) {
+	status, err := wc.CheckTaskStatusContext(ctx, taskID, wc.userIDFor(taskID, ""))
+	if err != nil {
+		return nil, err
+	}
+	if status.Status != StatusExported || status.ResultURL == "" {
+		return nil, fmt.Errorf("results not available, task status: %s", status.Status)
+	}
+
+	results, err := wc.fetchResults(ctx, status.ResultURL, -1)
+	if err != nil {
+		return nil, err
+	}
+
+	var failed []string
+	for _, r := range results {
+		if r.Failed() {
+			failed = append(failed, r.Number)
+		}
+	}
+	if len(failed) == 0 {
+		return nil, ErrNoFailures
+	}
+
+	file, err := os.CreateTemp(tempDir(), "whatsapp_resubmit_*.txt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create resubmit file: %v", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	if err := wc.CreateInputFile(failed, file.Name()); err != nil {
+		return nil, fmt.Errorf("failed to write resubmit file: %v", err)
+	}
+
+	resubmitted, err := wc.UploadFileContext(ctx, file.Name())
+	if err != nil {
+		return nil, err
+	}
+
+	if wc.taskStore != nil {
+		rec, _ := wc.taskStore.Get(resubmitted.TaskID)
+		rec.TaskID = resubmitted.TaskID
+		rec.ParentID = taskID
+		rec.addEvent("resubmitted", fmt.Sprintf("retrying %d failed numbers from %s", len(failed), taskID))
+		if err := wc.taskStore.Put(rec); err != nil {
+			log.Printf("Failed to link task %s to %s: %v", resubmitted.TaskID, taskID, err)
+		}
+		wc.recordEvent(taskID, "resubmitted", fmt.Sprintf("%d failed numbers resubmitted as %s", len(failed), resubmitted.TaskID))
+	}
+
+	log.Printf("Resubmitted %d failed numbers from %s as task %s", len(failed), taskID, resubmitted.TaskID)
+	return resubmitted, nil
+}
+
+// CheckNumbers checks phoneNumbers in one task and returns the parsed
+// results. With WithResultSinks the results are also written to every sink;
+// when one fails the results are returned along with the error.
+func (wc *Checker) CheckNumbers(phoneNumbers []string, interval time.Duration) (Results, error) {
+	results, err := wc.checkNumbersCached(phoneNumbers, interval)
+	if err != nil {
+		return nil, err
+	}
+	if err := wc.writeResultSinks(context.Background(), results); err != nil {
+		return results, err
+	}
+	return results, nil
+}
+
+func (wc *Checker) checkNumbersCached(phoneNumbers []string, interval time.Duration) (Results, error) {
+	if wc.resultCache == nil {
+		return wc.checkNumbers(phoneNumbers, interval)
+	}
+
+	var hits Results
+	var misses []string
+	for _, number := range phoneNumbers {
+		if r, ok := wc.cacheGet(number); ok {
+			hits = append(hits, r)
+		} else {
+			misses = append(misses, number)
+		}
+	}
+	log.Printf("Result cache: %d hits, %d numbers to check", len(hits), len(misses))
+	if len(misses) == 0 {
+		return hits, nil
+	}
+
+	fresh, err := wc.checkNumbers(misses, interval)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range fresh {
+		if !r.Failed() {
+			wc.cacheSet(r.Number, r)
+		}
+	}
+	return inInputOrder(phoneNumbers, append(hits, fresh...)), nil
+}
+
+// inInputOrder sorts results by the first position of their normalized
+// number in numbers, so merged cache or history hits come out in the order
+// the numbers were given. Results for numbers not in the input keep their
+// relative order at the end.
+func inInputOrder(numbers []string, results Results) Results {
+	pos := make(map[string]int, len(numbers))
+	for i, number := range numbers {
+		if _, ok := pos[resultKey(number)]; !ok {
+			pos[resultKey(number)] = i
+		}
+	}
+	index := func(r NumberResult) int {
+		if i, ok := pos[resultKey(r.Number)]; ok {
+			return i
+		}
+		return len(numbers)
+	}
+	sort.SliceStable(results, func(i, j int) bool { return index(results[i]) < index(results[j]) })
+	return results
+}
+
+// cacheGet and cacheSet key the result cache by normalized number. With PII
+// hashing the key and the stored number are hashed, so a shared cache such
+// as Redis never holds raw numbers; hits get the caller's number back.
+func (wc *Checker) cacheGet(number string) (NumberResult, bool) {
+	number = NormalizeNumber(number)
+	r, ok := wc.resultCache.Get(wc.redact(number))
+	if ok && wc.piiSalt != nil {
+		r.Number = number
+	}
+	return r, ok
+}
+
+func (wc *Checker) cacheSet(number string, r NumberResult) {
+	key := wc.redact(NormalizeNumber(number))
+	if wc.piiSalt != nil {
+		r.Number = key
+	}
+	wc.resultCache.Set(key, r)
+}
+
+func (wc *Checker) checkNumbers(phoneNumbers []string, interval time.Duration) (Results, error) {
+	if wc.LocalOnly() {
+		log.Printf("No API key configured, skipping remote check of %d numbers", len(phoneNumbers))
+		return checkLocally(phoneNumbers), nil
+	}
+
+	resp, err := wc.runChunk(context.Background(), phoneNumbers, interval)
+	if err != nil {
+		return nil, err
+	}
+	if resp.ResultURL == "" {
+		return nil, fmt.Errorf("task %s exported without a result URL", resp.TaskID)
+	}
+	return wc.FetchResults(resp.ResultURL)
+}
+
+// checkLocally validates numbers without the API, marking each one
+// ResultUnchecked, or ResultInvalid when it can never be checked.
+func checkLocally(phoneNumbers []string) Results {
+	results := make(Results, 0, len(phoneNumbers))
+	for _, raw := range phoneNumbers {
+		if strings.TrimSpace(raw) == "" {
+			continue
+		}
+		if number, _ := RepairNumber(raw, RepairOptions{}); number == "" {
+			results = append(results, NumberResult{Number: strings.TrimSpace(raw), WhatsApp: ResultInvalid})
+		} else {
+			results = append(results, NumberResult{Number: number, WhatsApp: ResultUnchecked})
+		}
+	}
+	return results
+}
+
+// Pipeline streams numbers through the API for long-running services: numbers
+// read from an input channel are batched, uploaded as tasks, polled, and the
+// parsed results sent to an output channel. Every stage blocks when the next
+// one is busy, so a slow consumer throttles uploads instead of buffering.
+type Pipeline struct {
+	Checker      *Checker
+	BatchSize    int           // numbers per task, default 1000
+	BatchWait    time.Duration // flush a partial batch after this long, default 30s
+	MaxInFlight  int           // uploaded tasks waiting to be polled, default 2
+	PollInterval time.Duration // default 10s
+}
+
+// Run drives the pipeline until in is closed and every task is drained, or
+// until ctx is cancelled or a stage fails; the first error stops all stages
+// and is returned once they have exited. Run closes out before returning.
+func (p *Pipeline) Run(ctx context.Context, in <-chan string, out chan<- NumberResult) error {
+	defer close(out)
+
+	batchSize, batchWait, inFlight, interval := p.BatchSize, p.BatchWait, p.MaxInFlight, p.PollInterval
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+	if batchWait <= 0 {
+		batchWait = 30 * time.Second
+	}
+	if inFlight <= 0 {
+		inFlight = 2
+	}
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+
+	g, ctx := newStageGroup(ctx)
+	batches := make(chan []string)
+	tasks := make(chan *WhatsAppResponse, inFlight-1)
+
+	g.Go(func() error {
+		defer close(batches)
+		return p.batch(ctx, in, batches, batchSize, batchWait)
+	})
+	g.Go(func() error {
+		defer close(tasks)
+		for batch := range batches {
+			task, err := p.upload(ctx, batch)
+			if err != nil {
+				return err
+			}
+			select {
+			case tasks <- task:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		return nil
+	})
+	g.Go(func() error {
+		for task := range tasks {
+			done, err := p.Checker.PollTaskStatusContext(ctx, task.TaskID, task.UserID, interval)
+			if err != nil {
+				return fmt.Errorf("task %s: %w", task.TaskID, err)
+			}
+			results, err := p.Checker.fetchResults(ctx, done.ResultURL, -1)
+			if err != nil {
+				return fmt.Errorf("task %s: %w", task.TaskID, err)
+			}
+			if err := p.Checker.writeResultSinks(ctx, results); err != nil {
+				return fmt.Errorf("task %s: %w", task.TaskID, err)
+			}
+			for _, r := range results {
+				select {
+				case out <- r:
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+		return nil
+	})
+	return g.Wait()
+}
+
+func (p *Pipeline) batch(ctx context.Context, in <-chan string, batches chan<- []string, size int, wait time.Duration) error {
+	var batch []string
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		select {
+		case batches <- batch:
+			batch = nil
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case number, ok := <-in:
+			if !ok {
+				return flush()
+			}
+			if number = NormalizeNumber(number); number == "" {
+				continue
+			}
+			if len(batch) == 0 {
+				timer.Reset(wait)
+			}
+			if batch = append(batch, number); len(batch) >= size {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		case <-timer.C:
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (p *Pipeline) upload(ctx context.Context, batch []string) (*WhatsAppResponse, error) {
+	task, err := p.Checker.uploadNumbers(ctx, batch, UploadOptions{})
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Pipeline uploaded %d numbers as task %s", len(batch), task.TaskID)
+	return task, nil
+}
+
+// stageGroup runs goroutines that share a context, cancelling it when the
+// first one fails, like golang.org/x/sync/errgroup.
+type stageGroup struct {
+	wg     sync.WaitGroup
+	once   sync.Once
+	err    error
+	cancel context.CancelFunc
+}
+
+func newStageGroup(ctx context.Context) (*stageGroup, context.Context) {
+	ctx, cancel := context.WithCancel(ctx)
+	return &stageGroup{cancel: cancel}, ctx
+}
+
+func (g *stageGroup) Go(fn func() error) {
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		if err := fn(); err != nil {
+			g.once.Do(func() {
+				g.err = err
+				g.cancel()
+			})
+		}
+	}()
+}
+
+func (g *stageGroup) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	return g.err
+}
+
+func (j *JobResult) truncate(start, end int, reason string) {
+	j.Truncated = &InputRange{Start: start, End: end}
+	j.TruncateReason = reason
+	log.Printf("Job truncated, %s not submitted: %s", j.Truncated, reason)
+}
+
+// Err joins the errors of the chunks that failed, each with its input range,
+// or returns nil when every chunk succeeded.
+func (j *JobResult) Err() error {
+	var errs []error
+	for _, chunk := range j.Chunks {
+		if chunk.Err != nil {
+			errs = append(errs, fmt.Errorf("chunk %s: %w", chunk.Range, chunk.Err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (j *JobResult) addMissing(r InputRange) {
+	if n := len(j.Missing); n > 0 && j.Missing[n-1].End == r.Start {
+		j.Missing[n-1].End = r.End
+		return
+	}
+	j.Missing = append(j.Missing, r)
+}
+
+func (wc *Checker) CreateInputFile(phoneNumbers []string, filePath string) error {
+	content := strings.Join(phoneNumbers, "\n")
+	return os.WriteFile(filePath, []byte(content), 0644)
+}
+
+// CreateInputFileFromString writes content as is, for input that is already
+// one number per line.
+func (wc *Checker) CreateInputFileFromString(content, filePath string) error {
+	return os.WriteFile(filePath, []byte(content), 0644)
+}
+
+// Events receives a task's lifecycle: creation on upload, every status
+// poll, and the outcome. Methods are called synchronously from the goroutine
+// driving the task, so slow work such as network calls belongs in a goroutine
+// of its own. Embed NoopEvents to implement only some of them.
+type Events interface {
+	OnTaskCreated(task *WhatsAppResponse)
+	OnProgress(ev ProgressEvent)
+	OnCompleted(task *WhatsAppResponse)
+	OnFailed(taskID string, err error)
+}
+
+// NoopEvents ignores every event.
+type NoopEvents struct{}
+
+func (NoopEvents) OnTaskCreated(*WhatsAppResponse) {}
+func (NoopEvents) OnProgress(ProgressEvent)        {}
+func (NoopEvents) OnCompleted(*WhatsAppResponse)   {}
+func (NoopEvents) OnFailed(string, error)          {}
+
+func (wc *Checker) emit(fn func(Events)) {
+	for _, e := range wc.events {
+		fn(e)
+	}
+}
+
+// emitOutcome reports a finished poll: exported tasks complete, everything
+// else but the caller giving up fails.
+func (wc *Checker) emitOutcome(taskID string, resp *WhatsAppResponse, err error) {
+	switch {
+	case errors.Is(err, context.Canceled):
+	case err != nil:
+		wc.emit(func(e Events) { e.OnFailed(taskID, err) })
+	case resp.Status == StatusExported:
+		wc.emit(func(e Events) { e.OnCompleted(resp) })
+	case resp.Status == StatusFailed:
+		wc.emit(func(e Events) { e.OnFailed(taskID, ErrTaskFailed) })
+	}
+}
+
+// Notifier is told when a polled task reaches a terminal state.
+type Notifier interface {
+	Notify(ctx context.Context, n TaskNotification) error
+}
+
+type TaskNotification struct {
+	Event     string     `json:"event"`
+	TaskID    string     `json:"task_id"`
+	Status    TaskStatus `json:"status"`
+	Total     int        `json:"total"`
+	Success   int        `json:"success"`
+	Failure   int        `json:"failure"`
+	ResultURL string     `json:"result_url,omitempty"`
+	Duration  string     `json:"duration,omitempty"`
+}
+
+func newTaskNotification(resp *WhatsAppResponse) TaskNotification {
+	n := TaskNotification{
+		Event:     "task.completed",
+		TaskID:    resp.TaskID,
+		Status:    resp.Status,
+		Total:     resp.Total,
+		Success:   resp.Success,
+		Failure:   resp.Failure,
+		ResultURL: resp.ResultURL,
+	}
+	if resp.Status == StatusFailed {
+		n.Event = "task.failed"
+	}
+	if d := resp.Duration(); d > 0 {
+		n.Duration = d.String()
+	}
+	return n
+}
+
+func (wc *Checker) notify(resp *WhatsAppResponse) {
+	if len(wc.notifiers) == 0 {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	n := newTaskNotification(resp)
+	for _, notifier := range wc.notifiers {
+		if err := notifier.Notify(ctx, n); err != nil {
+			log.Printf("Failed to notify about task %s: %v", resp.TaskID, err)
+		}
+	}
+}
+
+// WebhookNotifier posts the notification as JSON to URL.
+type WebhookNotifier struct {
+	URL string
+}
+
+func (w WebhookNotifier) Notify(ctx context.Context, n TaskNotification) error {
+	return postJSONContext(ctx, w.URL, n)
+}
+
+// SlackNotifier posts a short message to a Slack incoming webhook.
+type SlackNotifier struct {
+	WebhookURL string
+}
+
+func (s SlackNotifier) Notify(ctx context.Context, n TaskNotification) error {
+	icon := ":white_check_mark:"
+	if n.Status == StatusFailed {
+		icon = ":x:"
+	}
+	text := fmt.Sprintf("%s WhatsApp check task `%s` %s: %d/%d succeeded, %d failed",
+		icon, n.TaskID, n.Status, n.Success, n.Total, n.Failure)
+	if n.Duration != "" {
+		text += " in " + n.Duration
+	}
+	if n.ResultURL != "" {
+		text += fmt.Sprintf("\n<%s|Download results>", n.ResultURL)
+	}
+	return postJSONContext(ctx, s.WebhookURL, map[string]string{"text": text})
+}
+
+type heartbeat struct {
+	wc         *Checker
+	label      string
+	started    time.Time
+	staleAfter time.Duration
+
+	mu     sync.Mutex
+	last   time.Time
+	detail string
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func (wc *Checker) startHeartbeat(label string, pollInterval time.Duration) *heartbeat {
+	if wc.heartbeatEvery <= 0 {
+		return nil
+	}
+
+	now := time.Now()
+	hb := &heartbeat{
+		wc:         wc,
+		label:      label,
+		started:    now,
+		staleAfter: max(3*pollInterval+wc.httpClient.Timeout, 2*wc.heartbeatEvery),
+		last:       now,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+	go hb.loop()
+	return hb
+}
+
+func (hb *heartbeat) loop() {
+	defer close(hb.done)
+	ticker := time.NewTicker(hb.wc.heartbeatEvery)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hb.stop:
+			return
+		case <-ticker.C:
+		}
+
+		hb.mu.Lock()
+		last, detail := hb.last, hb.detail
+		hb.mu.Unlock()
+
+		if idle := time.Since(last); idle > hb.staleAfter {
+			log.Printf("Heartbeat withheld for %s: no progress for %s", hb.label, idle.Round(time.Second))
+			continue
+		}
+
+		log.Printf("Heartbeat: %s running for %s (%s)", hb.label, time.Since(hb.started).Round(time.Second), detail)
+		hb.wc.metrics.SetGauge("wachecker_last_heartbeat_timestamp_seconds", float64(time.Now().Unix()))
+		hb.ping("", detail)
+	}
+}
+
+// Touch records the task's state after a poll; only a changed state counts
+// as progress.
+func (hb *heartbeat) Touch(detail string) {
+	if hb == nil {
+		return
+	}
+	hb.mu.Lock()
+	if detail != hb.detail {
+		hb.last = time.Now()
+		hb.detail = detail
+	}
+	hb.mu.Unlock()
+}
+
+func (hb *heartbeat) Stop(err error) {
+	if hb == nil {
+		return
+	}
+	close(hb.stop)
+	<-hb.done
+
+	if err != nil {
+		hb.ping("/fail", err.Error())
+		return
+	}
+	hb.ping("", "completed")
+}
+
+func (hb *heartbeat) ping(suffix, detail string) {
+	if hb.wc.heartbeatURL == "" {
+		return
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Post(strings.TrimSuffix(hb.wc.heartbeatURL, "/")+suffix, "text/plain", strings.NewReader(hb.label+": "+detail))
+	if err != nil {
+		log.Printf("Heartbeat ping failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+type TaskRecord struct {
+	TaskID    string            `json:"task_id"`
+	UserID    string            `json:"user_id"`
+	Name      string            `json:"name,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	InputHash string            `json:"input_hash,omitempty"`
+	ParentID  string            `json:"parent_id,omitempty"`
+	Status    TaskStatus        `json:"status"`
+	Total     int               `json:"total"`
+	ResultURL string            `json:"result_url,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+	UpdatedAt time.Time         `json:"updated_at"`
+	Events    []TaskEvent       `json:"events,omitempty"`
+}
+
+// DisplayName is the task's name, or its ID when it has none.
+func (rec TaskRecord) DisplayName() string {
+	if rec.Name != "" {
+		return rec.Name
+	}
+	return rec.TaskID
+}
+
+// HasLabels reports whether every label in selector is set on the task with
+// the same value.
+func (rec TaskRecord) HasLabels(selector map[string]string) bool {
+	for key, value := range selector {
+		if rec.Labels[key] != value {
+			return false
+		}
+	}
+	return true
+}
+
+type TaskEvent struct {
+	Time   time.Time `json:"time"`
+	Kind   string    `json:"kind"`
+	Detail string    `json:"detail,omitempty"`
+}
+
+const maxTaskEvents = 200
+
+func (rec *TaskRecord) addEvent(kind, detail string) {
+	rec.Events = append(rec.Events, TaskEvent{Time: time.Now(), Kind: kind, Detail: detail})
+	if len(rec.Events) > maxTaskEvents {
+		rec.Events = rec.Events[len(rec.Events)-maxTaskEvents:]
+	}
+}
+
+// TaskStore persists known tasks as a JSON file so they survive restarts.
+// Writes go to a temporary file that is renamed over the store.
+type TaskStore struct {
+	path  string
+	mu    sync.Mutex
+	tasks map[string]TaskRecord
+}
+
+func DefaultTaskStorePath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "wachecker_tasks.json"
+	}
+	return filepath.Join(home, ".wachecker", "tasks.json")
+}
+
+func OpenTaskStore(path string) (*TaskStore, error) {
+	ts := &TaskStore{path: path, tasks: make(map[string]TaskRecord)}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return ts, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read task store: %v", err)
+	}
+
+	var records []TaskRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, fmt.Errorf("failed to parse task store: %v", err)
+	}
+	for _, rec := range records {
+		ts.tasks[rec.TaskID] = rec
+	}
+	return ts, nil
+}
+
+func (ts *TaskStore) Get(taskID string) (TaskRecord, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	rec, ok := ts.tasks[taskID]
+	return rec, ok
+}
+
+func (ts *TaskStore) List() []TaskRecord {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.listLocked()
+}
+
+func (ts *TaskStore) listLocked() []TaskRecord {
+	records := make([]TaskRecord, 0, len(ts.tasks))
+	for _, rec := range ts.tasks {
+		records = append(records, rec)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].CreatedAt.Before(records[j].CreatedAt)
+	})
+	return records
+}
+
+func (ts *TaskStore) Put(rec TaskRecord) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if rec.UpdatedAt.IsZero() {
+		rec.UpdatedAt = time.Now()
+	}
+	ts.tasks[rec.TaskID] = rec
+	return ts.saveLocked()
+}
+
+// Update merges a fresh API response into the stored record, using defaults
+// for fields the API does not return when the task is not yet known.
+func (ts *TaskStore) Update(resp *WhatsAppResponse, defaults TaskRecord) error {
+	if resp.TaskID == "" {
+		return nil
+	}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	rec, ok := ts.tasks[resp.TaskID]
+	if !ok {
+		rec = defaults
+		rec.TaskID = resp.TaskID
+		if len(rec.Events) == 0 {
+			rec.addEvent("registered", "first seen via status check")
+		}
+	}
+	if rec.Status != resp.Status {
+		rec.addEvent("status", fmt.Sprintf("%s, success %d/%d", resp.Status, resp.Success, resp.Total))
+	}
+	if resp.UserID != "" {
+		rec.UserID = resp.UserID
+	}
+	if rec.CreatedAt.IsZero() {
+		rec.CreatedAt = resp.CreatedAt.Time
+	}
+	if resp.ResultURL != "" {
+		rec.ResultURL = resp.ResultURL
+	}
+	rec.Status = resp.Status
+	rec.Total = resp.Total
+	rec.UpdatedAt = time.Now()
+
+	ts.tasks[rec.TaskID] = rec
+	return ts.saveLocked()
+}
+
+func (ts *TaskStore) AddEvent(taskID, kind, detail string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	rec, ok := ts.tasks[taskID]
+	if !ok {
+		rec = TaskRecord{TaskID: taskID, CreatedAt: time.Now()}
+	}
+	rec.addEvent(kind, detail)
+	rec.UpdatedAt = time.Now()
+	ts.tasks[taskID] = rec
+	return ts.saveLocked()
+}
+
+func (ts *TaskStore) Delete(taskIDs ...string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, id := range taskIDs {
+		delete(ts.tasks, id)
+	}
+	return ts.saveLocked()
+}
+
+func (ts *TaskStore) FindByResultURL(resultURL string) (TaskRecord, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, rec := range ts.tasks {
+		if rec.ResultURL == resultURL {
+			return rec, true
+		}
+	}
+	return TaskRecord{}, false
+}
+
+// ListTasks returns the stored tasks carrying all labels in selector, oldest
+// first. A nil selector lists every task.
+func (ts *TaskStore) ListTasks(selector map[string]string) []TaskRecord {
+	var records []TaskRecord
+	for _, rec := range ts.List() {
+		if rec.HasLabels(selector) {
+			records = append(records, rec)
+		}
+	}
+	return records
+}
+
+// Label names a task and merges labels into its existing ones; an empty
+// label value removes the label.
+func (ts *TaskStore) Label(taskID, name string, labels map[string]string) error {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	rec, ok := ts.tasks[taskID]
+	if !ok {
+		return fmt.Errorf("unknown task: %s", taskID)
+	}
+	if name != "" {
+		rec.Name = name
+	}
+	for key, value := range labels {
+		if rec.Labels == nil {
+			rec.Labels = make(map[string]string)
+		}
+		if value == "" {
+			delete(rec.Labels, key)
+		} else {
+			rec.Labels[key] = value
+		}
+	}
+	rec.UpdatedAt = time.Now()
+	ts.tasks[taskID] = rec
+	return ts.saveLocked()
+}
+
+func (ts *TaskStore) Children(taskID string) []TaskRecord {
+	var children []TaskRecord
+	for _, rec := range ts.List() {
+		if rec.ParentID == taskID {
+			children = append(children, rec)
+		}
+	}
+	return children
+}
+
+func (ts *TaskStore) FindByHash(inputHash string, maxAge time.Duration) (TaskRecord, bool) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	records := ts.listLocked()
+	for i := len(records) - 1; i >= 0; i-- {
+		rec := records[i]
+		if rec.InputHash != inputHash || rec.Status == StatusFailed {
+			continue
+		}
+		if time.Since(rec.CreatedAt) <= maxAge {
+			return rec, true
+		}
+	}
+	return TaskRecord{}, false
+}
+
+// Check reports whether the store's directory is writable, so a readiness
+// probe fails before task records are lost.
+func (ts *TaskStore) Check() error {
+	dir := filepath.Dir(ts.path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return fmt.Errorf("task store directory unavailable: %v", err)
+	}
+	probe, err := os.CreateTemp(dir, ".probe-*")
+	if err != nil {
+		return fmt.Errorf("task store not writable: %v", err)
+	}
+	probe.Close()
+	os.Remove(probe.Name())
+	return nil
+}
+
+func (ts *TaskStore) saveLocked() error {
+	data, err := json.MarshalIndent(ts.listLocked(), "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode task store: %v", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(ts.path), 0700); err != nil {
+		return fmt.Errorf("failed to create task store directory: %v", err)
+	}
+
+	tmp := ts.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write task store: %v", err)
+	}
+	if err := os.Rename(tmp, ts.path); err != nil {
+		return fmt.Errorf("failed to replace task store: %v", err)
+	}
+	return nil
+}
+
+// callingCodes maps E.164 country calling codes to ISO 3166 alpha-2 codes.
+// Shared codes resolve to their largest member, e.g. the NANP +1 to US.
+var callingCodes = map[string]string{
+	"1": "US", "7": "RU", "20": "EG", "27": "ZA", "30": "GR", "31": "NL", "32": "BE", "33": "FR",
+	"34": "ES", "36": "HU", "39": "IT", "40": "RO", "41": "CH", "43": "AT", "44": "GB", "45": "DK",
+	"46": "SE", "47": "NO", "48": "PL", "49": "DE", "51": "PE", "52": "MX", "53": "CU", "54": "AR",
+	"55": "BR", "56": "CL", "57": "CO", "58": "VE", "60": "MY", "61": "AU", "62": "ID", "63": "PH",
+	"64": "NZ", "65": "SG", "66": "TH", "76": "KZ", "77": "KZ", "81": "JP", "82": "KR", "84": "VN",
+	"86": "CN", "90": "TR", "91": "IN", "92": "PK", "93": "AF", "94": "LK", "95": "MM", "98": "IR",
+	"211": "SS", "212": "MA", "213": "DZ", "216": "TN", "218": "LY", "220": "GM", "221": "SN", "222": "MR",
+	"223": "ML", "224": "GN", "225": "CI", "226": "BF", "227": "NE", "228": "TG", "229": "BJ", "230": "MU",
+	"231": "LR", "232": "SL", "233": "GH", "234": "NG", "235": "TD", "236": "CF", "237": "CM", "238": "CV",
+	"239": "ST", "240": "GQ", "241": "GA", "242": "CG", "243": "CD", "244": "AO", "245": "GW", "248": "SC",
+	"249": "SD", "250": "RW", "251": "ET", "252": "SO", "253": "DJ", "254": "KE", "255": "TZ", "256": "UG",
+	"257": "BI", "258": "MZ", "260": "ZM", "261": "MG", "262": "RE", "263": "ZW", "264": "NA", "265": "MW",
+	"266": "LS", "267": "BW", "268": "SZ", "269": "KM", "291": "ER", "297": "AW", "298": "FO", "299": "GL",
+	"350": "GI", "351": "PT", "352": "LU", "353": "IE", "354": "IS", "355": "AL", "356": "MT", "357": "CY",
+	"358": "FI", "359": "BG", "370": "LT", "371": "LV", "372": "EE", "373": "MD", "374": "AM", "375": "BY",
+	"376": "AD", "377": "MC", "378": "SM", "380": "UA", "381": "RS", "382": "ME", "383": "XK", "385": "HR",
+	"386": "SI", "387": "BA", "389": "MK", "420": "CZ", "421": "SK", "423": "LI", "501": "BZ", "502": "GT",
+	"503": "SV", "504": "HN", "505": "NI", "506": "CR", "507": "PA", "509": "HT", "590": "GP", "591": "BO",
+	"592": "GY", "593": "EC", "594": "GF", "595": "PY", "596": "MQ", "597": "SR", "598": "UY", "599": "CW",
+	"670": "TL", "673": "BN", "675": "PG", "676": "TO", "677": "SB", "678": "VU", "679": "FJ", "685": "WS",
+	"687": "NC", "689": "PF", "850": "KP", "852": "HK", "853": "MO", "855": "KH", "856": "LA", "880": "BD",
+	"886": "TW", "960": "MV", "961": "LB", "962": "JO", "963": "SY", "964": "IQ", "965": "KW", "966": "SA",
+	"967": "YE", "968": "OM", "970": "PS", "971": "AE", "972": "IL", "973": "BH", "974": "QA", "975": "BT",
+	"976": "MN", "977": "NP", "992": "TJ", "993": "TM", "994": "AZ", "995": "GE", "996": "KG", "998": "UZ",
+}
+
+const UnknownCountry = "ZZ"
+
+// CountryForNumber returns the ISO country code for an international number,
+// or UnknownCountry when the calling code is not recognised.
+func CountryForNumber(number string) string {
+	_, country := lookupCallingCode(number)
+	return country
+}
+
+// CallingCodeForCountry returns the calling code for an ISO country code,
+// e.g. "31" for "NL". Countries with several codes get the shortest.
+func CallingCodeForCountry(country string) (string, bool) {
+	country = strings.ToUpper(strings.TrimSpace(country))
+	best := ""
+	for code, c := range callingCodes {
+		if c == country && (best == "" || len(code) < len(best) || (len(code) == len(best) && code < best)) {
+			best = code
+		}
+	}
+	return best, best != ""
+}
+
+// numberingZones names the ITU world numbering zones, keyed by the first
+// digit of the calling code.
+var numberingZones = map[byte]string{
+	'1': "North America",
+	'2': "Africa",
+	'3': "Europe",
+	'4': "Europe",
+	'5': "Latin America",
+	'6': "Southeast Asia and Oceania",
+	'7': "Russia and Kazakhstan",
+	'8': "East Asia",
+	'9': "Asia and Middle East",
+}
+
+const UnknownRegion = "Unknown"
+
+// RegionForNumber returns the ITU numbering zone of the number's calling
+// code, a coarse market region ("Europe", "Latin America", ...).
+func RegionForNumber(number string) string {
+	code, _ := lookupCallingCode(number)
+	if code == "" {
+		return UnknownRegion
+	}
+	return numberingZones[code[0]]
+}
+
+func lookupCallingCode(number string) (code, country string) {
+	normalized := NormalizeNumber(number)
+	if !strings.HasPrefix(normalized, "+") {
+		return "", UnknownCountry
+	}
+	digits := normalized[1:]
+	for n := 3; n >= 1; n-- {
+		if len(digits) > n {
+			if country, ok := callingCodes[digits[:n]]; ok {
+				return digits[:n], country
+			}
+		}
+	}
+	return "", UnknownCountry
+}
+
+// Enricher augments results in place with data from another source, such as
+// a carrier lookup. It receives whole result sets so lookups can be batched.
+type Enricher interface {
+	Enrich(ctx context.Context, results Results) error
+}
+
+// NoopEnricher leaves results unchanged.
+type NoopEnricher struct{}
+
+func (NoopEnricher) Enrich(ctx context.Context, results Results) error { return nil }
+
+// TwilioLookup is a sample Enricher backed by the Twilio Lookup v2 line type
+// intelligence API. Numbers not on WhatsApp are skipped unless All is set,
+// since lookups are billed per number.
+type TwilioLookup struct {
+	AccountSID  string
+	AuthToken   string
+	All         bool
+	Concurrency int // parallel lookups, default 4
+	Client      *http.Client
+	BaseURL     string // default https://lookups.twilio.com/v2/PhoneNumbers
+
+	// PIISalt, when set, replaces numbers in errors with their HashNumber.
+	// Use the salt given to WithPIIHashing.
+	PIISalt []byte
+}
+
+func (t *TwilioLookup) Enrich(ctx context.Context, results Results) error {
+	client, baseURL, workers := t.Client, t.BaseURL, t.Concurrency
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if baseURL == "" {
+		baseURL = "https://lookups.twilio.com/v2/PhoneNumbers"
+	}
+	if workers <= 0 {
+		workers = 4
+	}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+		sem      = make(chan struct{}, workers)
+	)
+	for i := range results {
+		r := &results[i]
+		if !t.All && strings.ToLower(r.WhatsApp) != "yes" {
+			continue
+		}
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			if err := t.lookup(ctx, client, baseURL, r); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func (t *TwilioLookup) lookup(ctx context.Context, client *http.Client, baseURL string, r *NumberResult) error {
+	endpoint := baseURL + "/" + url.PathEscape(NormalizeNumber(r.Number)) + "?Fields=line_type_intelligence"
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.SetBasicAuth(t.AccountSID, t.AuthToken)
+
+	number := r.Number
+	if t.PIISalt != nil {
+		number = HashNumber(number, t.PIISalt)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		// The *url.Error would repeat the number in the request URL.
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+		return fmt.Errorf("lookup failed for %s: %v", number, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("lookup failed for %s: HTTP error: %d", number, resp.StatusCode)
+	}
+
+	var body struct {
+		LineType *struct {
+			CarrierName string `json:"carrier_name"`
+			Type        string `json:"type"`
+		} `json:"line_type_intelligence"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return fmt.Errorf("failed to decode lookup for %s: %v", number, err)
+	}
+	if body.LineType != nil {
+		r.Carrier, r.LineType = body.LineType.CarrierName, body.LineType.Type
+	}
+	return nil
+}
+
+// GroupByCountry splits results by country, using the enriched Country field
+// or deriving it from the number for results that were built by hand.
+func GroupByCountry(results Results) map[string]Results {
+	groups := make(map[string]Results)
+	for _, r := range results {
+		country := r.Country
+		if country == "" {
+			country = CountryForNumber(r.Number)
+		}
+		groups[country] = append(groups[country], r)
+	}
+	return groups
+}
+
+func PartitionByCountry(phoneNumbers []string) map[string][]string {
+	parts := make(map[string][]string)
+	for _, number := range phoneNumbers {
+		country := CountryForNumber(number)
+		parts[country] = append(parts[country], number)
+	}
+	return parts
+}
+
+type CountryResult struct {
+	Country string
+	TaskID  string
+	Numbers int
+	Counts  map[string]int
+	File    string
+	Err     error
+}
+
+// RunByCountry submits one task per country and writes each market's results
+// to <outputDir>/<country>.csv. A failing country does not stop the others.
+func (wc *Checker) RunByCountry(phoneNumbers []string, interval time.Duration, outputDir string) ([]CountryResult, error) {
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %v", err)
+	}
+
+	parts := PartitionByCountry(phoneNumbers)
+	var results []CountryResult
+	failed := 0
+	for _, country := range sortedKeys(parts) {
+		cr := CountryResult{Country: country, Numbers: len(parts[country])}
+		cr.Err = wc.runCountry(&cr, parts[country], interval, outputDir)
+		if cr.Err != nil {
+			log.Printf("Country %s failed: %v", country, cr.Err)
+			failed++
+		}
+		results = append(results, cr)
+	}
+
+	if err := wc.writeCountrySummary(filepath.Join(outputDir, "summary.csv"), results); err != nil {
+		return results, err
+	}
+
+	if failed > 0 && failed == len(results) {
+		return results, fmt.Errorf("all %d countries failed", failed)
+	}
+	return results, nil
+}
+
+func (wc *Checker) writeCountrySummary(path string, results []CountryResult) error {
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	cw.Write([]string{"country", "task_id", "numbers", "whatsapp_yes", "whatsapp_no", "error"})
+	for _, cr := range results {
+		errText := ""
+		if cr.Err != nil {
+			errText = cr.Err.Error()
+		}
+		cw.Write([]string{
+			cr.Country,
+			cr.TaskID,
+			strconv.Itoa(cr.Numbers),
+			strconv.Itoa(cr.Counts["yes"]),
+			strconv.Itoa(cr.Counts["no"]),
+			errText,
+		})
+	}
+	cw.Flush()
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("failed to write summary: %v", err)
+	}
+	data, err := wc.sealBytes(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return fmt.Errorf("failed to write summary: %v", err)
+	}
+	return nil
+}
+
+func (wc *Checker) runCountry(cr *CountryResult, phoneNumbers []string, interval time.Duration, outputDir string) error {
+	task, err := wc.runChunk(context.Background(), phoneNumbers, interval)
+	if err != nil {
+		return err
+	}
+	cr.TaskID = task.TaskID
+
+	results, err := wc.FetchResults(task.ResultURL)
+	if err != nil {
+		return err
+	}
+
+	cr.Counts = make(map[string]int)
+	for _, r := range results {
+		cr.Counts[r.WhatsApp]++
+	}
+
+	cr.File = filepath.Join(outputDir, cr.Country+".csv")
+	return wc.ExportResultsFile(results, cr.File)
+}
+
+// ResultCache stores results keyed by normalized number. Implementations
+// expire entries after their own TTL.
+type ResultCache interface {
+	Get(number string) (NumberResult, bool)
+	Set(number string, result NumberResult)
+}
+
+type lruEntry struct {
+	number  string
+	result  NumberResult
+	expires time.Time
+}
+
+// LRUCache is an in-process ResultCache bounded by size and entry age.
+type LRUCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+func NewLRUCache(size int, ttl time.Duration) *LRUCache {
+	return &LRUCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+func (c *LRUCache) Get(number string) (NumberResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[number]
+	if !ok {
+		return NumberResult{}, false
+	}
+	entry := el.Value.(*lruEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(el)
+		delete(c.entries, number)
+		return NumberResult{}, false
+	}
+	c.order.MoveToFront(el)
+	return entry.result, true
+}
+
+func (c *LRUCache) Set(number string, result NumberResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	expires := time.Now().Add(c.ttl)
+	if el, ok := c.entries[number]; ok {
+		entry := el.Value.(*lruEntry)
+		entry.result, entry.expires = result, expires
+		c.order.MoveToFront(el)
+		return
+	}
+
+	c.entries[number] = c.order.PushFront(&lruEntry{number: number, result: result, expires: expires})
+	for c.size > 0 && c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*lruEntry).number)
+	}
+}
+
+// DropFolder watches a directory for new .txt and .csv files, checks them,
+// and moves each file to done/ next to a <name>.results.csv file, or to
+// failed/ with a <name>.error.txt file. A file is only picked up once its
+// size has stopped changing between two scans, so partial copies are skipped.
+type DropFolder struct {
+	Dir          string
+	ScanInterval time.Duration
+	PollInterval time.Duration
+
+	checker *Checker
+	sizes   map[string]int64
+}
+
+func NewDropFolder(checker *Checker, dir string) *DropFolder {
+	return &DropFolder{
+		Dir:          dir,
+		ScanInterval: 10 * time.Second,
+		PollInterval: 5 * time.Second,
+		checker:      checker,
+		sizes:        make(map[string]int64),
+	}
+}
+
+func (d *DropFolder) Run(ctx context.Context) error {
+	ticker := time.NewTicker(d.ScanInterval)
+	defer ticker.Stop()
+	for {
+		if _, err := d.ScanOnce(ctx); err != nil {
+			log.Printf("Drop folder scan failed: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// ScanOnce processes every stable input file and returns the names of the
+// files it moved to done/.
+func (d *DropFolder) ScanOnce(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(d.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read directory: %v", err)
+	}
+
+	seen := make(map[string]bool)
+	var done []string
+	for _, entry := range entries {
+		ext := strings.ToLower(filepath.Ext(entry.Name()))
+		if entry.IsDir() || (ext != ".txt" && ext != ".csv") || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		name := entry.Name()
+		seen[name] = true
+		if previous, ok := d.sizes[name]; !ok || previous != info.Size() {
+			d.sizes[name] = info.Size()
+			continue
+		}
+		if ctx.Err() != nil {
+			return done, ctx.Err()
+		}
+
+		delete(d.sizes, name)
+		if err := d.process(name); err != nil {
+			log.Printf("Drop folder: %s failed: %v", name, err)
+			if err := d.moveTo("failed", name, ".error.txt", []byte(err.Error()+"\n")); err != nil {
+				log.Printf("Drop folder: %v", err)
+			}
+			continue
+		}
+		done = append(done, name)
+	}
+	for name := range d.sizes {
+		if !seen[name] {
+			delete(d.sizes, name)
+		}
+	}
+	return done, nil
+}
+
+func (d *DropFolder) process(name string) error {
+	numbers, err := LoadNumbersFile(filepath.Join(d.Dir, name))
+	if err != nil {
+		return err
+	}
+	if numbers, _ = DedupeNumbers(numbers); len(numbers) == 0 {
+		return errors.New("file contains no numbers")
+	}
+
+	log.Printf("Drop folder: checking %d numbers from %s", len(numbers), name)
+	results, err := d.checker.CheckNumbers(numbers, d.PollInterval)
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := d.checker.redactResults(results).ExportCSV(&buf); err != nil {
+		return err
+	}
+	data, err := d.checker.sealBytes(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	return d.moveTo("done", name, ".results.csv", data)
+}
+
+// moveTo moves name into sub and writes a companion file next to it.
+func (d *DropFolder) moveTo(sub, name, suffix string, companion []byte) error {
+	dir := filepath.Join(d.Dir, sub)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+	base := strings.TrimSuffix(name, filepath.Ext(name))
+	if err := os.WriteFile(filepath.Join(dir, base+suffix), companion, 0644); err != nil {
+		return fmt.Errorf("failed to write %s%s: %v", base, suffix, err)
+	}
+	if err := os.Rename(filepath.Join(d.Dir, name), filepath.Join(dir, name)); err != nil {
+		return fmt.Errorf("failed to move %s to %s: %v", name, sub, err)
+	}
+	return nil
+}
+
+// CronSchedule is a standard five-field cron expression (minute, hour, day of
+// month, month, day of week) evaluated in local time. As in cron, when both
+// day fields are restricted a day matching either one is selected; a field
+// starting with "*", such as "*/2", does not count as restricted.
+type CronSchedule struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+var cronAliases = map[string]string{
+	"@hourly":   "0 * * * *",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@weekly":   "0 0 * * 0",
+	"@monthly":  "0 0 1 * *",
+	"@yearly":   "0 0 1 1 *",
+}
+
+func ParseCron(expr string) (*CronSchedule, error) {
+	if alias, ok := cronAliases[strings.TrimSpace(expr)]; ok {
+		expr = alias
+	}
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("invalid cron expression %q: expected 5 fields", expr)
+	}
+
+	bounds := [5][2]int{{0, 59}, {0, 23}, {1, 31}, {1, 12}, {0, 7}}
+	var masks [5]uint64
+	for i, field := range fields {
+		mask, err := parseCronField(field, bounds[i][0], bounds[i][1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cron expression %q: %v", expr, err)
+		}
+		masks[i] = mask
+	}
+	// Both 0 and 7 mean Sunday.
+	if masks[4]&(1<<7) != 0 {
+		masks[4] |= 1
+	}
+	return &CronSchedule{
+		minute: masks[0], hour: masks[1], dom: masks[2], month: masks[3], dow: masks[4],
+		domAny: strings.HasPrefix(fields[2], "*"), dowAny: strings.HasPrefix(fields[4], "*"),
+	}, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var mask uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return 0, fmt.Errorf("invalid step %q", part)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		if rangePart != "*" {
+			from, to, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = strconv.Atoi(from); err != nil {
+				return 0, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return 0, fmt.Errorf("invalid range %q", part)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, fmt.Errorf("%q out of range %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			mask |= 1 << uint(v)
+		}
+	}
+	return mask, nil
+}
+
+// Next returns the first matching minute strictly after t, or the zero time
+// if the expression never matches (e.g. "0 0 31 2 *").
+func (c *CronSchedule) Next(t time.Time) time.Time {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		switch {
+		case c.month&(1<<uint(t.Month())) == 0:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+		case !c.dayMatches(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+		case c.hour&(1<<uint(t.Hour())) == 0:
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+		case c.minute&(1<<uint(t.Minute())) == 0:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func (c *CronSchedule) dayMatches(t time.Time) bool {
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	if c.domAny || c.dowAny {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+type ScheduledJob struct {
+	Name     string
+	Schedule *CronSchedule
+	Source   Source
+	Sink     Sink
+}
+
+// Scheduler re-checks each job's source on its cron schedule and delivers the
+// results to its sink. A job never overlaps with itself: a run that is still
+// going when the next one is due delays it.
+type Scheduler struct {
+	PollInterval time.Duration
+
+	checker *Checker
+	jobs    []ScheduledJob
+}
+
+func NewScheduler(checker *Checker) *Scheduler {
+	return &Scheduler{checker: checker, PollInterval: 30 * time.Second}
+}
+
+func (s *Scheduler) Add(name, cronExpr string, source Source, sink Sink) error {
+	schedule, err := ParseCron(cronExpr)
+	if err != nil {
+		return err
+	}
+	s.jobs = append(s.jobs, ScheduledJob{Name: name, Schedule: schedule, Source: source, Sink: sink})
+	return nil
+}
+
+func (s *Scheduler) Run(ctx context.Context) error {
+	if len(s.jobs) == 0 {
+		return errors.New("no jobs scheduled")
+	}
+	var wg sync.WaitGroup
+	for _, job := range s.jobs {
+		wg.Add(1)
+		go func(job ScheduledJob) {
+			defer wg.Done()
+			s.loop(ctx, job)
+		}(job)
+	}
+	wg.Wait()
+	return ctx.Err()
+}
+
+func (s *Scheduler) loop(ctx context.Context, job ScheduledJob) {
+	for {
+		next := job.Schedule.Next(time.Now())
+		if next.IsZero() {
+			log.Printf("Job %s: schedule never fires, stopping", job.Name)
+			return
+		}
+		log.Printf("Job %s: next run at %s", job.Name, next.Format(time.RFC3339))
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if err := s.RunNow(ctx, job); err != nil {
+			log.Printf("Job %s failed: %v", job.Name, err)
+		}
+	}
+}
+
+// RunNow runs job once. The sink receives "<name>-<timestamp>" as the task
+// ID, since one run may span several upstream tasks.
+func (s *Scheduler) RunNow(ctx context.Context, job ScheduledJob) error {
+	numbers, err := job.Source.Numbers(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load numbers: %v", err)
+	}
+	numbers, _ = DedupeNumbers(numbers)
+	if len(numbers) == 0 {
+		log.Printf("Job %s: source returned no numbers", job.Name)
+		return nil
+	}
+
+	runID := job.Name + "-" + time.Now().UTC().Format("20060102T150405Z")
+	results, err := s.checker.CheckNumbers(numbers, s.PollInterval)
+	if err != nil {
+		return err
+	}
+	if err := s.checker.bindSink(job.Sink).WriteResults(ctx, runID, s.checker.redactResults(results)); err != nil {
+		return fmt.Errorf("failed to deliver results: %v", err)
+	}
+	log.Printf("Job %s: delivered %d results as %s", job.Name, len(results), runID)
+	return nil
+}
+
+// BloomFilter is a compact membership index of checked numbers. Contains
+// never misses an added number and wrongly claims a new one with about the
+// rate the filter was sized for, so a large list can be pre-filtered in
+// memory and only possible matches looked up in the history: 200M numbers at
+// 1% take about 240 MB.
+type BloomFilter struct {
+	bits   []uint64
+	m      uint64 // number of bits
+	hashes uint32
+}
+
+// NewBloomFilter sizes a filter for n numbers at false positive rate fpRate.
+func NewBloomFilter(n int, fpRate float64) *BloomFilter {
+	n = max(n, 1)
+	if fpRate <= 0 || fpRate >= 1 {
+		fpRate = 0.01
+	}
+	m := uint64(math.Ceil(-float64(n) * math.Log(fpRate) / (math.Ln2 * math.Ln2)))
+	m = max(m, 64)
+	k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+	return &BloomFilter{bits: make([]uint64, (m+63)/64), m: m, hashes: max(k, 1)}
+}
+
+// locations derives the filter's bit positions for number by double
+// hashing the two halves of its 128-bit FNV-1a hash.
+func (bf *BloomFilter) locations(number string, fn func(bit uint64) bool) {
+	h := fnv.New128a()
+	h.Write([]byte(resultKey(number)))
+	sum := h.Sum(nil)
+	h1, h2 := binary.BigEndian.Uint64(sum[:8]), binary.BigEndian.Uint64(sum[8:])|1
+	for i := uint64(0); i < uint64(bf.hashes); i++ {
+		if !fn((h1 + i*h2) % bf.m) {
+			return
+		}
+	}
+}
+
+func (bf *BloomFilter) Add(number string) {
+	bf.locations(number, func(bit uint64) bool {
+		bf.bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+func (bf *BloomFilter) Contains(number string) bool {
+	found := true
+	bf.locations(number, func(bit uint64) bool {
+		found = bf.bits[bit/64]&(1<<(bit%64)) != 0
+		return found
+	})
+	return found
+}
+
+// Filter splits numbers into those possibly checked before and those
+// certainly not.
+func (bf *BloomFilter) Filter(numbers []string) (maybeChecked, unchecked []string) {
+	for _, number := range numbers {
+		if bf.Contains(number) {
+			maybeChecked = append(maybeChecked, number)
+		} else {
+			unchecked = append(unchecked, number)
+		}
+	}
+	return maybeChecked, unchecked
+}
+
+var bloomMagic = []byte("WABF1")
+
+// WriteTo saves the filter so it can be reloaded with ReadBloomFilter
+// instead of rebuilt from the history.
+func (bf *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	header := append([]byte(nil), bloomMagic...)
+	header = binary.LittleEndian.AppendUint64(header, bf.m)
+	header = binary.LittleEndian.AppendUint32(header, bf.hashes)
+	bw := bufio.NewWriter(w)
+	bw.Write(header)
+	if err := binary.Write(bw, binary.LittleEndian, bf.bits); err != nil {
+		return 0, fmt.Errorf("failed to write bloom filter: %v", err)
+	}
+	if err := bw.Flush(); err != nil {
+		return 0, fmt.Errorf("failed to write bloom filter: %v", err)
+	}
+	return int64(len(header) + 8*len(bf.bits)), nil
+}
+
+func ReadBloomFilter(r io.Reader) (*BloomFilter, error) {
+	br := bufio.NewReader(r)
+	header := make([]byte, len(bloomMagic)+12)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("failed to read bloom filter: %v", err)
+	}
+	if !bytes.Equal(header[:len(bloomMagic)], bloomMagic) {
+		return nil, errors.New("not a bloom filter file")
+	}
+	bf := &BloomFilter{
+		m:      binary.LittleEndian.Uint64(header[len(bloomMagic):]),
+		hashes: binary.LittleEndian.Uint32(header[len(bloomMagic)+8:]),
+	}
+	if bf.m == 0 || bf.hashes == 0 {
+		return nil, errors.New("invalid bloom filter header")
+	}
+	bf.bits = make([]uint64, (bf.m+63)/64)
+	if err := binary.Read(br, binary.LittleEndian, bf.bits); err != nil {
+		return nil, fmt.Errorf("failed to read bloom filter: %v", err)
+	}
+	return bf, nil
+}
+
+// HistoryEntry is the last result recorded for a number.
+type HistoryEntry struct {
+	Result    NumberResult `json:"result"`
+	CheckedAt time.Time    `json:"checked_at"`
+}
+
+// ResultHistory is a local database of past results keyed by normalized
+// number, or by its HashNumber when PII hashing is enabled.
+type ResultHistory interface {
+	Last(key string) (HistoryEntry, bool)
+	Record(checkedAt time.Time, results Results) error
+}
+
+// FileHistory keeps the latest result per number in a JSON file, written
+// like the TaskStore.
+type FileHistory struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]HistoryEntry
+}
+
+func DefaultHistoryPath() string {
+	return filepath.Join(filepath.Dir(DefaultTaskStorePath()), "history.json")
+}
+
+func OpenFileHistory(path string) (*FileHistory, error) {
+	h := &FileHistory{path: path, entries: make(map[string]HistoryEntry)}
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return h, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read history: %v", err)
+	}
+	if err := json.Unmarshal(data, &h.entries); err != nil {
+		return nil, fmt.Errorf("failed to parse history: %v", err)
+	}
+	return h, nil
+}
+
+func (h *FileHistory) Last(key string) (HistoryEntry, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entry, ok := h.entries[key]
+	return entry, ok
+}
+
+// Record stores results under their Number, which callers set to the key.
+func (h *FileHistory) Record(checkedAt time.Time, results Results) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range results {
+		h.entries[r.Number] = HistoryEntry{Result: r, CheckedAt: checkedAt}
+	}
+
+	data, err := json.Marshal(h.entries)
+	if err != nil {
+		return fmt.Errorf("failed to encode history: %v", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0700); err != nil {
+		return fmt.Errorf("failed to create history directory: %v", err)
+	}
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write history: %v", err)
+	}
+	if err := os.Rename(tmp, h.path); err != nil {
+		return fmt.Errorf("failed to replace history: %v", err)
+	}
+	return nil
+}
+
+// IncrementalChecker submits only numbers that were never checked, whose
+// last check failed, or whose last result is older than Staleness, and
+// answers the rest from History. A zero Staleness never re-checks. With Seen
+// set, numbers it does not contain are submitted without a History lookup.
+type IncrementalChecker struct {
+	Checker   *Checker
+	History   ResultHistory
+	Staleness time.Duration
+	Seen      *BloomFilter
+}
+
+func NewIncrementalChecker(checker *Checker, history ResultHistory, staleness time.Duration) *IncrementalChecker {
+	return &IncrementalChecker{Checker: checker, History: history, Staleness: staleness}
+}
+
+// IncrementalReport is what an incremental check skipped. SavedCost is set
+// when the checker has WithPricing.
+type IncrementalReport struct {
+	Total     int     `json:"total"`
+	Reused    int     `json:"reused"`
+	Submitted int     `json:"submitted"`
+	SavedCost float64 `json:"saved_cost,omitempty"`
+}
+
+func (r *IncrementalReport) String() string {
+	s := fmt.Sprintf("%d of %d numbers answered from history, %d submitted", r.Reused, r.Total, r.Submitted)
+	if r.SavedCost > 0 {
+		s += fmt.Sprintf(", saved %.2f", r.SavedCost)
+	}
+	return s
+}
+
+// Split divides numbers, deduplicated, into results reused from history and
+// numbers that still need checking.
+func (ic *IncrementalChecker) Split(numbers []string) (Results, []string, *IncrementalReport) {
+	var reused Results
+	var stale []string
+	seen := make(map[string]bool, len(numbers))
+	now := time.Now()
+	for _, raw := range numbers {
+		number := NormalizeNumber(raw)
+		if number == "" || seen[number] {
+			continue
+		}
+		seen[number] = true
+		key := ic.Checker.redact(number)
+		if ic.Seen != nil && !ic.Seen.Contains(key) {
+			stale = append(stale, number)
+			continue
+		}
+
+		entry, ok := ic.History.Last(key)
+		if ok && !entry.Result.Failed() && (ic.Staleness <= 0 || now.Sub(entry.CheckedAt) < ic.Staleness) {
+			r := entry.Result
+			r.Number = number
+			reused = append(reused, r)
+		} else {
+			stale = append(stale, number)
+		}
+	}
+
+	report := &IncrementalReport{Total: len(seen), Reused: len(reused), Submitted: len(stale)}
+	report.SavedCost = float64(report.Reused) * ic.Checker.pricePerNumber
+	return reused, stale, report
+}
+
+// Record adds freshly checked results to the history. Failed checks are not
+// recorded, so they are retried next time.
+func (ic *IncrementalChecker) Record(results Results) error {
+	var ok Results
+	for _, r := range results {
+		if !r.Failed() {
+			r.Number = ic.Checker.redact(cmp.Or(NormalizeNumber(r.Number), r.Number))
+			ok = append(ok, r)
+			if ic.Seen != nil {
+				ic.Seen.Add(r.Number)
+			}
+		}
+	}
+	return ic.History.Record(time.Now(), ok)
+}
+
+// Check returns results for numbers, checking only the stale ones with
+// CheckNumbers.
+func (ic *IncrementalChecker) Check(numbers []string, interval time.Duration) (Results, *IncrementalReport, error) {
+	reused, stale, report := ic.Split(numbers)
+	log.Printf("Incremental check: %s", report)
+	if len(stale) == 0 {
+		return reused, report, nil
+	}
+
+	fresh, err := ic.Checker.CheckNumbers(stale, interval)
+	if err != nil {
+		return nil, report, err
+	}
+	if err := ic.Record(fresh); err != nil {
+		return nil, report, err
+	}
+	return inInputOrder(numbers, append(reused, fresh...)), report, nil
+}
+
+type StatusChange struct {
+	Number    string    `json:"number"`
+	Previous  string    `json:"previous"`
+	Current   string    `json:"current"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// WatchList re-checks a set of numbers on a schedule and only notifies when
+// a number's WhatsApp status differs from the previous check. The first check
+// of a number records a baseline and is never reported as a change. Numbers
+// are watched in E.164 form, so they must include their calling code.
+type WatchList struct {
+	OnChange   func(StatusChange)
+	WebhookURL string
+
+	checker      *Checker
+	pollInterval time.Duration
+
+	mu       sync.Mutex
+	statuses map[string]string
+}
+
+func NewWatchList(checker *Checker, pollInterval time.Duration) *WatchList {
+	return &WatchList{
+		checker:      checker,
+		pollInterval: pollInterval,
+		statuses:     make(map[string]string),
+	}
+}
+
+func (w *WatchList) Add(phoneNumbers ...string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, number := range phoneNumbers {
+		key := watchKey(number)
+		if _, ok := w.statuses[key]; !ok && key != "" {
+			w.statuses[key] = ""
+		}
+	}
+}
+
+func (w *WatchList) Remove(phoneNumbers ...string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for _, number := range phoneNumbers {
+		delete(w.statuses, watchKey(number))
+	}
+}
+
+// watchKey returns number in E.164 form, so "+1 415 555 0100", "0014155550100"
+// and "14155550100" are one entry, however the API echoes them back.
+func watchKey(number string) string {
+	n := NormalizeNumber(number)
+	if n == "" || strings.HasPrefix(n, "+") {
+		return n
+	}
+	return "+" + n
+}
+
+func (w *WatchList) Numbers() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	numbers := make([]string, 0, len(w.statuses))
+	for number := range w.statuses {
+		numbers = append(numbers, number)
+	}
+	sort.Strings(numbers)
+	return numbers
+}
+
+func (w *WatchList) CheckOnce() ([]StatusChange, error) {
+	numbers := w.Numbers()
+	if len(numbers) == 0 {
+		return nil, nil
+	}
+
+	results, err := w.checker.CheckNumbers(numbers, w.pollInterval)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	var changes []StatusChange
+	w.mu.Lock()
+	for _, result := range results {
+		key := watchKey(result.Number)
+		previous, watched := w.statuses[key]
+		if !watched {
+			continue
+		}
+		w.statuses[key] = result.WhatsApp
+		if previous != "" && previous != result.WhatsApp {
+			changes = append(changes, StatusChange{
+				Number:    key,
+				Previous:  previous,
+				Current:   result.WhatsApp,
+				CheckedAt: now,
+			})
+		}
+	}
+	w.mu.Unlock()
+
+	for _, change := range changes {
+		if w.OnChange != nil {
+			w.OnChange(change)
+		}
+	}
+	if len(changes) > 0 && w.WebhookURL != "" {
+		if err := postJSON(w.WebhookURL, changes); err != nil {
+			return changes, fmt.Errorf("failed to notify webhook: %v", err)
+		}
+	}
+	return changes, nil
+}
+
+func (w *WatchList) Run(ctx context.Context, every time.Duration) error {
+	ticker := time.NewTicker(every)
+	defer ticker.Stop()
+
+	for {
+		if _, err := w.CheckOnce(); err != nil {
+			log.Printf("Watch list check failed: %v", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// webhookClient posts notifications; the timeout keeps an unresponsive
+// endpoint from stalling the watch loop or the pipeline that notifies it.
+var webhookClient = &http.Client{Timeout: 30 * time.Second}
+
+func postJSON(url string, payload interface{}) error {
+	return postJSONContext(context.Background(), url, payload)
+}
+
+func postJSONContext(ctx context.Context, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("failed to encode payload: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP error: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// SheetsWriter appends results to a Google Sheet through the Sheets v4 REST
+// API. The caller supplies an OAuth access token with the spreadsheets scope,
+// e.g. from "gcloud auth print-access-token".
+type SheetsWriter struct {
+	AccessToken   string
+	SpreadsheetID string
+	Title         string
+	ChunkSize     int
+
+	// SummaryOnly writes just the Summary tab, leaving numbers out of the
+	// spreadsheet.
+	SummaryOnly bool
+
 	baseURL    string
 	httpClient *http.Client
 }
 
-type WhatsAppResponse struct {
-	CreatedAt string `json:"created_at"`
-	UpdatedAt string `json:"updated_at"`
-	TaskID    string `json:"task_id"`
-	UserID    string `json:"user_id"`
-	Status    string `json:"status"`
-	Total     int    `json:"total"`
-	Success   int    `json:"success"`
-	Failure   int    `json:"failure"`
-	ResultURL string `json:"result_url,omitempty"`
-}
-
-func NewWhatsAppChecker(apiKey string) *WhatsAppChecker {
-	return &WhatsAppChecker{
-		apiKey:  apiKey,
-		baseURL: "https://api.checknumber.ai/wa/api/simple/tasks",
-		httpClient: &http.Client{
-			Timeout: 30 * time.Second,
-		},
+func NewSheetsWriter(accessToken, spreadsheetID string) *SheetsWriter {
+	return &SheetsWriter{
+		AccessToken:   accessToken,
+		SpreadsheetID: spreadsheetID,
+		Title:         "WhatsApp Results " + time.Now().Format("2006-01-02 15:04"),
+		ChunkSize:     5000,
+		baseURL:       "https://sheets.googleapis.com/v4/spreadsheets",
+		httpClient: &http.Client{
+			Timeout: 60 * time.Second,
+		},
+	}
+}
+
+// Write appends results to a "Results" tab and rewrites a "Summary" tab,
+// creating the spreadsheet when no ID was given. It returns the spreadsheet ID.
+func (sw *SheetsWriter) Write(results Results) (string, error) {
+	tabs := []string{"Results", "Summary"}
+	if sw.SummaryOnly {
+		tabs = tabs[1:]
+	}
+	newResultsTab := true
+	if sw.SpreadsheetID == "" {
+		var created struct {
+			SpreadsheetID string `json:"spreadsheetId"`
+		}
+		var sheets []map[string]interface{}
+		for _, title := range tabs {
+			sheets = append(sheets, map[string]interface{}{"properties": map[string]string{"title": title}})
+		}
+		body := map[string]interface{}{
+			"properties": map[string]string{"title": sw.Title},
+			"sheets":     sheets,
+		}
+		if err := sw.call("POST", sw.baseURL, body, &created); err != nil {
+			return "", fmt.Errorf("failed to create spreadsheet: %v", err)
+		}
+		sw.SpreadsheetID = created.SpreadsheetID
+	} else {
+		added, err := sw.ensureTabs(tabs...)
+		if err != nil {
+			return sw.SpreadsheetID, err
+		}
+		newResultsTab = added["Results"]
+	}
+
+	var rows [][]string
+	if newResultsTab && !sw.SummaryOnly {
+		rows = append(rows, []string{"number", "whatsapp"})
+	}
+	if !sw.SummaryOnly {
+		for _, r := range results {
+			rows = append(rows, []string{r.Number, r.WhatsApp})
+		}
+	}
+
+	chunkSize := sw.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 5000
+	}
+	for start := 0; start < len(rows); start += chunkSize {
+		end := start + chunkSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		endpoint := fmt.Sprintf("%s/%s/values/%s:append?valueInputOption=RAW&insertDataOption=INSERT_ROWS",
+			sw.baseURL, sw.SpreadsheetID, url.PathEscape("Results!A1"))
+		if err := sw.call("POST", endpoint, map[string]interface{}{"values": rows[start:end]}, nil); err != nil {
+			return sw.SpreadsheetID, fmt.Errorf("failed to append rows %d-%d: %v", start, end, err)
+		}
+	}
+
+	counts := make(map[string]int)
+	for _, r := range results {
+		counts[r.WhatsApp]++
+	}
+	summary := [][]string{{"whatsapp", "count"}}
+	for _, status := range sortedKeys(counts) {
+		summary = append(summary, []string{status, strconv.Itoa(counts[status])})
+	}
+	summary = append(summary, []string{"total", strconv.Itoa(len(results))})
+
+	byCountry := Summarize(results).ByCountry
+	summary = append(summary, []string{}, []string{"country", "total", "yes", "no", "failed"})
+	for _, country := range sortedKeys(byCountry) {
+		c := byCountry[country]
+		summary = append(summary, []string{country, strconv.Itoa(c.Total), strconv.Itoa(c.Yes), strconv.Itoa(c.No), strconv.Itoa(c.Failed)})
+	}
+
+	// Clear first, so a shorter summary leaves no rows of the previous one.
+	endpoint := fmt.Sprintf("%s/%s/values/%s:clear", sw.baseURL, sw.SpreadsheetID, url.PathEscape("Summary"))
+	if err := sw.call("POST", endpoint, map[string]interface{}{}, nil); err != nil {
+		return sw.SpreadsheetID, fmt.Errorf("failed to clear summary: %v", err)
+	}
+	endpoint = fmt.Sprintf("%s/%s/values/%s?valueInputOption=RAW",
+		sw.baseURL, sw.SpreadsheetID, url.PathEscape("Summary!A1"))
+	if err := sw.call("PUT", endpoint, map[string]interface{}{"values": summary}, nil); err != nil {
+		return sw.SpreadsheetID, fmt.Errorf("failed to write summary: %v", err)
+	}
+
+	return sw.SpreadsheetID, nil
+}
+
+func (sw *SheetsWriter) ensureTabs(titles ...string) (map[string]bool, error) {
+	var spreadsheet struct {
+		Sheets []struct {
+			Properties struct {
+				Title string `json:"title"`
+			} `json:"properties"`
+		} `json:"sheets"`
+	}
+	endpoint := fmt.Sprintf("%s/%s?fields=sheets.properties.title", sw.baseURL, sw.SpreadsheetID)
+	if err := sw.call("GET", endpoint, nil, &spreadsheet); err != nil {
+		return nil, fmt.Errorf("failed to read spreadsheet: %v", err)
+	}
+
+	existing := make(map[string]bool)
+	for _, sheet := range spreadsheet.Sheets {
+		existing[sheet.Properties.Title] = true
+	}
+
+	added := make(map[string]bool)
+	var requests []map[string]interface{}
+	for _, title := range titles {
+		if !existing[title] {
+			added[title] = true
+			requests = append(requests, map[string]interface{}{
+				"addSheet": map[string]interface{}{"properties": map[string]string{"title": title}},
+			})
+		}
+	}
+	if len(requests) == 0 {
+		return added, nil
+	}
+
+	endpoint = fmt.Sprintf("%s/%s:batchUpdate", sw.baseURL, sw.SpreadsheetID)
+	if err := sw.call("POST", endpoint, map[string]interface{}{"requests": requests}, nil); err != nil {
+		return nil, fmt.Errorf("failed to add sheets: %v", err)
+	}
+	return added, nil
+}
+
+func (sw *SheetsWriter) call(method, endpoint string, payload, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		data, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to encode request: %v", err)
+		}
+		body = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Authorization", "Bearer "+sw.AccessToken)
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := sw.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP error: %d", resp.StatusCode)
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("failed to decode response: %v", err)
+	}
+	return nil
+}
+
+// SpreadsheetURL is the link to open the written spreadsheet in a browser.
+func (sw *SheetsWriter) SpreadsheetURL() string {
+	return "https://docs.google.com/spreadsheets/d/" + sw.SpreadsheetID
+}
+
+// newSheetsSink backs "sheets:<spreadsheet-id>" specs, or "sheets:" for a new
+// spreadsheet per write, authenticated with GOOGLE_OAUTH_ACCESS_TOKEN.
+func newSheetsSink(location string) (Sink, error) {
+	token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN")
+	if token == "" {
+		return nil, errors.New("GOOGLE_OAUTH_ACCESS_TOKEN is not set")
+	}
+	return sheetsSink{token: token, spreadsheetID: location}, nil
+}
+
+type sheetsSink struct {
+	token         string
+	spreadsheetID string
+}
+
+func (s sheetsSink) WriteResults(ctx context.Context, taskID string, results Results) error {
+	sw := NewSheetsWriter(s.token, s.spreadsheetID)
+	if _, err := sw.Write(results); err != nil {
+		return err
+	}
+	log.Printf("Wrote %d results for %s to %s", len(results), cmp.Or(taskID, "run"), sw.SpreadsheetURL())
+	return nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// S3Store uploads result files to an S3 bucket (or an S3-compatible endpoint)
+// using Signature Version 4, so no AWS SDK is required.
+type S3Store struct {
+	Bucket       string
+	Region       string
+	Endpoint     string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	httpClient *http.Client
+}
+
+func NewS3StoreFromEnv(bucket string) (*S3Store, error) {
+	store := &S3Store{
+		Bucket:       bucket,
+		Region:       os.Getenv("AWS_REGION"),
+		Endpoint:     os.Getenv("AWS_ENDPOINT_URL_S3"),
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		httpClient:   &http.Client{Timeout: 10 * time.Minute},
+	}
+	if store.Region == "" {
+		store.Region = "us-east-1"
+	}
+	if store.AccessKey == "" || store.SecretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return store, nil
+}
+
+func (s *S3Store) Put(ctx context.Context, key string, body io.Reader, size int64) (string, error) {
+	// S3 rejects chunked uploads without a signed chunk encoding, so bodies
+	// of unknown length are buffered to learn their size.
+	if size < 0 {
+		data, err := io.ReadAll(body)
+		if err != nil {
+			return "", fmt.Errorf("failed to read body: %v", err)
+		}
+		body, size = bytes.NewReader(data), int64(len(data))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", s.objectURL(key), body)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+	req.ContentLength = size
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	signAWSV4(req, "s3", s.Region, s.AccessKey, s.SecretKey, s.SessionToken, "UNSIGNED-PAYLOAD", time.Now())
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("HTTP error: %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return fmt.Sprintf("s3://%s/%s", s.Bucket, key), nil
+}
+
+func (s *S3Store) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", s.objectURL(key), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	emptyHash := sha256.Sum256(nil)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(emptyHash[:]))
+	signAWSV4(req, "s3", s.Region, s.AccessKey, s.SecretKey, s.SessionToken, hex.EncodeToString(emptyHash[:]), time.Now())
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("HTTP error: %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return resp.Body, nil
+}
+
+func (s *S3Store) objectURL(key string) string {
+	if s.Endpoint != "" {
+		return fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(s.Endpoint, "/"), s.Bucket, awsURIEncode(key, false))
+	}
+	return fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", s.Bucket, s.Region, awsURIEncode(key, false))
+}
+
+// signAWSV4 adds a Signature Version 4 Authorization header to req.
+func signAWSV4(req *http.Request, service, region, accessKey, secretKey, sessionToken, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	day := amzDate[:8]
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		lower := strings.ToLower(name)
+		if lower == "content-type" || strings.HasPrefix(lower, "x-amz-") {
+			headers[lower] = strings.TrimSpace(strings.Join(values, ","))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	query := req.URL.Query()
+	queryKeys := make([]string, 0, len(query))
+	for k := range query {
+		queryKeys = append(queryKeys, k)
+	}
+	sort.Strings(queryKeys)
+	var canonicalQuery []string
+	for _, k := range queryKeys {
+		for _, v := range query[k] {
+			canonicalQuery = append(canonicalQuery, awsURIEncode(k, true)+"="+awsURIEncode(v, true))
+		}
+	}
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		path,
+		strings.Join(canonicalQuery, "&"),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := day + "/" + region + "/" + service + "/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), day)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsURIEncode percent-encodes everything except unreserved characters, and
+// keeps "/" unless encodeSlash is set, as SigV4 canonical URIs require.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// S3Source reads numbers from an S3 object: .csv and .xlsx objects use their
+// first column, anything else is read as one number per line.
+type S3Source struct {
+	Store *S3Store
+	Key   string
+}
+
+func (src S3Source) Numbers(ctx context.Context) ([]string, error) {
+	body, err := src.Store.Get(ctx, src.Key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return numbersFromReader(src.Key, body)
+}
+
+// newS3Source accepts "bucket/key" or "//bucket/key" and reads credentials
+// from the environment.
+func newS3Source(location string) (Source, error) {
+	bucket, key, ok := strings.Cut(strings.TrimPrefix(location, "//"), "/")
+	if !ok || bucket == "" || key == "" {
+		return nil, fmt.Errorf("invalid S3 location %q: expected bucket/key", location)
+	}
+	store, err := NewS3StoreFromEnv(bucket)
+	if err != nil {
+		return nil, err
+	}
+	return S3Source{Store: store, Key: key}, nil
+}
+
+// DynamoTable records tasks in a DynamoDB table whose partition key is the
+// string attribute "task_id", through the JSON API rather than the AWS SDK.
+type DynamoTable struct {
+	Table        string
+	Region       string
+	Endpoint     string
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+
+	httpClient *http.Client
+}
+
+func NewDynamoTableFromEnv(table string) (*DynamoTable, error) {
+	d := &DynamoTable{
+		Table:        table,
+		Region:       os.Getenv("AWS_REGION"),
+		Endpoint:     os.Getenv("AWS_ENDPOINT_URL_DYNAMODB"),
+		AccessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		SecretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		SessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		httpClient:   &http.Client{Timeout: 30 * time.Second},
+	}
+	if d.Region == "" {
+		d.Region = "us-east-1"
+	}
+	if d.Endpoint == "" {
+		d.Endpoint = fmt.Sprintf("https://dynamodb.%s.amazonaws.com", d.Region)
+	}
+	if d.AccessKey == "" || d.SecretKey == "" {
+		return nil, errors.New("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY must be set")
+	}
+	return d, nil
+}
+
+type dynamoValue struct {
+	S *string `json:"S,omitempty"`
+	N *string `json:"N,omitempty"`
+}
+
+func dynamoString(v string) dynamoValue { return dynamoValue{S: &v} }
+
+func dynamoNumber(v int) dynamoValue {
+	n := strconv.Itoa(v)
+	return dynamoValue{N: &n}
+}
+
+func (d *DynamoTable) PutTask(ctx context.Context, task *WhatsAppResponse) error {
+	item := map[string]dynamoValue{
+		"task_id":    dynamoString(task.TaskID),
+		"user_id":    dynamoString(task.UserID),
+		"status":     dynamoString(string(task.Status)),
+		"total":      dynamoNumber(task.Total),
+		"success":    dynamoNumber(task.Success),
+		"failure":    dynamoNumber(task.Failure),
+		"updated_at": dynamoString(time.Now().UTC().Format(time.RFC3339)),
+	}
+	if task.ResultURL != "" {
+		item["result_url"] = dynamoString(task.ResultURL)
+	}
+	return d.call(ctx, "PutItem", map[string]interface{}{"TableName": d.Table, "Item": item}, nil)
+}
+
+// GetTask returns the stored task, or false when the table has no item for
+// taskID.
+func (d *DynamoTable) GetTask(ctx context.Context, taskID string) (*WhatsAppResponse, bool, error) {
+	var out struct {
+		Item map[string]dynamoValue `json:"Item"`
+	}
+	payload := map[string]interface{}{
+		"TableName":      d.Table,
+		"Key":            map[string]dynamoValue{"task_id": dynamoString(taskID)},
+		"ConsistentRead": true,
+	}
+	if err := d.call(ctx, "GetItem", payload, &out); err != nil {
+		return nil, false, err
+	}
+	if out.Item == nil {
+		return nil, false, nil
+	}
+
+	str := func(name string) string {
+		if v := out.Item[name]; v.S != nil {
+			return *v.S
+		}
+		return ""
+	}
+	num := func(name string) int {
+		if v := out.Item[name]; v.N != nil {
+			n, _ := strconv.Atoi(*v.N)
+			return n
+		}
+		return 0
+	}
+	return &WhatsAppResponse{
+		TaskID:    str("task_id"),
+		UserID:    str("user_id"),
+		Status:    TaskStatus(str("status")),
+		Total:     num("total"),
+		Success:   num("success"),
+		Failure:   num("failure"),
+		ResultURL: str("result_url"),
+	}, true, nil
+}
+
+func (d *DynamoTable) call(ctx context.Context, op string, payload, out interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", strings.TrimSuffix(d.Endpoint, "/")+"/", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.0")
+	req.Header.Set("X-Amz-Target", "DynamoDB_20120810."+op)
+	bodyHash := sha256.Sum256(body)
+	signAWSV4(req, "dynamodb", d.Region, d.AccessKey, d.SecretKey, d.SessionToken, hex.EncodeToString(bodyHash[:]), time.Now())
+
+	resp, err := d.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("%s failed: HTTP %d: %s", op, resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return fmt.Errorf("failed to decode %s response: %v", op, err)
+		}
+	}
+	return nil
+}
+
+// LambdaHandler adapts the checker to AWS Lambda. Submit accepts an S3 event
+// or {"numbers": [...]} and records each created task in Tasks; Complete
+// accepts {"task_id": "..."}, refreshes the stored task and, once exported,
+// copies the result file to Results.
+type LambdaHandler struct {
+	Checker *Checker
+	Tasks   *DynamoTable
+
+	// Inputs supplies credentials for reading S3 event objects; the bucket
+	// is taken from each event record.
+	Inputs *S3Store
+
+	Results   ResultStore
+	ResultKey string
+}
+
+type LambdaFunc func(ctx context.Context, payload json.RawMessage) (interface{}, error)
+
+func (h *LambdaHandler) Submit(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var event struct {
+		Records []struct {
+			S3 struct {
+				Bucket struct {
+					Name string `json:"name"`
+				} `json:"bucket"`
+				Object struct {
+					Key string `json:"key"`
+				} `json:"object"`
+			} `json:"s3"`
+		} `json:"Records"`
+		Numbers []string `json:"numbers"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("invalid event: %v", err)
+	}
+
+	var tasks []*WhatsAppResponse
+	if len(event.Numbers) > 0 {
+		task, err := h.submitNumbers(ctx, event.Numbers)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, task)
+	}
+	for _, record := range event.Records {
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			return tasks, fmt.Errorf("invalid object key %q: %v", record.S3.Object.Key, err)
+		}
+		numbers, err := h.readObject(ctx, record.S3.Bucket.Name, key)
+		if err != nil {
+			return tasks, fmt.Errorf("failed to read s3://%s/%s: %v", record.S3.Bucket.Name, key, err)
+		}
+		task, err := h.submitNumbers(ctx, numbers)
+		if err != nil {
+			return tasks, fmt.Errorf("failed to submit s3://%s/%s: %v", record.S3.Bucket.Name, key, err)
+		}
+		tasks = append(tasks, task)
+	}
+	if len(tasks) == 0 {
+		return nil, errors.New("event contains no numbers or S3 records")
+	}
+	return tasks, nil
+}
+
+func (h *LambdaHandler) readObject(ctx context.Context, bucket, key string) ([]string, error) {
+	if h.Inputs == nil {
+		return nil, errors.New("no S3 credentials configured")
+	}
+	store := *h.Inputs
+	store.Bucket = bucket
+	return S3Source{Store: &store, Key: key}.Numbers(ctx)
+}
+
+func (h *LambdaHandler) submitNumbers(ctx context.Context, numbers []string) (*WhatsAppResponse, error) {
+	file, err := os.CreateTemp(tempDir(), "whatsapp_lambda_*.txt")
+	if err != nil {
+		return nil, err
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	if err := h.Checker.CreateInputFile(numbers, file.Name()); err != nil {
+		return nil, err
+	}
+
+	task, err := h.Checker.UploadFileContext(ctx, file.Name())
+	if err != nil {
+		return nil, err
+	}
+	if err := h.Tasks.PutTask(ctx, task); err != nil {
+		return task, fmt.Errorf("task %s created but not recorded: %v", task.TaskID, err)
+	}
+	return task, nil
+}
+
+// Complete is meant to be invoked on a schedule or from a Step Functions wait
+// loop; it returns the current task so callers can decide whether to retry.
+func (h *LambdaHandler) Complete(ctx context.Context, payload json.RawMessage) (interface{}, error) {
+	var event struct {
+		TaskID string `json:"task_id"`
+		UserID string `json:"user_id"`
+	}
+	if err := json.Unmarshal(payload, &event); err != nil || event.TaskID == "" {
+		return nil, errors.New(`event must be {"task_id": "..."}`)
+	}
+
+	if event.UserID == "" {
+		stored, ok, err := h.Tasks.GetTask(ctx, event.TaskID)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, fmt.Errorf("unknown task %s", event.TaskID)
+		}
+		event.UserID = stored.UserID
+	}
+
+	task, err := h.Checker.CheckTaskStatusContext(ctx, event.TaskID, event.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.Tasks.PutTask(ctx, task); err != nil {
+		return task, err
+	}
+
+	result := map[string]interface{}{"task": task}
+	if task.Status == StatusExported && h.Results != nil {
+		keyTemplate := h.ResultKey
+		if keyTemplate == "" {
+			keyTemplate = "{task_id}.xlsx"
+		}
+		location, err := h.Checker.StoreResults(ctx, task, h.Results, keyTemplate)
+		if err != nil {
+			return result, err
+		}
+		result["results"] = location
+	}
+	return result, nil
+}
+
+// RunLambda serves invocations through the Lambda runtime API, so the
+// example can be deployed as a custom runtime ("provided.al2023") without
+// the aws-lambda-go module. It only returns on runtime API errors.
+func RunLambda(handler LambdaFunc) error {
+	api := "http://" + os.Getenv("AWS_LAMBDA_RUNTIME_API") + "/2018-06-01/runtime/invocation/"
+	client := &http.Client{}
+	for {
+		resp, err := client.Get(api + "next")
+		if err != nil {
+			return fmt.Errorf("failed to fetch invocation: %v", err)
+		}
+		payload, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read invocation: %v", err)
+		}
+
+		requestID := resp.Header.Get("Lambda-Runtime-Aws-Request-Id")
+		ctx, cancel := context.Background(), context.CancelFunc(func() {})
+		if ms, err := strconv.ParseInt(resp.Header.Get("Lambda-Runtime-Deadline-Ms"), 10, 64); err == nil {
+			ctx, cancel = context.WithDeadline(ctx, time.UnixMilli(ms))
+		}
+		out, err := handler(ctx, payload)
+		cancel()
+
+		endpoint, body := api+requestID+"/response", interface{}(out)
+		if err != nil {
+			log.Printf("Invocation %s failed: %v", requestID, err)
+			endpoint, body = api+requestID+"/error", map[string]string{"errorMessage": err.Error(), "errorType": "CheckerError"}
+		}
+		data, err := json.Marshal(body)
+		if err != nil {
+			return fmt.Errorf("failed to encode response: %v", err)
+		}
+		post, err := client.Post(endpoint, "application/json", bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("failed to post response: %v", err)
+		}
+		post.Body.Close()
+	}
+}
+
+// GCSStore uploads result files to Google Cloud Storage, authenticating with
+// Application Default Credentials.
+type GCSStore struct {
+	Bucket string
+	Prefix string
+
+	tokens     *googleTokenSource
+	httpClient *http.Client
+}
+
+// NewGCSStore accepts a destination such as "gs://bucket/prefix".
+func NewGCSStore(destination string) (*GCSStore, error) {
+	if !strings.HasPrefix(destination, "gs://") {
+		return nil, fmt.Errorf("invalid GCS destination: %s", destination)
+	}
+	bucket, prefix, _ := strings.Cut(strings.TrimPrefix(destination, "gs://"), "/")
+	if bucket == "" {
+		return nil, fmt.Errorf("invalid GCS destination: %s", destination)
+	}
+	return &GCSStore{
+		Bucket:     bucket,
+		Prefix:     strings.Trim(prefix, "/"),
+		tokens:     newGoogleTokenSource("https://www.googleapis.com/auth/devstorage.read_write"),
+		httpClient: &http.Client{Timeout: 10 * time.Minute},
+	}, nil
+}
+
+func (g *GCSStore) Put(ctx context.Context, key string, body io.Reader, size int64) (string, error) {
+	name := key
+	if g.Prefix != "" {
+		name = g.Prefix + "/" + key
+	}
+
+	token, err := g.tokens.Token(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	endpoint := fmt.Sprintf("https://storage.googleapis.com/upload/storage/v1/b/%s/o?uploadType=media&name=%s",
+		url.PathEscape(g.Bucket), url.QueryEscape(name))
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, body)
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %v", err)
+	}
+	if size >= 0 {
+		req.ContentLength = size
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	resp, err := g.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "", fmt.Errorf("HTTP error: %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return fmt.Sprintf("gs://%s/%s", g.Bucket, name), nil
+}
+
+// googleTokenSource resolves Application Default Credentials in the usual
+// order: GOOGLE_APPLICATION_CREDENTIALS, the gcloud ADC file, then the GCE
+// metadata server. Tokens are cached until shortly before they expire.
+type googleTokenSource struct {
+	scope string
+
+	mu     sync.Mutex
+	token  string
+	expiry time.Time
+}
+
+func newGoogleTokenSource(scope string) *googleTokenSource {
+	return &googleTokenSource{scope: scope}
+}
+
+func (ts *googleTokenSource) Token(ctx context.Context) (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.token != "" && time.Until(ts.expiry) > time.Minute {
+		return ts.token, nil
+	}
+
+	token, expiresIn, err := ts.fetch(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to obtain Google credentials: %v", err)
+	}
+	ts.token = token
+	ts.expiry = time.Now().Add(time.Duration(expiresIn) * time.Second)
+	return ts.token, nil
+}
+
+func (ts *googleTokenSource) fetch(ctx context.Context) (string, int, error) {
+	path := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS")
+	if path == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = filepath.Join(home, ".config", "gcloud", "application_default_credentials.json")
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ts.fetchMetadata(ctx)
+	}
+
+	var creds struct {
+		Type         string `json:"type"`
+		ClientEmail  string `json:"client_email"`
+		PrivateKey   string `json:"private_key"`
+		TokenURI     string `json:"token_uri"`
+		ClientID     string `json:"client_id"`
+		ClientSecret string `json:"client_secret"`
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return "", 0, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+	if creds.TokenURI == "" {
+		creds.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	form := url.Values{}
+	switch creds.Type {
+	case "service_account":
+		assertion, err := signGoogleJWT(creds.ClientEmail, creds.PrivateKey, ts.scope, creds.TokenURI)
+		if err != nil {
+			return "", 0, err
+		}
+		form.Set("grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer")
+		form.Set("assertion", assertion)
+	case "authorized_user":
+		form.Set("grant_type", "refresh_token")
+		form.Set("client_id", creds.ClientID)
+		form.Set("client_secret", creds.ClientSecret)
+		form.Set("refresh_token", creds.RefreshToken)
+	default:
+		return "", 0, fmt.Errorf("unsupported credentials type: %q", creds.Type)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", creds.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return doTokenRequest(req)
+}
+
+func (ts *googleTokenSource) fetchMetadata(ctx context.Context) (string, int, error) {
+	endpoint := "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token?scopes=" +
+		url.QueryEscape(ts.scope)
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return "", 0, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return doTokenRequest(req)
+}
+
+func doTokenRequest(req *http.Request) (string, int, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", 0, fmt.Errorf("token request failed: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, fmt.Errorf("token request HTTP error: %d", resp.StatusCode)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", 0, fmt.Errorf("failed to decode token: %v", err)
+	}
+	return token.AccessToken, token.ExpiresIn, nil
+}
+
+func signGoogleJWT(email, privateKeyPEM, scope, audience string) (string, error) {
+	block, _ := pem.Decode([]byte(privateKeyPEM))
+	if block == nil {
+		return "", errors.New("invalid service account private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("failed to parse private key: %v", err)
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("service account key is not RSA")
+	}
+
+	now := time.Now()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	claims, _ := json.Marshal(map[string]interface{}{
+		"iss":   email,
+		"scope": scope,
+		"aud":   audience,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %v", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
+
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60, 120}
+
+type LatencyHistogram struct {
+	mu     sync.Mutex
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{counts: make([]uint64, len(latencyBuckets)+1)}
+}
+
+func (h *LatencyHistogram) Observe(d time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets, seconds)
+	h.counts[i]++
+	h.count++
+	h.sum += seconds
+}
+
+// Quantile estimates the q-th quantile as the upper bound of the bucket it
+// falls in. It returns zero until at least one observation exists.
+func (h *LatencyHistogram) Quantile(q float64) time.Duration {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.count == 0 {
+		return 0
+	}
+
+	target := uint64(math.Ceil(q * float64(h.count)))
+	var cumulative uint64
+	for i, c := range h.counts {
+		cumulative += c
+		if cumulative >= target {
+			if i == len(latencyBuckets) {
+				return time.Duration(latencyBuckets[i-1] * 2 * float64(time.Second))
+			}
+			return time.Duration(latencyBuckets[i] * float64(time.Second))
+		}
+	}
+	return 0
+}
+
+type Metrics struct {
+	mu         sync.Mutex
+	histograms map[string]*LatencyHistogram
+	gauges     map[string]float64
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		histograms: make(map[string]*LatencyHistogram),
+		gauges:     make(map[string]float64),
+	}
+}
+
+func (m *Metrics) SetGauge(name string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.gauges[name] = value
+}
+
+func (m *Metrics) Histogram(op string) *LatencyHistogram {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	h, ok := m.histograms[op]
+	if !ok {
+		h = newLatencyHistogram()
+		m.histograms[op] = h
+	}
+	return h
+}
+
+func (m *Metrics) Observe(op string, d time.Duration) {
+	m.Histogram(op).Observe(d)
+}
+
+// WriteText writes the histograms in the Prometheus text exposition format.
+func (m *Metrics) WriteText(w io.Writer) error {
+	m.mu.Lock()
+	ops := make([]string, 0, len(m.histograms))
+	for op := range m.histograms {
+		ops = append(ops, op)
+	}
+	gauges := make(map[string]float64, len(m.gauges))
+	for name, value := range m.gauges {
+		gauges[name] = value
+	}
+	m.mu.Unlock()
+	sort.Strings(ops)
+
+	var b strings.Builder
+	for _, name := range sortedKeys(gauges) {
+		fmt.Fprintf(&b, "# TYPE %s gauge\n%s %g\n", name, name, gauges[name])
+	}
+	b.WriteString("# HELP wachecker_request_duration_seconds Latency of provider API requests.\n")
+	b.WriteString("# TYPE wachecker_request_duration_seconds histogram\n")
+	for _, op := range ops {
+		h := m.Histogram(op)
+		h.mu.Lock()
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(&b, "wachecker_request_duration_seconds_bucket{op=%q,le=\"%g\"} %d\n", op, bound, cumulative)
+		}
+		fmt.Fprintf(&b, "wachecker_request_duration_seconds_bucket{op=%q,le=\"+Inf\"} %d\n", op, h.count)
+		fmt.Fprintf(&b, "wachecker_request_duration_seconds_sum{op=%q} %g\n", op, h.sum)
+		fmt.Fprintf(&b, "wachecker_request_duration_seconds_count{op=%q} %d\n", op, h.count)
+		h.mu.Unlock()
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func (m *Metrics) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if err := m.WriteText(w); err != nil {
+			log.Printf("Failed to write metrics: %v", err)
+		}
+	})
+}
+
+var ErrSequentialInput = errors.New("input contains sequential number ranges")
+
+type SequentialRun struct {
+	First string
+	Last  string
+	Count int
+}
+
+func (r SequentialRun) String() string {
+	return fmt.Sprintf("%s-%s (%d numbers)", r.First, r.Last, r.Count)
+}
+
+// DetectSequentialRuns reports runs of at least minRun numerically
+// consecutive numbers, regardless of the order they appear in the input.
+func DetectSequentialRuns(phoneNumbers []string, minRun int) []SequentialRun {
+	type entry struct {
+		value int64
+		raw   string
+	}
+
+	var entries []entry
+	for _, number := range phoneNumbers {
+		digits := digitsOnly(number)
+		if len(digits) < 7 || len(digits) > 18 {
+			continue
+		}
+		value, err := strconv.ParseInt(digits, 10, 64)
+		if err != nil {
+			continue
+		}
+		entries = append(entries, entry{value: value, raw: strings.TrimSpace(number)})
+	}
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].value < entries[j].value })
+
+	// Drop repeats up front so a duplicate cannot hide the end of a run.
+	unique := entries[:0]
+	for _, e := range entries {
+		if len(unique) == 0 || unique[len(unique)-1].value != e.value {
+			unique = append(unique, e)
+		}
+	}
+	entries = unique
+
+	var runs []SequentialRun
+	start, count := 0, 0
+	for i := range entries {
+		if i > 0 && entries[i].value == entries[i-1].value+1 {
+			count++
+		} else {
+			start, count = i, 1
+		}
+
+		last := i == len(entries)-1 || entries[i+1].value > entries[i].value+1
+		if last && count >= minRun {
+			runs = append(runs, SequentialRun{First: entries[start].raw, Last: entries[i].raw, Count: count})
+		}
+	}
+	return runs
+}
+
+func (wc *Checker) checkSequential(phoneNumbers []string) error {
+	if wc.allowSequential || wc.maxSequentialRun <= 0 {
+		return nil
+	}
+
+	runs := DetectSequentialRuns(phoneNumbers, wc.maxSequentialRun)
+	if len(runs) == 0 {
+		return nil
+	}
+
+	ranges := make([]string, len(runs))
+	for i, run := range runs {
+		ranges[i] = run.String()
+	}
+	return fmt.Errorf("%w: %s (use WithSequentialOverride to upload anyway)", ErrSequentialInput, strings.Join(ranges, ", "))
+}
+
+func digitsOnly(s string) string {
+	var b strings.Builder
+	for _, ch := range s {
+		if ch >= '0' && ch <= '9' {
+			b.WriteRune(ch)
+		}
+	}
+	return b.String()
+}
+
+var ErrResultURLExpired = errors.New("result URL expired")
+
+// openResult downloads a result file. Result URLs are signed and expire; when
+// the download is refused with 403 or 410, the task is re-fetched (task, or
+// the task store entry for resultURL) and the download retried once with the
+// fresh URL. The caller closes the body of the returned 200 response.
+func (wc *Checker) openResult(ctx context.Context, resultURL string, task *WhatsAppResponse) (*http.Response, error) {
+	get := func(url string) (*http.Response, error) {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create request: %v", err)
+		}
+		start := time.Now()
+		resp, err := wc.downloadClient.Do(req)
+		wc.audit.Record("download", req, resp, err, start)
+		if err != nil {
+			return nil, fmt.Errorf("failed to download results: %v", err)
+		}
+		return resp, nil
+	}
+
+	resp, err := get(resultURL)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusGone {
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			return nil, fmt.Errorf("HTTP error: %d", resp.StatusCode)
+		}
+		return resp, nil
+	}
+	resp.Body.Close()
+
+	taskID, userID := "", ""
+	if task != nil {
+		taskID, userID = task.TaskID, task.UserID
+	} else if wc.taskStore != nil {
+		if rec, ok := wc.taskStore.FindByResultURL(resultURL); ok {
+			taskID, userID = rec.TaskID, rec.UserID
+		}
+	}
+	if taskID == "" {
+		return nil, fmt.Errorf("%w (HTTP %d) and the task is unknown, so it cannot be refreshed", ErrResultURLExpired, resp.StatusCode)
+	}
+
+	status, err := wc.CheckTaskStatusContext(ctx, taskID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("%w, refreshing task %s failed: %w", ErrResultURLExpired, taskID, err)
+	}
+	if status.ResultURL == "" || status.ResultURL == resultURL {
+		return nil, fmt.Errorf("%w, task %s returned no new URL", ErrResultURLExpired, taskID)
+	}
+	if task != nil {
+		task.ResultURL = status.ResultURL
+	}
+	log.Printf("Result URL for task %s expired, retrying with a refreshed URL", taskID)
+	wc.recordEvent(taskID, "refreshed", "result URL expired, fetched a new one")
+
+	if resp, err = get(status.ResultURL); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("HTTP error: %d", resp.StatusCode)
+	}
+	return resp, nil
+}
+
+func (wc *Checker) DownloadResults(resultURL, outputPath string) error {
+	if wc.piiSalt != nil {
+		// The provider's file holds raw numbers, so it is rewritten hashed.
+		results, err := wc.fetchResults(context.Background(), resultURL, -1)
+		if err != nil {
+			return err
+		}
+		if err := wc.exportHashed(results, outputPath); err != nil {
+			return err
+		}
+		if rec, ok := wc.taskForResultURL(resultURL); ok {
+			wc.recordEvent(rec.TaskID, "delivered", outputPath)
+		}
+		return nil
+	}
+
+	resp, err := wc.openResult(context.Background(), resultURL, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	// Download next to the destination and rename once complete, so a crash
+	// never leaves a truncated file under the final name.
+	dir := filepath.Dir(outputPath)
+	if free, ok := freeDiskSpace(dir); ok && resp.ContentLength > 0 && free < resp.ContentLength {
+		return fmt.Errorf("not enough disk space in %s: need %d bytes, %d available", dir, resp.ContentLength, free)
+	}
+	key, err := wc.encryptionKey(context.Background())
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(outputPath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create output file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	var out io.Writer = tmp
+	var ew io.WriteCloser
+	if key != nil {
+		if ew, err = NewEncryptWriter(tmp, key); err != nil {
+			tmp.Close()
+			return err
+		}
+		out = ew
+	}
+	n, err := io.Copy(out, resp.Body)
+	if err == nil && resp.ContentLength > 0 && n != resp.ContentLength {
+		err = fmt.Errorf("got %d of %d bytes", n, resp.ContentLength)
+	}
+	if err == nil && ew != nil {
+		err = ew.Close()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write to file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), outputPath); err != nil {
+		return fmt.Errorf("failed to replace output: %v", err)
+	}
+
+	if rec, ok := wc.taskForResultURL(resultURL); ok {
+		wc.recordEvent(rec.TaskID, "delivered", outputPath)
+	}
+	return nil
+}
+
+// PurgeSummary lists what Purge removed, or would remove in dry-run mode.
+type PurgeSummary struct {
+	Tasks   []string `json:"tasks"`
+	Results []string `json:"results"`
+	Temp    []string `json:"temp"`
+	Bytes   int64    `json:"bytes"`
+	Errors  []string `json:"errors,omitempty"`
+}
+
+// Purge enforces a retention window on local data: task store records not
+// updated within olderThan, the result files they were delivered to, and
+// temporary input files left in tempDir by interrupted runs. A record whose
+// result file is still recent is kept along with the file. Results
+// delivered to remote stores are not touched. With WithDryRun nothing is
+// deleted.
+func (wc *Checker) Purge(olderThan time.Duration) (*PurgeSummary, error) {
+	if olderThan <= 0 {
+		return nil, fmt.Errorf("invalid retention: %s", olderThan)
+	}
+	cutoff := time.Now().Add(-olderThan)
+	summary := &PurgeSummary{}
+
+	remove := func(path string) bool {
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() || !info.ModTime().Before(cutoff) {
+			return false
+		}
+		if !wc.dryRun {
+			if err := os.Remove(path); err != nil {
+				summary.Errors = append(summary.Errors, err.Error())
+				return false
+			}
+		}
+		summary.Bytes += info.Size()
+		return true
+	}
+
+	if wc.taskStore != nil {
+		for _, rec := range wc.taskStore.List() {
+			if !rec.UpdatedAt.Before(cutoff) {
+				continue
+			}
+			var files []string
+			recent := false
+			for _, ev := range rec.Events {
+				if ev.Kind != "delivered" || strings.Contains(ev.Detail, "://") {
+					continue
+				}
+				if info, err := os.Stat(ev.Detail); err == nil {
+					files = append(files, ev.Detail)
+					recent = recent || !info.ModTime().Before(cutoff)
+				}
+			}
+			if recent {
+				continue
+			}
+			removedAll := true
+			for _, path := range files {
+				if remove(path) {
+					summary.Results = append(summary.Results, path)
+				} else {
+					removedAll = false
+				}
+			}
+			if removedAll {
+				summary.Tasks = append(summary.Tasks, rec.TaskID)
+			}
+		}
+		if !wc.dryRun && len(summary.Tasks) > 0 {
+			if err := wc.taskStore.Delete(summary.Tasks...); err != nil {
+				return summary, err
+			}
+		}
+	}
+
+	temps, _ := filepath.Glob(filepath.Join(os.TempDir(), tempDirName, "whatsapp_*"))
+	for _, path := range temps {
+		if remove(path) {
+			summary.Temp = append(summary.Temp, path)
+		}
+	}
+	return summary, nil
+}
+
+// tempDirName is the checker's own directory under the system temp
+// directory, so Purge never removes other programs' files.
+const tempDirName = "wachecker"
+
+func tempDir() string {
+	dir := filepath.Join(os.TempDir(), tempDirName)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		log.Printf("Failed to create %s, using %s: %v", dir, os.TempDir(), err)
+		return os.TempDir()
+	}
+	return dir
+}
+
+func (s *PurgeSummary) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Task records:\t%d\n", len(s.Tasks))
+	fmt.Fprintf(tw, "Result files:\t%d\n", len(s.Results))
+	fmt.Fprintf(tw, "Temp files:\t%d\n", len(s.Temp))
+	fmt.Fprintf(tw, "Bytes freed:\t%d\n", s.Bytes)
+	for _, path := range s.Results {
+		fmt.Fprintf(tw, "\t%s\n", path)
+	}
+	for _, err := range s.Errors {
+		fmt.Fprintf(tw, "Error:\t%s\n", err)
+	}
+	return tw.Flush()
+}
+
+// resultsExt is the extension for downloaded results: the provider's .xlsx,
+// or .csv when numbers have to be hashed.
+func (wc *Checker) resultsExt() string {
+	if wc.piiSalt != nil {
+		return ".csv"
+	}
+	return ".xlsx"
+}
+
+func (wc *Checker) taskForResultURL(resultURL string) (TaskRecord, bool) {
+	if wc.taskStore == nil {
+		return TaskRecord{}, false
+	}
+	return wc.taskStore.FindByResultURL(resultURL)
+}
+
+// exportHashed writes results with PII hashing; the provider's .xlsx
+// layout cannot be reproduced, so other formats must be used.
+func (wc *Checker) exportHashed(results Results, path string) error {
+	if format, _ := exportFormatFromPath(path); format == "xlsx" {
+		return fmt.Errorf("PII hashing is enabled, write %s as .csv, .json or .ndjson instead of .xlsx", path)
+	}
+	return wc.ExportResultsFile(results, path)
+}
+
+// freeDiskSpace returns the bytes available in dir using df, which keeps the
+// example free of per-OS syscalls. ok is false when it cannot tell.
+func freeDiskSpace(dir string) (free int64, ok bool) {
+	if runtime.GOOS == "windows" {
+		return 0, false
+	}
+	out, err := exec.Command("df", "-Pk", dir).Output()
+	if err != nil {
+		return 0, false
+	}
+	lines := strings.Split(strings.TrimSpace(string(out)), "\n")
+	fields := strings.Fields(lines[len(lines)-1])
+	if len(fields) < 4 {
+		return 0, false
+	}
+	kb, err := strconv.ParseInt(fields[3], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return kb * 1024, true
+}
+
+// DownloadTask re-fetches the task status to obtain a current result URL and
+// downloads it, so results can be recovered after the process that started
+// the task is gone. The user ID comes from the task store when empty.
+func (wc *Checker) DownloadTask(ctx context.Context, taskID, userID, outputPath string) (*WhatsAppResponse, error) {
+	status, err := wc.CheckTaskStatusContext(ctx, taskID, wc.userIDFor(taskID, userID))
+	if err != nil {
+		return nil, err
+	}
+	if status.Status != StatusExported || status.ResultURL == "" {
+		return status, fmt.Errorf("results not available, task status: %s", status.Status)
+	}
+
+	if err := wc.DownloadResults(status.ResultURL, outputPath); err != nil {
+		return status, err
+	}
+	return status, nil
+}
+
+// Unfinished reports whether the task is still running, or has results
+// that were never downloaded or fetched.
+func (rec TaskRecord) Unfinished() bool {
+	if rec.Status == StatusFailed {
+		return false
+	}
+	for _, ev := range rec.Events {
+		if ev.Kind == "delivered" {
+			return false
+		}
+	}
+	return true
+}
+
+// maxResumePolls bounds how many tasks ResumeAll polls at once, so a long
+// task history does not open a connection per task.
+const maxResumePolls = 8
+
+type ResumedTask struct {
+	Record TaskRecord
+	Status *WhatsAppResponse
+	Err    error
+}
+
+// ResumeAll picks up every unfinished task in the task store, for example
+// after a crash or reboot, and polls them concurrently until they finish.
+// Per-task failures are reported in the returned tasks.
+func (wc *Checker) ResumeAll(ctx context.Context, interval time.Duration) ([]ResumedTask, error) {
+	if wc.taskStore == nil {
+		return nil, errors.New("task store not configured")
+	}
+
+	var resumed []ResumedTask
+	for _, rec := range wc.taskStore.List() {
+		if rec.Unfinished() {
+			resumed = append(resumed, ResumedTask{Record: rec})
+		}
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, maxResumePolls)
+	for i := range resumed {
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(task *ResumedTask) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			wc.recordEvent(task.Record.TaskID, "resumed", "")
+			task.Status, task.Err = wc.PollTaskStatusContext(ctx, task.Record.TaskID, task.Record.UserID, interval)
+		}(&resumed[i])
+	}
+	wg.Wait()
+	return resumed, nil
+}
+
+type TaskReport struct {
+	Record    TaskRecord
+	Parent    *TaskRecord
+	Children  []TaskRecord
+	Events    []TaskEvent
+	Current   *WhatsAppResponse
+	StatusErr error
+}
+
+// ExplainTask gathers everything known about a task, locally and from the
+// provider, into a single report with events in chronological order.
+func (wc *Checker) ExplainTask(taskID, userID string) (*TaskReport, error) {
+	if wc.taskStore == nil {
+		return nil, errors.New("task store not configured")
+	}
+
+	report := &TaskReport{}
+	_, known := wc.taskStore.Get(taskID)
+	report.Current, report.StatusErr = wc.CheckTaskStatus(taskID, wc.userIDFor(taskID, userID))
+	if !known && report.StatusErr != nil {
+		return nil, fmt.Errorf("unknown task %s: %v", taskID, report.StatusErr)
+	}
+
+	report.Record, _ = wc.taskStore.Get(taskID)
+	if !known {
+		report.Record.TaskID = taskID
+	}
+	report.Events = append(report.Events, report.Record.Events...)
+
+	if report.Record.ParentID != "" {
+		if parent, ok := wc.taskStore.Get(report.Record.ParentID); ok {
+			report.Parent = &parent
+		}
+	}
+	report.Children = wc.taskStore.Children(taskID)
+
+	sort.SliceStable(report.Events, func(i, j int) bool {
+		return report.Events[i].Time.Before(report.Events[j].Time)
+	})
+	return report, nil
+}
+
+func (r *TaskReport) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Task:\t%s\n", r.Record.TaskID)
+	if r.Record.Name != "" {
+		fmt.Fprintf(tw, "Name:\t%s\n", r.Record.Name)
+	}
+	if len(r.Record.Labels) > 0 {
+		fmt.Fprintf(tw, "Labels:\t%s\n", formatLabels(r.Record.Labels))
+	}
+	fmt.Fprintf(tw, "User:\t%s\n", r.Record.UserID)
+	fmt.Fprintf(tw, "Created:\t%s\n", r.Record.CreatedAt.Format(time.RFC3339))
+	if r.Record.InputHash != "" {
+		fmt.Fprintf(tw, "Input hash:\t%s\n", r.Record.InputHash)
+	}
+	if r.Parent != nil {
+		fmt.Fprintf(tw, "Parent:\t%s (%s)\n", r.Parent.TaskID, r.Parent.Status)
+	}
+	for _, child := range r.Children {
+		fmt.Fprintf(tw, "Child:\t%s (%s)\n", child.TaskID, child.Status)
+	}
+	if r.StatusErr != nil {
+		fmt.Fprintf(tw, "Provider status:\tunavailable: %v\n", r.StatusErr)
+	} else {
+		fmt.Fprintf(tw, "Provider status:\t%s, success %d, failure %d, total %d, runtime %s\n",
+			r.Current.Status, r.Current.Success, r.Current.Failure, r.Current.Total, r.Current.Duration())
+		if r.Current.ResultURL != "" {
+			fmt.Fprintf(tw, "Result URL:\t%s\n", r.Current.ResultURL)
+		}
+	}
+
+	fmt.Fprintln(tw, "\nTIME\tEVENT\tDETAIL")
+	for _, e := range r.Events {
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", e.Time.Format(time.RFC3339), e.Kind, e.Detail)
+	}
+	return tw.Flush()
+}
+
+// Source supplies numbers to check and Sink receives checked results. New
+// kinds are added with RegisterSource/RegisterSink, or without recompiling as
+// "wachecker-source-<scheme>" / "wachecker-sink-<scheme>" programs on PATH
+// that speak the NDJSON protocol described on ExecSource and ExecSink.
+type Source interface {
+	Numbers(ctx context.Context) ([]string, error)
+}
+
+type Sink interface {
+	WriteResults(ctx context.Context, taskID string, results Results) error
+}
+
+type SourceFactory func(location string) (Source, error)
+
+type SinkFactory func(location string) (Sink, error)
+
+var (
+	pluginsMu sync.RWMutex
+	sources   = map[string]SourceFactory{
+		"csv":  func(location string) (Source, error) { return fileSource{location, LoadNumbersFromCSV}, nil },
+		"xlsx": func(location string) (Source, error) { return fileSource{location, xlsxFirstSheet}, nil },
+		"s3":   newS3Source,
+	}
+	sinks = map[string]SinkFactory{
+		"file":   func(location string) (Sink, error) { return fileSink{path: location}, nil },
+		"sheets": newSheetsSink,
+	}
+)
+
+func RegisterSource(scheme string, factory SourceFactory) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	sources[scheme] = factory
+}
+
+func RegisterSink(scheme string, factory SinkFactory) {
+	pluginsMu.Lock()
+	defer pluginsMu.Unlock()
+	sinks[scheme] = factory
+}
+
+// OpenSource resolves a spec such as "csv:numbers.csv#phone" or
+// "crm:segment-42", falling back to a wachecker-source-<scheme> program.
+func OpenSource(spec string) (Source, error) {
+	scheme, location, err := splitPluginSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	pluginsMu.RLock()
+	factory, ok := sources[scheme]
+	pluginsMu.RUnlock()
+	if ok {
+		return factory(location)
+	}
+	path, err := exec.LookPath("wachecker-source-" + scheme)
+	if err != nil {
+		return nil, fmt.Errorf("source %q is not registered", scheme)
+	}
+	return &ExecSource{Path: path, Args: []string{location}}, nil
+}
+
+func OpenSink(spec string) (Sink, error) {
+	scheme, location, err := splitPluginSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	pluginsMu.RLock()
+	factory, ok := sinks[scheme]
+	pluginsMu.RUnlock()
+	if ok {
+		return factory(location)
+	}
+	path, err := exec.LookPath("wachecker-sink-" + scheme)
+	if err != nil {
+		return nil, fmt.Errorf("sink %q is not registered", scheme)
+	}
+	return &ExecSink{Path: path, Args: []string{location}}, nil
+}
+
+func splitPluginSpec(spec string) (string, string, error) {
+	scheme, location, ok := strings.Cut(spec, ":")
+	if !ok || scheme == "" {
+		return "", "", fmt.Errorf("invalid spec %q: expected scheme:location", spec)
+	}
+	return scheme, location, nil
+}
+
+type fileSource struct {
+	location string
+	load     func(path, column string) ([]string, error)
+}
+
+// Numbers reads "path#column"; the column defaults to the first one.
+func (f fileSource) Numbers(ctx context.Context) ([]string, error) {
+	path, column, ok := strings.Cut(f.location, "#")
+	if !ok {
+		column = "1"
+	}
+	return f.load(path, column)
+}
+
+func xlsxFirstSheet(path, column string) ([]string, error) {
+	return LoadNumbersFromXLSX(path, "", column)
+}
+
+// fileSink exports each task's results to a file, choosing the format from
+// the extension. A "{task_id}" placeholder keeps tasks from overwriting
+// each other. Once bound to a Checker with bindSink the file is written with
+// ExportResultsFile, so numbers are hashed and the file encrypted as
+// configured.
+type fileSink struct {
+	path    string
+	checker *Checker
+}
+
+func (f fileSink) WriteResults(ctx context.Context, taskID string, results Results) error {
+	path := strings.ReplaceAll(f.path, "{task_id}", taskID)
+	if f.checker != nil {
+		return f.checker.ExportResultsFile(results, path)
+	}
+	return results.ExportFile(path)
+}
+
+// bindSink attaches the checker to sinks that write local files.
+func (wc *Checker) bindSink(sink Sink) Sink {
+	if f, ok := sink.(fileSink); ok {
+		f.checker = wc
+		return f
+	}
+	return sink
+}
+
+type pluginRecord struct {
+	TaskID   string `json:"task_id,omitempty"`
+	Number   string `json:"number"`
+	WhatsApp string `json:"whatsapp,omitempty"`
+}
+
+// ExecSource runs an external program that prints one JSON object per line,
+// {"number": "+31612345678"}, and exits 0 when done.
+type ExecSource struct {
+	Path string
+	Args []string
+}
+
+func (e *ExecSource) Numbers(ctx context.Context) ([]string, error) {
+	cmd := exec.CommandContext(ctx, e.Path, e.Args...)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("failed to start source %s: %v", e.Path, err)
+	}
+
+	var numbers []string
+	scanner := bufio.NewScanner(stdout)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var rec pluginRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil, fmt.Errorf("source %s line %d: %v", e.Path, line, err)
+		}
+		numbers = append(numbers, rec.Number)
+	}
+	if err := scanner.Err(); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, fmt.Errorf("failed to read source %s: %v", e.Path, err)
+	}
+	if err := cmd.Wait(); err != nil {
+		return nil, fmt.Errorf("source %s failed: %v", e.Path, err)
+	}
+	return numbers, nil
+}
+
+// ExecSink runs an external program per batch of results, writing one JSON
+// object per line to its stdin:
+// {"task_id": "...", "number": "+31612345678", "whatsapp": "yes"}.
+// A non-zero exit status fails the write.
+type ExecSink struct {
+	Path string
+	Args []string
+}
+
+func (e *ExecSink) WriteResults(ctx context.Context, taskID string, results Results) error {
+	var input bytes.Buffer
+	enc := json.NewEncoder(&input)
+	for _, r := range results {
+		if err := enc.Encode(pluginRecord{TaskID: taskID, Number: r.Number, WhatsApp: r.WhatsApp}); err != nil {
+			return err
+		}
+	}
+
+	cmd := exec.CommandContext(ctx, e.Path, e.Args...)
+	cmd.Stdin = &input
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("sink %s failed: %v", e.Path, err)
+	}
+	return nil
+}
+
+// ResultSink receives parsed results one at a time, as configured with
+// WithResultSinks. Flush is called after each complete result set, so sinks
+// that batch can write out what they hold.
+type ResultSink interface {
+	Write(ctx context.Context, r NumberResult) error
+	Flush(ctx context.Context) error
+}
+
+// BufferedSink adapts a batch writer to ResultSink. Results are collected
+// and passed to FlushFunc on Flush, or every BatchSize results when set.
+// Results FlushFunc fails on stay pending for the next flush.
+type BufferedSink struct {
+	BatchSize int
+	FlushFunc func(ctx context.Context, results Results) error
+
+	mu      sync.Mutex
+	pending Results
+}
+
+func (b *BufferedSink) Write(ctx context.Context, r NumberResult) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.pending = append(b.pending, r)
+	if b.BatchSize > 0 && len(b.pending) >= b.BatchSize {
+		return b.flush(ctx)
+	}
+	return nil
+}
+
+func (b *BufferedSink) Flush(ctx context.Context) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.flush(ctx)
+}
+
+func (b *BufferedSink) flush(ctx context.Context) error {
+	if len(b.pending) == 0 {
+		return nil
+	}
+	if err := b.FlushFunc(ctx, b.pending); err != nil {
+		return err
+	}
+	b.pending = nil
+	return nil
+}
+
+// SinkResults writes to a Sink from OpenSink, such as "file:out.csv" or an
+// exec plugin, as a ResultSink. Each flush is one WriteResults call for
+// taskID.
+func SinkResults(sink Sink, taskID string) *BufferedSink {
+	return &BufferedSink{FlushFunc: func(ctx context.Context, results Results) error {
+		return sink.WriteResults(ctx, taskID, results)
+	}}
+}
+
+// WebhookResultSink posts results to url as {"results": [...]}, at most
+// batchSize per request when batchSize is positive.
+func WebhookResultSink(url string, batchSize int) *BufferedSink {
+	return &BufferedSink{BatchSize: batchSize, FlushFunc: func(ctx context.Context, results Results) error {
+		return postJSONContext(ctx, url, map[string]Results{"results": results})
+	}}
+}
+
+// writeResultSinks hands each result to every configured sink in a single
+// pass over results, then flushes them. A sink that fails is skipped for the
+// rest of the pass without holding up the others. With PII hashing sinks
+// only see hashed numbers.
+func (wc *Checker) writeResultSinks(ctx context.Context, results Results) error {
+	if len(wc.resultSinks) == 0 {
+		return nil
+	}
+	results = wc.redactResults(results)
+	errs := make([]error, len(wc.resultSinks))
+	for _, r := range results {
+		for i, sink := range wc.resultSinks {
+			if errs[i] == nil {
+				errs[i] = sink.Write(ctx, r)
+			}
+		}
+	}
+	for i, sink := range wc.resultSinks {
+		if errs[i] == nil {
+			errs[i] = sink.Flush(ctx)
+		}
+		if errs[i] != nil {
+			errs[i] = fmt.Errorf("result sink %d: %w", i+1, errs[i])
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Cassette is an http.RoundTripper that records API exchanges to a JSON
+// fixture file and replays them, so regression tests can run against real
+// payloads without credentials. Recorded fixtures never contain the API key
+// or bearer tokens, and query parameters named in Redact are masked.
+//
+// In CassetteReplay mode requests are matched by method and masked URL, in
+// recording order; an unmatched request fails instead of going to the network.
+type Cassette struct {
+	Path      string
+	Mode      string
+	Redact    []string
+	Transport http.RoundTripper
+
+	mu           sync.Mutex
+	interactions []CassetteInteraction
+	next         map[string]int
+}
+
+const (
+	CassetteRecord = "record"
+	CassetteReplay = "replay"
+)
+
+type CassetteInteraction struct {
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header"`
+	Body     string      `json:"body"`
+	Encoding string      `json:"encoding,omitempty"`
+}
+
+var cassetteSecretHeaders = []string{"X-Api-Key", "Authorization", "Set-Cookie", "Cookie", "X-Vault-Token"}
+
+// OpenCassette loads path in replay mode, or starts an empty recording when
+// mode is CassetteRecord.
+func OpenCassette(path, mode string) (*Cassette, error) {
+	c := &Cassette{Path: path, Mode: mode, Redact: []string{"user_id"}, next: make(map[string]int)}
+	switch mode {
+	case CassetteRecord:
+		return c, nil
+	case CassetteReplay:
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read cassette: %v", err)
+		}
+		if err := json.Unmarshal(data, &c.interactions); err != nil {
+			return nil, fmt.Errorf("failed to parse cassette: %v", err)
+		}
+		return c, nil
+	}
+	return nil, fmt.Errorf("unknown cassette mode %q", mode)
+}
+
+func (c *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	masked := c.maskURL(req.URL)
+	if c.Mode == CassetteReplay {
+		return c.replay(req, masked)
+	}
+
+	transport := c.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(body))
+
+	header := resp.Header.Clone()
+	for _, name := range cassetteSecretHeaders {
+		header.Del(name)
+	}
+	interaction := CassetteInteraction{Method: req.Method, URL: masked, Status: resp.StatusCode, Header: header, Body: string(body)}
+	if !utf8.Valid(body) {
+		interaction.Body, interaction.Encoding = base64.StdEncoding.EncodeToString(body), "base64"
+	}
+	c.mu.Lock()
+	c.interactions = append(c.interactions, interaction)
+	c.mu.Unlock()
+	return resp, nil
+}
+
+func (c *Cassette) replay(req *http.Request, masked string) (*http.Response, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := req.Method + " " + masked
+	seen := 0
+	for _, in := range c.interactions {
+		if in.Method != req.Method || in.URL != masked {
+			continue
+		}
+		if seen++; seen <= c.next[key] {
+			continue
+		}
+		c.next[key]++
+		body := []byte(in.Body)
+		if in.Encoding == "base64" {
+			var err error
+			if body, err = base64.StdEncoding.DecodeString(in.Body); err != nil {
+				return nil, fmt.Errorf("corrupt cassette body for %s: %v", key, err)
+			}
+		}
+		return &http.Response{
+			Status:        fmt.Sprintf("%d %s", in.Status, http.StatusText(in.Status)),
+			StatusCode:    in.Status,
+			Proto:         "HTTP/1.1",
+			ProtoMajor:    1,
+			ProtoMinor:    1,
+			Header:        in.Header.Clone(),
+			Body:          io.NopCloser(bytes.NewReader(body)),
+			ContentLength: int64(len(body)),
+			Request:       req,
+		}, nil
+	}
+	return nil, fmt.Errorf("cassette %s has no recorded response for %s", c.Path, key)
+}
+
+func (c *Cassette) maskURL(u *url.URL) string {
+	masked := *u
+	query := masked.Query()
+	for _, name := range c.Redact {
+		if query.Has(name) {
+			query.Set(name, "REDACTED")
+		}
+	}
+	masked.RawQuery = query.Encode()
+	return masked.String()
+}
+
+// Save writes the recorded interactions to Path. It is a no-op in replay
+// mode.
+func (c *Cassette) Save() error {
+	if c.Mode != CassetteRecord {
+		return nil
+	}
+	c.mu.Lock()
+	data, err := json.MarshalIndent(c.interactions, "", "  ")
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(c.Path, data, 0600); err != nil {
+		return fmt.Errorf("failed to save cassette: %v", err)
+	}
+	return nil
+}
+
+// ResultStore receives raw result files, e.g. an object storage bucket.
+// Put returns the location the file was written to.
+type ResultStore interface {
+	Put(ctx context.Context, key string, body io.Reader, size int64) (string, error)
+}
+
+// StoreResults streams the task's result file into store without touching
+// local disk. keyTemplate may contain {task_id}, {user_id}, {date} and
+// {timestamp} placeholders.
+func (wc *Checker) StoreResults(ctx context.Context, task *WhatsAppResponse, store ResultStore, keyTemplate string) (string, error) {
+	if task.ResultURL == "" {
+		return "", fmt.Errorf("task %s has no result URL", task.TaskID)
+	}
+
+	now := time.Now().UTC()
+	key := strings.NewReplacer(
+		"{task_id}", task.TaskID,
+		"{user_id}", task.UserID,
+		"{date}", now.Format("2006-01-02"),
+		"{timestamp}", now.Format("20060102T150405Z"),
+	).Replace(keyTemplate)
+
+	var body io.Reader
+	var size int64
+	if wc.piiSalt != nil {
+		// The provider's file holds raw numbers, so it is rewritten hashed.
+		format, codec := exportFormatFromPath(key)
+		if format == "xlsx" {
+			return "", fmt.Errorf("PII hashing is enabled, store %s as .csv, .json or .ndjson instead of .xlsx", key)
+		}
+		results, err := wc.fetchResults(ctx, task.ResultURL, -1)
+		if err != nil {
+			return "", err
+		}
+		var buf bytes.Buffer
+		if err := results.Hashed(wc.piiSalt).Export(&buf, format, codec); err != nil {
+			return "", err
+		}
+		body, size = &buf, int64(buf.Len())
+	} else {
+		resp, err := wc.openResult(ctx, task.ResultURL, task)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, size = resp.Body, resp.ContentLength
+	}
+
+	location, err := store.Put(ctx, key, body, size)
+	if err != nil {
+		return "", fmt.Errorf("failed to store results: %v", err)
+	}
+
+	wc.recordEvent(task.TaskID, "delivered", location)
+	return location, nil
+}
+
+func (wc *Checker) PreviewResults(taskID, userID string, n int) (*WhatsAppResponse, Results, error) {
+	status, err := wc.CheckTaskStatus(taskID, userID)
+	if err != nil {
+		return nil, nil, err
+	}
+	if status.Status != StatusExported || status.ResultURL == "" {
+		return status, nil, fmt.Errorf("results not available, task status: %s", status.Status)
+	}
+
+	results, err := wc.previewResults(context.Background(), status.ResultURL, n)
+	if err != nil {
+		return status, nil, err
+	}
+	return status, results, nil
+}
+
+// rangeChunk is the size of each Range request made by rangeReaderAt.
+const rangeChunk = 256 << 10
+
+// previewResults reads the first n results. A result file is a zip archive
+// with its directory at the end, so when the server honours Range requests
+// only the directory and the start of the sheet are downloaded; otherwise
+// the whole file is.
+func (wc *Checker) previewResults(ctx context.Context, resultURL string, n int) (Results, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", resultURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=0-%d", rangeChunk-1))
+	start := time.Now()
+	resp, err := wc.downloadClient.Do(req)
+	wc.audit.Record("download", req, resp, err, start)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download results: %v", err)
+	}
+	defer resp.Body.Close()
+
+	var size int64
+	if resp.StatusCode == http.StatusPartialContent {
+		_, total, _ := strings.Cut(resp.Header.Get("Content-Range"), "/")
+		size, _ = strconv.ParseInt(total, 10, 64)
+	}
+	var first []byte
+	if size > 0 {
+		if first, err = io.ReadAll(io.LimitReader(resp.Body, rangeChunk)); err != nil {
+			return nil, fmt.Errorf("failed to read results: %v", err)
+		}
+	}
+	if size <= 0 || int64(len(first)) != min(size, rangeChunk) {
+		return wc.fetchResults(ctx, resultURL, n)
+	}
+
+	ra := &rangeReaderAt{ctx: ctx, client: wc.downloadClient, url: resultURL, size: size, chunks: map[int64][]byte{0: first}}
+	results, err := parseResults(ra, size, n)
+	if err != nil || wc.enricher == nil {
+		return results, err
+	}
+	if err := wc.enricher.Enrich(ctx, results); err != nil {
+		log.Printf("Failed to enrich %d results: %v", len(results), err)
+	}
+	return results, nil
+}
+
+// rangeReaderAt reads a remote file of known size through HTTP Range
+// requests of rangeChunk bytes, fetching each chunk at most once.
+type rangeReaderAt struct {
+	ctx    context.Context
+	client *http.Client
+	url    string
+	size   int64
+	chunks map[int64][]byte
+}
+
+func (r *rangeReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) {
+		pos := off + int64(n)
+		if pos >= r.size {
+			return n, io.EOF
+		}
+		start := pos - pos%rangeChunk
+		chunk, err := r.chunk(start)
+		if err != nil {
+			return n, err
+		}
+		n += copy(p[n:], chunk[pos-start:])
+	}
+	return n, nil
+}
+
+func (r *rangeReaderAt) chunk(start int64) ([]byte, error) {
+	if chunk, ok := r.chunks[start]; ok {
+		return chunk, nil
+	}
+	end := min(start+rangeChunk, r.size)
+	req, err := http.NewRequestWithContext(r.ctx, "GET", r.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download results: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("HTTP error: %d", resp.StatusCode)
+	}
+	chunk, err := io.ReadAll(io.LimitReader(resp.Body, end-start))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read results: %v", err)
+	}
+	if int64(len(chunk)) != end-start {
+		return nil, fmt.Errorf("got %d of %d bytes at offset %d", len(chunk), end-start, start)
+	}
+	r.chunks[start] = chunk
+	return chunk, nil
+}
+
+func (wc *Checker) FetchResults(resultURL string) (Results, error) {
+	return wc.fetchResults(context.Background(), resultURL, -1)
+}
+
+func (wc *Checker) fetchResults(ctx context.Context, resultURL string, limit int) (Results, error) {
+	resp, err := wc.openResult(ctx, resultURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read results: %v", err)
+	}
+
+	results, err := parseResults(bytes.NewReader(data), int64(len(data)), limit)
+	if err != nil {
+		return results, err
+	}
+	if limit < 0 {
+		if rec, ok := wc.taskForResultURL(resultURL); ok {
+			wc.recordEvent(rec.TaskID, "delivered", resultURL)
+		}
+	}
+	if wc.enricher == nil {
+		return results, nil
+	}
+	if err := wc.enricher.Enrich(ctx, results); err != nil {
+		log.Printf("Failed to enrich %d results: %v", len(results), err)
+	}
+	return results, nil
+}
+
+func ParseResults(r io.ReaderAt, size int64) (Results, error) {
+	return parseResults(r, size, -1)
+}
+
+func ParseResultsFile(path string) (Results, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat file: %v", err)
+	}
+	return ParseResults(file, info.Size())
+}
+
+// parseResults reads at most limit result rows (all rows when limit < 0),
+// locating the number and whatsapp columns from the header row.
+func parseResults(r io.ReaderAt, size int64, limit int) (Results, error) {
+	rowLimit := limit
+	if rowLimit >= 0 {
+		rowLimit++
+	}
+	rows, err := readXLSXRows(r, size, "", rowLimit)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+
+	numberCol, whatsappCol := 0, 1
+	for i, name := range rows[0] {
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "number":
+			numberCol = i
+		case "whatsapp", "telegram", "status", "result":
+			whatsappCol = i
+		}
+	}
+
+	results := make(Results, 0, len(rows)-1)
+	for _, row := range rows[1:] {
+		result := NumberResult{Number: cellAt(row, numberCol), WhatsApp: cellAt(row, whatsappCol)}
+		if result.Number == "" {
+			continue
+		}
+		result.Country, result.Region = CountryForNumber(result.Number), RegionForNumber(result.Number)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// LoadNumbersFile reads the first column of a .csv or .xlsx file, or one
+// number per line from any other file. Blank lines are dropped.
+func LoadNumbersFile(path string) ([]string, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return LoadNumbersFromCSV(path, "1")
+	case ".xlsx":
+		return LoadNumbersFromXLSX(path, "", "1")
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
+	text, _ := DecodeText(data)
+	var numbers []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			numbers = append(numbers, line)
+		}
+	}
+	return numbers, nil
+}
+
+// InputFile is one number file found by ExpandInputs.
+type InputFile struct {
+	Name    string
+	Numbers []string
+}
+
+// maxInputFileSize guards against zip bombs when expanding archives.
+const maxInputFileSize = 1 << 30
+
+// ExpandInputs reads every number file in a .zip archive or directory, or
+// the single file at path. Entries are read like LoadNumbersFile: .csv and
+// .xlsx by their first column, anything else as one number per line. Hidden
+// files and macOS resource forks are skipped.
+func ExpandInputs(path string) ([]InputFile, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open input: %v", err)
+	}
+
+	var files []InputFile
+	switch {
+	case info.IsDir():
+		entries, err := os.ReadDir(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read directory: %v", err)
+		}
+		for _, entry := range entries {
+			if entry.IsDir() || skipInputName(entry.Name()) {
+				continue
+			}
+			numbers, err := LoadNumbersFile(filepath.Join(path, entry.Name()))
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", entry.Name(), err)
+			}
+			files = append(files, InputFile{Name: entry.Name(), Numbers: numbers})
+		}
+	case strings.EqualFold(filepath.Ext(path), ".zip"):
+		zr, err := zip.OpenReader(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open zip: %v", err)
+		}
+		defer zr.Close()
+		for _, entry := range zr.File {
+			if entry.FileInfo().IsDir() || skipInputName(entry.Name) {
+				continue
+			}
+			numbers, err := numbersFromZipEntry(entry)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", entry.Name, err)
+			}
+			files = append(files, InputFile{Name: entry.Name, Numbers: numbers})
+		}
+	default:
+		numbers, err := LoadNumbersFile(path)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, InputFile{Name: filepath.Base(path), Numbers: numbers})
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no number files found in %s", path)
+	}
+	return files, nil
+}
+
+func skipInputName(name string) bool {
+	base := filepath.Base(name)
+	return strings.HasPrefix(base, ".") || strings.HasPrefix(name, "__MACOSX/")
+}
+
+func numbersFromZipEntry(entry *zip.File) ([]string, error) {
+	if entry.UncompressedSize64 > maxInputFileSize {
+		return nil, fmt.Errorf("entry is larger than %d bytes", maxInputFileSize)
+	}
+	rc, err := entry.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open entry: %v", err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, maxInputFileSize))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read entry: %v", err)
+	}
+	return numbersFromBytes(entry.Name, data)
+}
+
+// numbersFromBytes reads numbers from an in-memory file the way
+// LoadNumbersFile reads them from disk, choosing the format by name.
+func numbersFromBytes(name string, data []byte) ([]string, error) {
+	var (
+		rows [][]string
+		err  error
+	)
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".xlsx":
+		if rows, err = readXLSXRows(bytes.NewReader(data), int64(len(data)), "", -1); err != nil {
+			return nil, err
+		}
+	case ".csv":
+		text, _ := DecodeText(data)
+		reader := csv.NewReader(strings.NewReader(text))
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		if rows, err = reader.ReadAll(); err != nil {
+			return nil, fmt.Errorf("failed to read csv: %v", err)
+		}
+	default:
+		text, _ := DecodeText(data)
+		var numbers []string
+		for _, line := range strings.Split(text, "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				numbers = append(numbers, line)
+			}
+		}
+		return numbers, nil
+	}
+	numbers, _, err := NumberLoader{}.numbersFromRows(rows, "1")
+	return numbers, err
+}
+
+// numbersFromReader is numbersFromBytes for a stream such as a remote object.
+// Text and CSV are read a line or record at a time, so only the numbers are
+// held in memory; spreadsheets need random access and UTF-16 text needs its
+// encoding sniffed, so those are read whole. Input over maxInputFileSize is
+// an error rather than silently cut short.
+func numbersFromReader(name string, r io.Reader) ([]string, error) {
+	br := bufio.NewReaderSize(&sizeLimitReader{r: r, limit: maxInputFileSize}, 64<<10)
+	head, err := br.Peek(4096)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read input: %v", err)
+	}
+
+	ext := strings.ToLower(filepath.Ext(name))
+	_, utf16 := sniffUTF16(head[:len(head)&^1])
+	if ext == ".xlsx" || utf16 || bytes.HasPrefix(head, []byte{0xFF, 0xFE}) || bytes.HasPrefix(head, []byte{0xFE, 0xFF}) {
+		data, err := io.ReadAll(br)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read input: %v", err)
+		}
+		return numbersFromBytes(name, data)
+	}
+	if bytes.HasPrefix(head, []byte{0xEF, 0xBB, 0xBF}) {
+		br.Discard(3)
+	}
+
+	if ext == ".csv" {
+		reader := csv.NewReader(br)
+		reader.FieldsPerRecord = -1
+		reader.TrimLeadingSpace = true
+		reader.ReuseRecord = true
+		var rows [][]string
+		for {
+			record, err := reader.Read()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read csv: %v", err)
+			}
+			rows = append(rows, []string{cellAt(record, 0)})
+		}
+		numbers, _, err := NumberLoader{}.numbersFromRows(rows, "1")
+		return numbers, err
+	}
+
+	var numbers []string
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		for _, line := range strings.Split(scanner.Text(), "\r") {
+			if line = strings.TrimSpace(line); line != "" {
+				numbers = append(numbers, line)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read input: %v", err)
+	}
+	return numbers, nil
+}
+
+// sizeLimitReader fails once more than limit bytes have been read.
+type sizeLimitReader struct {
+	r     io.Reader
+	limit int64
+	read  int64
+}
+
+func (l *sizeLimitReader) Read(p []byte) (int, error) {
+	n, err := l.r.Read(p)
+	if l.read += int64(n); l.read > l.limit {
+		return n, fmt.Errorf("input is larger than %d bytes", l.limit)
+	}
+	return n, err
+}
+
+// SubmitInputs uploads the files found by ExpandInputs, either merged and
+// deduplicated into one task, or as one task per file. Every task is labeled
+// input=<base name of path> (and file=<entry> when split), so the set can be
+// tracked together with "wachecker tasks --label input=...".
+func (wc *Checker) SubmitInputs(ctx context.Context, path string, perFile bool) ([]*WhatsAppResponse, error) {
+	files, err := ExpandInputs(path)
+	if err != nil {
+		return nil, err
+	}
+	input := filepath.Base(path)
+
+	if !perFile {
+		var all []string
+		for _, f := range files {
+			all = append(all, f.Numbers...)
+		}
+		unique, duplicates := DedupeNumbers(all)
+		log.Printf("Merged %d files from %s: %d numbers, %d duplicates removed", len(files), input, len(unique), duplicates)
+		files = []InputFile{{Name: input, Numbers: unique}}
+	}
+
+	var tasks []*WhatsAppResponse
+	for _, f := range files {
+		labels := map[string]string{"input": input}
+		if perFile {
+			labels["file"] = f.Name
+		}
+		task, err := wc.uploadNumbers(ctx, f.Numbers, UploadOptions{Name: f.Name, Labels: labels})
+		if err != nil {
+			return tasks, fmt.Errorf("%s: %w", f.Name, err)
+		}
+		tasks = append(tasks, task)
+	}
+	return tasks, nil
+}
+
+func (wc *Checker) uploadNumbers(ctx context.Context, phoneNumbers []string, opts UploadOptions) (*WhatsAppResponse, error) {
+	file, err := os.CreateTemp(tempDir(), "whatsapp_input_*.txt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create input file: %v", err)
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+
+	if err := wc.CreateInputFile(phoneNumbers, file.Name()); err != nil {
+		return nil, fmt.Errorf("failed to write input file: %v", err)
+	}
+	return wc.UploadFileWithOptions(ctx, file.Name(), opts)
+}
+
+func LoadNumbersFromCSV(path, column string) ([]string, error) {
+	numbers, _, err := NumberLoader{}.LoadCSV(path, column)
+	return numbers, err
+}
+
+func LoadNumbersFromXLSX(path, sheet, column string) ([]string, error) {
+	numbers, _, err := NumberLoader{}.LoadXLSX(path, sheet, column)
+	return numbers, err
+}
+
+// Encodings recognised by DecodeText.
+const (
+	EncodingUTF8    = "utf-8"
+	EncodingUTF8BOM = "utf-8-bom"
+	EncodingUTF16LE = "utf-16le"
+	EncodingUTF16BE = "utf-16be"
+	EncodingLatin1  = "latin-1"
+)
+
+// DecodeText converts a customer file to UTF-8 with "\n" line endings. It
+// honours UTF-8 and UTF-16 byte order marks, recognises BOM-less UTF-16 from
+// its NUL bytes, and reads anything else that is not valid UTF-8 as Latin-1.
+func DecodeText(data []byte) (text, encoding string) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xEF, 0xBB, 0xBF}):
+		text, encoding = string(data[3:]), EncodingUTF8BOM
+	case bytes.HasPrefix(data, []byte{0xFF, 0xFE}):
+		text, encoding = decodeUTF16(data[2:], false), EncodingUTF16LE
+	case bytes.HasPrefix(data, []byte{0xFE, 0xFF}):
+		text, encoding = decodeUTF16(data[2:], true), EncodingUTF16BE
+	default:
+		if order, ok := sniffUTF16(data); ok {
+			text, encoding = decodeUTF16(data, order), map[bool]string{false: EncodingUTF16LE, true: EncodingUTF16BE}[order]
+		} else if utf8.Valid(data) {
+			text, encoding = string(data), EncodingUTF8
+		} else {
+			runes := make([]rune, len(data))
+			for i, b := range data {
+				runes[i] = rune(b)
+			}
+			text, encoding = string(runes), EncodingLatin1
+		}
+	}
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	return strings.ReplaceAll(text, "\r", "\n"), encoding
+}
+
+// sniffUTF16 detects BOM-less UTF-16 from ASCII text: in a file of digits
+// every other byte is NUL. bigEndian says which half the NULs are in.
+func sniffUTF16(data []byte) (bigEndian, ok bool) {
+	if len(data) < 4 || len(data)%2 != 0 {
+		return false, false
+	}
+	var even, odd int
+	for i := 0; i < len(data); i += 2 {
+		if data[i] == 0 {
+			even++
+		}
+		if data[i+1] == 0 {
+			odd++
+		}
+	}
+	half := len(data) / 2
+	switch {
+	case odd*10 >= half*9 && even == 0:
+		return false, true
+	case even*10 >= half*9 && odd == 0:
+		return true, true
+	}
+	return false, false
+}
+
+func decodeUTF16(data []byte, bigEndian bool) string {
+	units := make([]uint16, len(data)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(data[2*i])<<8 | uint16(data[2*i+1])
+		} else {
+			units[i] = uint16(data[2*i+1])<<8 | uint16(data[2*i])
+		}
+	}
+	return string(utf16.Decode(units))
+}
+
+// NumberLoader reads numbers from customer files, repairing common spreadsheet
+// damage and reporting every value it changed or could not use.
+type NumberLoader struct {
+	Repair RepairOptions
+}
+
+type RepairOptions struct {
+	// DefaultCallingCode, e.g. "31", turns national numbers into E.164 by
+	// dropping the trunk "0" and prefixing the calling code.
+	DefaultCallingCode string
+
+	// AssumeInternational restores a lost "+" on digit-only values that
+	// start with a known calling code and have an international length.
+	AssumeInternational bool
+}
+
+const (
+	ActionRepaired = "repaired"
+	ActionRejected = "rejected"
+	ActionFlagged  = "flagged"
+)
+
+type ValidationIssue struct {
+	Line     int    `json:"line"`
+	Raw      string `json:"raw"`
+	Action   string `json:"action"`
+	Reason   string `json:"reason"`
+	Repaired string `json:"repaired,omitempty"`
+}
+
+type ValidationReport struct {
+	Source   string            `json:"source,omitempty"`
+	Accepted int               `json:"accepted"`
+	Issues   []ValidationIssue `json:"issues,omitempty"`
+}
+
+// Rejected returns the issues for values that were dropped.
+func (r *ValidationReport) Rejected() []ValidationIssue {
+	var rejected []ValidationIssue
+	for _, issue := range r.Issues {
+		if issue.Action == ActionRejected {
+			rejected = append(rejected, issue)
+		}
+	}
+	return rejected
+}
+
+// WriteRejects writes the rejected values as CSV with line, raw and reason
+// columns, ready to be fixed at the source and fed back in.
+func (r *ValidationReport) WriteRejects(w io.Writer) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"line", "raw", "reason"})
+	for _, issue := range r.Rejected() {
+		cw.Write([]string{strconv.Itoa(issue.Line), issue.Raw, issue.Reason})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func (r *ValidationReport) WriteRejectsFile(path string) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("failed to create rejects file: %v", err)
+	}
+	if err := r.WriteRejects(file); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write rejects file: %v", err)
+	}
+	return file.Close()
+}
+
+func (r *ValidationReport) Count(action string) int {
+	n := 0
+	for _, issue := range r.Issues {
+		if issue.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// PreflightReport is the outcome of checking a file locally before it is
+// submitted: the loader's repairs and rejections, duplicates, and the
+// countries the accepted numbers belong to.
+type PreflightReport struct {
+	*ValidationReport
+	Duplicates int            `json:"duplicates"`
+	Unique     int            `json:"unique"`
+	Countries  map[string]int `json:"countries"`
+}
+
+// Preflight runs the loader and deduplication on path without contacting
+// the API, returning the unique numbers that would be uploaded.
+func (l NumberLoader) Preflight(path string) ([]string, *PreflightReport, error) {
+	numbers, validation, err := l.Load(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	unique, duplicates := DedupeNumbers(numbers)
+	report := &PreflightReport{
+		ValidationReport: validation,
+		Duplicates:       duplicates,
+		Unique:           len(unique),
+		Countries:        make(map[string]int),
+	}
+	for _, number := range unique {
+		report.Countries[CountryForNumber(number)]++
+	}
+	return unique, report, nil
+}
+
+func (r *PreflightReport) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "Source:\t%s\n", r.Source)
+	fmt.Fprintf(tw, "Accepted:\t%d\n", r.Accepted)
+	fmt.Fprintf(tw, "Repaired:\t%d\n", r.Count(ActionRepaired))
+	fmt.Fprintf(tw, "Flagged:\t%d\n", r.Count(ActionFlagged))
+	fmt.Fprintf(tw, "Rejected:\t%d\n", r.Count(ActionRejected))
+	fmt.Fprintf(tw, "Duplicates:\t%d\n", r.Duplicates)
+	fmt.Fprintf(tw, "Unique:\t%d\n", r.Unique)
+
+	fmt.Fprintln(tw, "\nCOUNTRY\tNUMBERS")
+	for _, country := range sortedKeys(r.Countries) {
+		fmt.Fprintf(tw, "%s\t%d\n", country, r.Countries[country])
+	}
+
+	if len(r.Issues) > 0 {
+		fmt.Fprintln(tw, "\nLINE\tACTION\tRAW\tREASON")
+		for _, issue := range r.Issues {
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\n", issue.Line, issue.Action, strings.TrimSpace(issue.Raw), issue.Reason)
+		}
+	}
+	return tw.Flush()
+}
+
+// Load reads numbers from the first column of a .csv or .xlsx file, or one
+// per line from any other file, like LoadNumbersFile, and reports every value
+// it repaired or rejected.
+func (l NumberLoader) Load(path string) ([]string, *ValidationReport, error) {
+	var (
+		numbers []string
+		report  *ValidationReport
+		err     error
+	)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		numbers, report, err = l.LoadCSV(path, "1")
+	case ".xlsx":
+		numbers, report, err = l.LoadXLSX(path, "", "1")
+	default:
+		numbers, report, err = l.LoadText(path)
+	}
+	if report != nil {
+		report.Source = path
+	}
+	return numbers, report, err
+}
+
+// LoadText reads one number per line from a plain text file in any encoding
+// DecodeText understands.
+func (l NumberLoader) LoadText(path string) ([]string, *ValidationReport, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read file: %v", err)
+	}
+	text, _ := DecodeText(data)
+	lines := strings.Split(text, "\n")
+
+	report := l.validateLines(lines)
+	numbers := make([]string, 0, report.Accepted)
+	for _, line := range lines {
+		if number, _ := RepairNumber(line, l.Repair); number != "" {
+			numbers = append(numbers, number)
+		}
+	}
+	return numbers, report, nil
+}
+
+// validateLines reports every non-blank line that RepairNumber changes or
+// rejects, numbered from 1.
+func (l NumberLoader) validateLines(lines []string) *ValidationReport {
+	report := &ValidationReport{}
+	for i, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		number, issue := RepairNumber(line, l.Repair)
+		if issue != nil {
+			issue.Line = i + 1
+			report.Issues = append(report.Issues, *issue)
+		}
+		if number != "" {
+			report.Accepted++
+		}
+	}
+	return report
+}
+
+func (l NumberLoader) LoadCSV(path, column string) ([]string, *ValidationReport, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	text, _ := DecodeText(data)
+
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read csv: %v", err)
+	}
+	return l.numbersFromRows(rows, column)
+}
+
+func (l NumberLoader) LoadXLSX(path, sheet, column string) ([]string, *ValidationReport, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to stat file: %v", err)
+	}
+
+	rows, err := readXLSXRows(file, info.Size(), sheet, -1)
+	if err != nil {
+		return nil, nil, err
+	}
+	return l.numbersFromRows(rows, column)
+}
+
+// numbersFromRows selects column by header name, spreadsheet letter ("B") or
+// 1-based index ("2"), and returns the repaired numbers it contains.
+func (l NumberLoader) numbersFromRows(rows [][]string, column string) ([]string, *ValidationReport, error) {
+	report := &ValidationReport{}
+	if len(rows) == 0 {
+		return nil, report, nil
+	}
+
+	col, skipHeader := -1, false
+	for i, name := range rows[0] {
+		if strings.EqualFold(strings.TrimSpace(name), strings.TrimSpace(column)) {
+			col, skipHeader = i, true
+			break
+		}
+	}
+	if col < 0 {
+		if n, err := strconv.Atoi(column); err == nil && n > 0 {
+			col = n - 1
+		} else if idx := columnIndex(strings.ToUpper(column)); idx >= 0 && len(digitsOnly(column)) == 0 {
+			col = idx
+		} else {
+			return nil, nil, fmt.Errorf("column not found: %q", column)
+		}
+	}
+
+	var numbers []string
+	for i, row := range rows {
+		if i == 0 && skipHeader {
+			continue
+		}
+		raw := cellAt(row, col)
+		if raw == "" || (i == 0 && digitsOnly(raw) == "") {
+			continue
+		}
+
+		number, issue := RepairNumber(raw, l.Repair)
+		if issue != nil {
+			issue.Line = i + 1
+			report.Issues = append(report.Issues, *issue)
+		}
+		if number != "" {
+			numbers = append(numbers, number)
+			report.Accepted++
+		}
+	}
+	return numbers, report, nil
+}
+
+// RepairNumber normalizes raw, undoing spreadsheet damage where the original
+// value can be recovered exactly. The issue describes any repair, or why
+// the value was rejected (in which case the number is empty).
+func RepairNumber(raw string, opts RepairOptions) (string, *ValidationIssue) {
+	value := strings.TrimSpace(raw)
+	var repairs []string
+
+	if mantissa, exponent, ok := splitScientific(value); ok {
+		intPart, frac, _ := strings.Cut(strings.TrimPrefix(mantissa, "+"), ".")
+		switch {
+		case len(frac) > exponent:
+			return "", &ValidationIssue{Raw: raw, Action: ActionRejected, Reason: "scientific notation is not a whole number"}
+		case len(frac) < exponent:
+			return "", &ValidationIssue{Raw: raw, Action: ActionRejected,
+				Reason: fmt.Sprintf("scientific notation lost %d trailing digits", exponent-len(frac))}
+		}
+		value = intPart + frac
+		if strings.HasPrefix(mantissa, "+") {
+			value = "+" + value
+		}
+		repairs = append(repairs, "expanded scientific notation")
+	} else if whole, frac, ok := strings.Cut(value, "."); ok && strings.Trim(frac, "0") == "" && digitsOnly(whole) == strings.TrimPrefix(whole, "+") {
+		value = whole
+		repairs = append(repairs, "removed decimal suffix")
+	}
+
+	number := NormalizeNumber(value)
+	digits := strings.TrimPrefix(number, "+")
+	if digits == "" {
+		return "", &ValidationIssue{Raw: raw, Action: ActionRejected, Reason: "no digits"}
+	}
+
+	var flag string
+	if !strings.HasPrefix(number, "+") {
+		switch {
+		case opts.DefaultCallingCode != "" && len(digits) <= 10:
+			number = "+" + opts.DefaultCallingCode + strings.TrimPrefix(digits, "0")
+			repairs = append(repairs, "added calling code +"+opts.DefaultCallingCode)
+		case opts.AssumeInternational && len(digits) >= 10 && CountryForNumber("+"+digits) != UnknownCountry:
+			number = "+" + digits
+			repairs = append(repairs, "restored leading +")
+		default:
+			flag = "missing international prefix"
+		}
+	}
+
+	if n := len(strings.TrimPrefix(number, "+")); n < 7 || n > 15 {
+		return "", &ValidationIssue{Raw: raw, Action: ActionRejected, Reason: fmt.Sprintf("invalid length: %d digits", n)}
+	}
+
+	switch {
+	case len(repairs) > 0:
+		return number, &ValidationIssue{Raw: raw, Action: ActionRepaired, Reason: strings.Join(repairs, ", "), Repaired: number}
+	case flag != "":
+		return number, &ValidationIssue{Raw: raw, Action: ActionFlagged, Reason: flag}
+	}
+	return number, nil
+}
+
+// splitScientific recognises values such as "3.16123E+10" as written by
+// spreadsheets for long numeric cells.
+func splitScientific(value string) (string, int, bool) {
+	idx := strings.IndexAny(value, "eE")
+	if idx <= 0 {
+		return "", 0, false
+	}
+	mantissa, exp := value[:idx], strings.TrimPrefix(value[idx+1:], "+")
+	exponent, err := strconv.Atoi(exp)
+	if err != nil || exponent < 0 {
+		return "", 0, false
+	}
+	intPart, frac, _ := strings.Cut(strings.TrimPrefix(mantissa, "+"), ".")
+	if len(intPart) != 1 || digitsOnly(intPart) != intPart || digitsOnly(frac) != frac {
+		return "", 0, false
+	}
+	return mantissa, exponent, true
+}
+
+func countNumbers(data string) int {
+	n := 0
+	for _, line := range strings.Split(data, "\n") {
+		if strings.TrimSpace(line) != "" {
+			n++
+		}
+	}
+	return n
+}
+
+// DedupeNumbers drops blank lines and repeated numbers, comparing normalized
+// forms but returning the first occurrence unchanged.
+func DedupeNumbers(phoneNumbers []string) ([]string, int) {
+	seen := make(map[string]bool, len(phoneNumbers))
+	unique := make([]string, 0, len(phoneNumbers))
+	duplicates := 0
+	for _, number := range phoneNumbers {
+		key := NormalizeNumber(number)
+		if key == "" {
+			continue
+		}
+		if seen[key] {
+			duplicates++
+			continue
+		}
+		seen[key] = true
+		unique = append(unique, strings.TrimSpace(number))
+	}
+	return unique, duplicates
+}
+
+// resultKey normalizes number unless it is already a HashNumber.
+func resultKey(number string) string {
+	if strings.HasPrefix(number, "h:") {
+		return number
+	}
+	return cmp.Or(NormalizeNumber(number), number)
+}
+
+// NormalizeNumber strips formatting characters and converts a leading "00"
+// international prefix to "+". It returns "" when no digits remain.
+func NormalizeNumber(raw string) string {
+	raw = strings.TrimSpace(raw)
+	digits := digitsOnly(raw)
+	if digits == "" {
+		return ""
+	}
+	if strings.HasPrefix(raw, "+") {
+		return "+" + digits
+	}
+	if strings.HasPrefix(digits, "00") {
+		return "+" + digits[2:]
+	}
+	return digits
+}
+
+func cellAt(row []string, col int) string {
+	if col < len(row) {
+		return strings.TrimSpace(row[col])
+	}
+	return ""
+}
+
+type xlsxCell struct {
+	Ref    string `xml:"r,attr"`
+	Type   string `xml:"t,attr"`
+	Value  string `xml:"v"`
+	Inline struct {
+		Text string `xml:"t"`
+	} `xml:"is"`
+}
+
+// readXLSXRows returns up to limit rows (all rows when limit < 0) of the
+// named sheet, or of the first sheet when sheet is empty.
+func readXLSXRows(r io.ReaderAt, size int64, sheet string, limit int) ([][]string, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open xlsx: %v", err)
+	}
+
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	sharedStrings, err := readSharedStrings(files["xl/sharedStrings.xml"])
+	if err != nil {
+		return nil, err
+	}
+
+	sheetPath, err := findSheetPath(files, sheet)
+	if err != nil {
+		return nil, err
+	}
+
+	rc, err := files[sheetPath].Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sheet: %v", err)
+	}
+	defer rc.Close()
+
+	var rows [][]string
+	decoder := xml.NewDecoder(rc)
+	for limit < 0 || len(rows) < limit {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse sheet: %v", err)
+		}
+
+		start, ok := token.(xml.StartElement)
+		if !ok || start.Name.Local != "row" {
+			continue
+		}
+
+		var row struct {
+			Cells []xlsxCell `xml:"c"`
+		}
+		if err := decoder.DecodeElement(&row, &start); err != nil {
+			return nil, fmt.Errorf("failed to parse row: %v", err)
+		}
+
+		var values []string
+		for i, cell := range row.Cells {
+			col := columnIndex(cell.Ref)
+			if col < 0 {
+				col = i
+			}
+			for len(values) <= col {
+				values = append(values, "")
+			}
+			values[col] = cellValue(cell, sharedStrings)
+		}
+		rows = append(rows, values)
+	}
+
+	return rows, nil
+}
+
+func readSharedStrings(f *zip.File) ([]string, error) {
+	if f == nil {
+		return nil, nil
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open shared strings: %v", err)
+	}
+	defer rc.Close()
+
+	var sst struct {
+		Items []struct {
+			Text string `xml:"t"`
+			Runs []struct {
+				Text string `xml:"t"`
+			} `xml:"r"`
+		} `xml:"si"`
+	}
+	if err := xml.NewDecoder(rc).Decode(&sst); err != nil {
+		return nil, fmt.Errorf("failed to parse shared strings: %v", err)
+	}
+
+	values := make([]string, len(sst.Items))
+	for i, item := range sst.Items {
+		values[i] = item.Text
+		for _, run := range item.Runs {
+			values[i] += run.Text
+		}
+	}
+	return values, nil
+}
+
+func findSheetPath(files map[string]*zip.File, sheet string) (string, error) {
+	var workbook struct {
+		Sheets []struct {
+			Name string `xml:"name,attr"`
+			RID  string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	var rels struct {
+		Items []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+
+	if err := decodeZipXML(files["xl/workbook.xml"], &workbook); err != nil {
+		return "", err
+	}
+	if err := decodeZipXML(files["xl/_rels/workbook.xml.rels"], &rels); err != nil {
+		return "", err
+	}
+
+	for _, ws := range workbook.Sheets {
+		if sheet != "" && ws.Name != sheet {
+			continue
+		}
+		for _, rel := range rels.Items {
+			if rel.ID != ws.RID {
+				continue
+			}
+			target := strings.TrimPrefix(rel.Target, "/")
+			if !strings.HasPrefix(target, "xl/") {
+				target = "xl/" + target
+			}
+			if files[target] != nil {
+				return target, nil
+			}
+		}
+	}
+
+	if sheet == "" && files["xl/worksheets/sheet1.xml"] != nil {
+		return "xl/worksheets/sheet1.xml", nil
+	}
+	return "", fmt.Errorf("sheet not found: %q", sheet)
+}
+
+func decodeZipXML(f *zip.File, v interface{}) error {
+	if f == nil {
+		return nil
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %v", f.Name, err)
+	}
+	defer rc.Close()
+
+	if err := xml.NewDecoder(rc).Decode(v); err != nil {
+		return fmt.Errorf("failed to parse %s: %v", f.Name, err)
+	}
+	return nil
+}
+
+func cellValue(cell xlsxCell, sharedStrings []string) string {
+	switch cell.Type {
+	case "s":
+		idx, err := strconv.Atoi(cell.Value)
+		if err != nil || idx < 0 || idx >= len(sharedStrings) {
+			return ""
+		}
+		return sharedStrings[idx]
+	case "inlineStr":
+		return cell.Inline.Text
+	default:
+		return cell.Value
+	}
+}
+
+func columnIndex(ref string) int {
+	col := 0
+	for _, ch := range ref {
+		if ch < 'A' || ch > 'Z' {
+			break
+		}
+		col = col*26 + int(ch-'A'+1)
+	}
+	return col - 1
+}
+
+// Server exposes the checker over HTTP, so internal teams can submit and
+// fetch checks without ever handling the API key:
+//
+//	POST /tasks               {"numbers": [...]} or one number per line
+//	GET  /tasks/{id}          task status
+//	GET  /tasks/{id}/results  results as ?format=csv, json or ndjson
+//	GET  /metrics             Prometheus metrics
+//	GET  /healthz             liveness: the process is serving
+//	GET  /readyz              readiness: the API accepts the key and the
+//	                          task store is writable
+//
+// When Token is set, requests must carry "Authorization: Bearer <Token>",
+// except the probes, which kubelets send without credentials.
+type Server struct {
+	Token string
+
+	// ReadyTTL is how long an upstream Ping result is reused by /readyz,
+	// so frequent probes do not turn into API calls. Default 30s.
+	ReadyTTL time.Duration
+
+	checker *Checker
+	mux     *http.ServeMux
+
+	draining atomic.Bool
+	pingMu   sync.Mutex
+	pinging  chan struct{}
+	pingAt   time.Time
+	pingErr  error
+}
+
+func NewServer(checker *Checker) *Server {
+	s := &Server{checker: checker, mux: http.NewServeMux(), ReadyTTL: 30 * time.Second}
+	s.mux.HandleFunc("POST /tasks", s.submit)
+	s.mux.HandleFunc("GET /tasks/{id}", s.status)
+	s.mux.HandleFunc("GET /tasks/{id}/results", s.results)
+	s.mux.Handle("GET /metrics", checker.Metrics().Handler())
+	s.mux.HandleFunc("GET /healthz", s.healthz)
+	s.mux.HandleFunc("GET /readyz", s.readyz)
+	return s
+}
+
+// Drain fails /readyz from now on, so the service stops routing new
+// requests here while in-flight ones finish before shutdown.
+func (s *Server) Drain() {
+	s.draining.Store(true)
+}
+
+func (s *Server) healthz(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *Server) readyz(w http.ResponseWriter, r *http.Request) {
+	checks := make(map[string]string)
+	ready := true
+	fail := func(name string, err error) {
+		checks[name] = err.Error()
+		ready = false
+	}
+
+	if s.draining.Load() {
+		fail("server", errors.New("draining"))
+	}
+	if err := s.upstreamReady(r.Context()); err != nil {
+		fail("upstream", err)
+	} else {
+		checks["upstream"] = "ok"
+	}
+	if s.checker.taskStore != nil {
+		if err := s.checker.taskStore.Check(); err != nil {
+			fail("task_store", err)
+		} else {
+			checks["task_store"] = "ok"
+		}
+	}
+
+	if !ready {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]interface{}{"status": "unavailable", "checks": checks})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "checks": checks})
+}
+
+// upstreamReady pings the API at most once per ReadyTTL. The ping runs
+// detached from the probe, whose deadline is often a second, so a slow API
+// still gets a full answer cached; a probe that cannot wait for it gets the
+// previous result. Concurrent probes share one ping.
+func (s *Server) upstreamReady(ctx context.Context) error {
+	s.pingMu.Lock()
+	if !s.pingAt.IsZero() && time.Since(s.pingAt) < s.ReadyTTL {
+		defer s.pingMu.Unlock()
+		return s.pingErr
+	}
+	if s.pinging == nil {
+		s.pinging = make(chan struct{})
+		go s.ping(s.pinging)
+	}
+	done, last, known := s.pinging, s.pingErr, !s.pingAt.IsZero()
+	s.pingMu.Unlock()
+
+	select {
+	case <-done:
+		s.pingMu.Lock()
+		defer s.pingMu.Unlock()
+		return s.pingErr
+	case <-ctx.Done():
+		if !known {
+			return errors.New("upstream check in progress")
+		}
+		return last
+	}
+}
+
+func (s *Server) ping(done chan struct{}) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.checker.Ping(ctx)
+
+	s.pingMu.Lock()
+	defer s.pingMu.Unlock()
+	s.pinging = nil
+	if !errors.Is(err, context.Canceled) {
+		s.pingErr, s.pingAt = err, time.Now()
+	}
+	close(done)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	probe := r.URL.Path == "/healthz" || r.URL.Path == "/readyz"
+	if s.Token != "" && !probe && !hmac.Equal([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.Token)) {
+		writeJSONError(w, http.StatusUnauthorized, errors.New("missing or invalid bearer token"))
+		return
+	}
+	if id := cmp.Or(r.Header.Get(correlationIDHeader), r.Header.Get(requestIDHeader)); id != "" {
+		r = r.WithContext(ContextWithCorrelationID(r.Context(), id))
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) submit(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64<<20))
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("failed to read body: %v", err))
+		return
+	}
+
+	var numbers []string
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var req struct {
+			Numbers []string `json:"numbers"`
+		}
+		if err := json.Unmarshal(body, &req); err != nil {
+			writeJSONError(w, http.StatusBadRequest, fmt.Errorf("invalid JSON: %v", err))
+			return
+		}
+		numbers = req.Numbers
+	} else {
+		numbers = strings.Split(string(body), "\n")
+	}
+	numbers, _ = DedupeNumbers(numbers)
+	if len(numbers) == 0 {
+		writeJSONError(w, http.StatusBadRequest, errors.New("no numbers submitted"))
+		return
+	}
+
+	file, err := os.CreateTemp(tempDir(), "whatsapp_serve_*.txt")
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+	file.Close()
+	defer os.Remove(file.Name())
+	if err := s.checker.CreateInputFile(numbers, file.Name()); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	resp, err := s.checker.UploadFileWithOptions(r.Context(), file.Name(), UploadOptions{UserID: r.URL.Query().Get("user_id")})
+	if err != nil {
+		writeJSONError(w, upstreamErrorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusAccepted, resp)
+}
+
+func (s *Server) status(w http.ResponseWriter, r *http.Request) {
+	taskID := r.PathValue("id")
+	resp, err := s.checker.CheckTaskStatusContext(r.Context(), taskID, s.checker.userIDFor(taskID, r.URL.Query().Get("user_id")))
+	if err != nil {
+		writeJSONError(w, upstreamErrorStatus(err), err)
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func (s *Server) results(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	contentType := map[string]string{"": "text/csv", "csv": "text/csv", "json": "application/json", "ndjson": "application/x-ndjson"}[format]
+	if contentType == "" {
+		writeJSONError(w, http.StatusBadRequest, fmt.Errorf("unsupported format: %q", format))
+		return
+	}
+	if format == "" {
+		format = "csv"
+	}
+
+	taskID := r.PathValue("id")
+	resp, err := s.checker.CheckTaskStatusContext(r.Context(), taskID, s.checker.userIDFor(taskID, r.URL.Query().Get("user_id")))
+	if err != nil {
+		writeJSONError(w, upstreamErrorStatus(err), err)
+		return
+	}
+	if resp.Status != StatusExported || resp.ResultURL == "" {
+		writeJSON(w, http.StatusConflict, resp)
+		return
+	}
+
+	results, err := s.checker.fetchResults(r.Context(), resp.ResultURL, -1)
+	if err != nil {
+		writeJSONError(w, http.StatusBadGateway, err)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	if err := results.Export(w, format, ""); err != nil {
+		log.Printf("Failed to write results for %s: %v", taskID, err)
+	}
+}
+
+func upstreamErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrSequentialInput):
+		return http.StatusBadRequest
+	case errors.Is(err, ErrNoAPIKey):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %v", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error()})
+}
+
+// Config is the CLI configuration file, ~/.wacheck.yaml by default:
+//
+//	default_profile: prod
+//	profiles:
+//	  prod:
+//	    api_key_env: PROD_WHATSAPP_KEY
+//	    poll_interval: 10s
+//	    sink: file:results/{task_id}.csv
+//	  staging:
+//	    api_key_file: ~/.config/wachecker/staging.key
+//	    base_url: https://staging.example.com/wa/api/simple/tasks
+//
+// Settings apply in order flags > environment > config file.
+type Config struct {
+	DefaultProfile string
+	Profiles       map[string]*Profile
+}
+
+// Profile holds one named set of CLI defaults. Exactly one api_key* field
+// picks the key source; the others mirror the WHATSAPP_API_KEY_* variables.
+type Profile struct {
+	Name          string
+	APIKey        string
+	APIKeyEnv     string
+	APIKeyFile    string
+	APIKeySecret  string
+	APIKeyVault   string
+	APIKeyKeyring string
+	Service       string
+	BaseURL       string
+	PollInterval  time.Duration
+	Sink          string
+}
+
+func DefaultConfigPath() string {
+	if path := os.Getenv("WACHECKER_CONFIG"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ".wacheck.yaml"
+	}
+	return filepath.Join(home, ".wacheck.yaml")
+}
+
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+	doc, err := parseYAMLMap(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %v", path, err)
+	}
+
+	cfg := &Config{Profiles: make(map[string]*Profile)}
+	cfg.DefaultProfile, _ = doc["default_profile"].(string)
+	profiles, _ := doc["profiles"].(map[string]interface{})
+	for name, raw := range profiles {
+		fields, ok := raw.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("profile %s: expected a mapping", name)
+		}
+		p := &Profile{Name: name}
+		for key, value := range fields {
+			s, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("profile %s: %s must be a scalar", name, key)
+			}
+			switch key {
+			case "api_key":
+				p.APIKey = s
+			case "api_key_env":
+				p.APIKeyEnv = s
+			case "api_key_file":
+				p.APIKeyFile = expandHome(s)
+			case "api_key_secret":
+				p.APIKeySecret = s
+			case "api_key_vault":
+				p.APIKeyVault = s
+			case "api_key_keyring":
+				p.APIKeyKeyring = s
+			case "service":
+				p.Service = s
+			case "base_url":
+				p.BaseURL = s
+			case "poll_interval":
+				if p.PollInterval, err = time.ParseDuration(s); err != nil {
+					return nil, fmt.Errorf("profile %s: invalid poll_interval: %v", name, err)
+				}
+			case "sink":
+				p.Sink = s
+			default:
+				return nil, fmt.Errorf("profile %s: unknown setting %q", name, key)
+			}
+		}
+		cfg.Profiles[name] = p
+	}
+	return cfg, nil
+}
+
+// Profile returns the named profile, or the default profile for "".
+func (c *Config) Profile(name string) (*Profile, error) {
+	if name == "" {
+		name = c.DefaultProfile
+	}
+	if name == "" {
+		return nil, nil
+	}
+	p, ok := c.Profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown profile: %s", name)
+	}
+	return p, nil
+}
+
+// credentials returns the profile's static key or key provider.
+func (p *Profile) credentials() (string, CredentialProvider) {
+	switch {
+	case p.APIKeyEnv != "":
+		return os.Getenv(p.APIKeyEnv), nil
+	case p.APIKeyFile != "":
+		return "", FileCredentials(p.APIKeyFile)
+	case p.APIKeySecret != "":
+		id, field, _ := strings.Cut(p.APIKeySecret, "#")
+		return "", SecretsManagerCredentials{SecretID: id, Field: field}
+	case p.APIKeyVault != "":
+		path, field, _ := strings.Cut(p.APIKeyVault, "#")
+		return "", VaultCredentials{Path: path, Field: field}
+	case p.APIKeyKeyring != "":
+		service, account, _ := strings.Cut(p.APIKeyKeyring, "/")
+		return "", KeyringCredentials{Service: service, Account: account}
+	}
+	return p.APIKey, nil
+}
+
+func expandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return path
+}
+
+// parseYAMLMap parses the block-mapping subset of YAML used by config files:
+// nested "key: value" mappings by indentation, quoted or plain scalars and
+// comments. Sequences, anchors and flow style are rejected.
+func parseYAMLMap(text string) (map[string]interface{}, error) {
+	type frame struct {
+		indent int // indentation of the keys in m, -1 until the first key
+		m      map[string]interface{}
+	}
+	root := map[string]interface{}{}
+	stack := []*frame{{-1, root}}
+	var pendingKey string // key whose value is the block that follows
+
+	for n, line := range strings.Split(text, "\n") {
+		if i := strings.Index(line, " #"); i >= 0 && !strings.ContainsAny(line[:i], `"'`) {
+			line = line[:i]
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if strings.HasPrefix(trimmed, "- ") || strings.ContainsAny(trimmed[:1], "[{&*|>") {
+			return nil, fmt.Errorf("line %d: only mappings and scalars are supported", n+1)
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " "))
+
+		top := stack[len(stack)-1]
+		if pendingKey != "" {
+			if indent > top.indent {
+				child := map[string]interface{}{}
+				top.m[pendingKey] = child
+				top = &frame{indent, child}
+				stack = append(stack, top)
+			} else {
+				top.m[pendingKey] = ""
+			}
+			pendingKey = ""
+		}
+		for len(stack) > 1 && indent < top.indent {
+			stack = stack[:len(stack)-1]
+			top = stack[len(stack)-1]
+		}
+		if top.indent < 0 {
+			top.indent = indent
+		}
+		if indent != top.indent {
+			return nil, fmt.Errorf("line %d: inconsistent indentation", n+1)
+		}
+
+		key, value, ok := strings.Cut(trimmed, ":")
+		if !ok {
+			return nil, fmt.Errorf("line %d: expected key: value", n+1)
+		}
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if value == "" {
+			pendingKey = key
+			continue
+		}
+		if len(value) >= 2 && value[0] == '"' && value[len(value)-1] == '"' {
+			unquoted, err := strconv.Unquote(value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", n+1, err)
+			}
+			value = unquoted
+		} else if len(value) >= 2 && value[0] == '\'' && value[len(value)-1] == '\'' {
+			value = strings.ReplaceAll(value[1:len(value)-1], "''", "'")
+		}
+		top.m[key] = value
+	}
+	if pendingKey != "" {
+		stack[len(stack)-1].m[pendingKey] = ""
+	}
+	return root, nil
+}
+
+// cliProfile is the profile selected with --profile, WACHECKER_PROFILE or
+// default_profile, if any; commands use it for their flag defaults.
+var cliProfile *Profile
+
+func defaultPollInterval() time.Duration {
+	if cliProfile != nil && cliProfile.PollInterval > 0 {
+		return cliProfile.PollInterval
+	}
+	return 5 * time.Second
+}
+
+// cliJSON is set by the global --json flag: commands print their result as
+// a single JSON document on stdout instead of text.
+var cliJSON bool
+
+// printResult writes v as JSON under --json, and runs text otherwise.
+func printResult(v interface{}, text func() error) error {
+	if !cliJSON {
+		return text()
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// Exit codes of the CLI, stable so CI jobs can branch on the outcome.
+const (
+	ExitOK         = 0
+	ExitError      = 1
+	ExitUsage      = 2
+	ExitAuth       = 3
+	ExitValidation = 4
+	ExitTaskFailed = 5
+	ExitTimeout    = 6
+
+	// ExitInterrupted follows the shell convention of 128+SIGINT.
+	ExitInterrupted = 130
+)
+
+type usageError string
+
+func (e usageError) Error() string { return string(e) }
+
+var ErrJobIncomplete = errors.New("job incomplete")
+
+var ErrRejectedNumbers = errors.New("input contains rejected numbers")
+
+func exitCode(err error) int {
+	var usage usageError
+	var apiErr *APIError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ExitOK
+	case errors.As(err, &usage):
+		return ExitUsage
+	case errors.Is(err, ErrNoAPIKey), errors.Is(err, ErrNoHealthyKeys):
+		return ExitAuth
+	case errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusUnauthorized || apiErr.StatusCode == http.StatusForbidden):
+		return ExitAuth
+	case errors.Is(err, ErrSequentialInput), errors.Is(err, ErrCostExceeded), errors.Is(err, ErrRejectedNumbers):
+		return ExitValidation
+	case errors.As(err, &apiErr) && (apiErr.StatusCode == http.StatusBadRequest || apiErr.StatusCode == http.StatusUnprocessableEntity):
+		return ExitValidation
+	case errors.Is(err, ErrTaskFailed), errors.Is(err, ErrJobIncomplete):
+		return ExitTaskFailed
+	case errors.Is(err, ErrPollLimit), errors.Is(err, ErrTaskStalled), errors.Is(err, context.DeadlineExceeded):
+		return ExitTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ExitTimeout
+	case errors.Is(err, context.Canceled):
+		return ExitInterrupted
+	}
+	return ExitError
+}
+
+var commands = map[string]func(*Checker, []string) error{
+	"preview":   previewCommand,
+	"explain":   explainCommand,
+	"download":  downloadCommand,
+	"summary":   summaryCommand,
+	"serve":     serveCommand,
+	"watch-dir": watchDirCommand,
+	"balance":   balanceCommand,
+	"check":     checkCommand,
+	"run":       checkCommand,
+	"schedule":  scheduleCommand,
+	"tasks":     tasksCommand,
+	"submit":    submitCommand,
+	"label":     labelCommand,
+	"watch":     watchCommand,
+	"validate":  validateCommand,
+	"convert":   convertCommand,
+	"resume":    resumeCommand,
+	"decrypt":   decryptCommand,
+	"purge":     purgeCommand,
+	"sheets":    sheetsCommand,
+	"ping":      pingCommand,
+}
+
+// The completion commands list the other commands, so they are registered
+// in init to avoid an initialization cycle.
+func init() {
+	commands["completion"] = completionCommand
+	commands["__complete"] = completeCommand
+}
+
+// taskCommands take a task ID as their argument and complete it from the
+// local task store.
+var taskCommands = []string{"preview", "explain", "download", "watch", "label"}
+
+var completionScripts = map[string]string{
+	"bash": `# bash completion for wachecker
+_wachecker() {
+    local cur=${COMP_WORDS[COMP_CWORD]}
+    if [ "$COMP_CWORD" -eq 1 ]; then
+        COMPREPLY=($(compgen -W "{{commands}}" -- "$cur"))
+        return
+    fi
+    case ${COMP_WORDS[1]} in
+    {{task_commands_alt}})
+        COMPREPLY=($(compgen -W "$(wachecker __complete tasks 2>/dev/null)" -- "$cur")) ;;
+    completion)
+        COMPREPLY=($(compgen -W "{{shells}}" -- "$cur")) ;;
+    *)
+        COMPREPLY=($(compgen -f -- "$cur")) ;;
+    esac
+}
+complete -o filenames -F _wachecker wachecker
+`,
+	"zsh": `#compdef wachecker
+_wachecker() {
+    if (( CURRENT == 2 )); then
+        compadd -- {{commands}}
+        return
+    fi
+    case $words[2] in
+    {{task_commands_alt}})
+        compadd -- ${(f)"$(wachecker __complete tasks 2>/dev/null)"} ;;
+    completion)
+        compadd -- {{shells}} ;;
+    *)
+        _files ;;
+    esac
+}
+if [ "$funcstack[1]" = "_wachecker" ]; then
+    _wachecker "$@"
+else
+    compdef _wachecker wachecker
+fi
+`,
+	"fish": `# fish completion for wachecker
+complete -c wachecker -f
+complete -c wachecker -n __fish_use_subcommand -a '{{commands}}'
+complete -c wachecker -n '__fish_seen_subcommand_from {{task_commands}}' -a '(wachecker __complete tasks 2>/dev/null)'
+complete -c wachecker -n '__fish_seen_subcommand_from completion' -a '{{shells}}'
+complete -c wachecker -n 'not __fish_use_subcommand; and not __fish_seen_subcommand_from {{task_commands}} completion' -F
+`,
+	"powershell": `# PowerShell completion for wachecker
+Register-ArgumentCompleter -Native -CommandName wachecker -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+    $words = @($commandAst.CommandElements | ForEach-Object { $_.ToString() })
+    if ($words.Count -lt 2 -or ($words.Count -eq 2 -and $wordToComplete)) {
+        $candidates = '{{commands}}' -split ' '
+    } elseif (('{{task_commands}}' -split ' ') -contains $words[1]) {
+        $candidates = @(wachecker __complete tasks 2>$null)
+    } elseif ($words[1] -eq 'completion') {
+        $candidates = '{{shells}}' -split ' '
+    } else {
+        return
+    }
+    $candidates | Where-Object { $_ -like "$wordToComplete*" } | ForEach-Object {
+        [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+    }
+}
+`,
+}
+
+func completionCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("completion", flag.ExitOnError)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	var shells []string
+	for shell := range completionScripts {
+		shells = append(shells, shell)
+	}
+	sort.Strings(shells)
+	if len(positional) != 1 || completionScripts[positional[0]] == "" {
+		return usageError("usage: wachecker completion " + strings.Join(shells, "|"))
+	}
+
+	var names []string
+	for name := range commands {
+		if !strings.HasPrefix(name, "__") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	script := strings.NewReplacer(
+		"{{commands}}", strings.Join(names, " "),
+		"{{task_commands}}", strings.Join(taskCommands, " "),
+		"{{task_commands_alt}}", strings.Join(taskCommands, "|"),
+		"{{shells}}", strings.Join(shells, " "),
+	).Replace(completionScripts[positional[0]])
+	_, err = io.WriteString(os.Stdout, script)
+	return err
+}
+
+// completeCommand is called by the completion scripts to list dynamic
+// candidates; errors are ignored so a broken store never breaks the shell.
+func completeCommand(checker *Checker, args []string) error {
+	if len(args) != 1 || args[0] != "tasks" || checker.taskStore == nil {
+		return nil
+	}
+	for _, rec := range checker.taskStore.List() {
+		fmt.Println(rec.TaskID)
+	}
+	return nil
+}
+
+func runCommand(checker *Checker, name string, args []string) error {
+	command, ok := commands[name]
+	if !ok {
+		return usageError("unknown command: " + name)
+	}
+	return command(checker, args)
+}
+
+// parseArgs lets flags follow positional arguments, as in
+// "wachecker preview <task-id> --n 20".
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func previewCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("preview", flag.ExitOnError)
+	n := fs.Int("n", 20, "number of result rows to show")
+	userID := fs.String("user-id", os.Getenv("WHATSAPP_USER_ID"), "user ID that owns the task")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError("usage: wachecker preview <task-id> [--n 20] [--user-id id]")
+	}
+
+	status, results, err := checker.PreviewResults(positional[0], checker.userIDFor(positional[0], *userID), *n)
+	if err != nil {
+		return err
+	}
+
+	return printResult(map[string]interface{}{"task": status, "results": results}, func() error {
+		fmt.Printf("Task %s: %s, Success: %d, Total: %d\n", status.TaskID, status.Status, status.Success, status.Total)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NUMBER\tWHATSAPP")
+		for _, result := range results {
+			fmt.Fprintf(tw, "%s\t%s\n", result.Number, result.WhatsApp)
+		}
+		if err := tw.Flush(); err != nil {
+			return err
+		}
+		fmt.Printf("Showing %d of %d rows\n", len(results), status.Total)
+		return nil
+	})
+}
+
+func explainCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("explain", flag.ExitOnError)
+	userID := fs.String("user-id", os.Getenv("WHATSAPP_USER_ID"), "user ID that owns the task")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError("usage: wachecker explain <task-id> [--user-id id]")
+	}
+
+	report, err := checker.ExplainTask(positional[0], *userID)
+	if err != nil {
+		return err
+	}
+	doc := map[string]interface{}{
+		"record":   report.Record,
+		"parent":   report.Parent,
+		"children": report.Children,
+		"events":   report.Events,
+		"current":  report.Current,
+	}
+	if report.StatusErr != nil {
+		doc["status_error"] = report.StatusErr.Error()
+	}
+	return printResult(doc, func() error { return report.WriteText(os.Stdout) })
+}
+
+// labelFlag collects repeated --label key=value flags.
+type labelFlag map[string]string
+
+func (l labelFlag) String() string { return formatLabels(l) }
+
+func (l labelFlag) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("label must be key=value: %q", value)
+	}
+	l[key] = val
+	return nil
+}
+
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func tasksCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("tasks", flag.ExitOnError)
+	selector := labelFlag{}
+	fs.Var(selector, "label", "only list tasks with this key=value label (repeatable)")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+	if checker.taskStore == nil {
+		return errors.New("no task store configured")
+	}
+
+	records := checker.taskStore.ListTasks(selector)
+	return printResult(records, func() error {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tTASK\tSTATUS\tTOTAL\tCREATED\tLABELS")
+		for _, rec := range records {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", rec.DisplayName(), rec.TaskID, rec.Status, rec.Total,
+				rec.CreatedAt.Format(time.RFC3339), formatLabels(rec.Labels))
+		}
+		return tw.Flush()
+	})
+}
+
+func labelCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("label", flag.ExitOnError)
+	name := fs.String("name", "", "task name")
+	labels := labelFlag{}
+	fs.Var(labels, "label", "key=value label to set, key= to remove (repeatable)")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 || (*name == "" && len(labels) == 0) {
+		return usageError("usage: wachecker label <task-id> [--name name] [--label key=value ...]")
+	}
+	if checker.taskStore == nil {
+		return errors.New("no task store configured")
+	}
+	if err := checker.taskStore.Label(positional[0], *name, labels); err != nil {
+		return err
+	}
+	rec, _ := checker.taskStore.Get(positional[0])
+	return printResult(rec, func() error { return nil })
+}
+
+func downloadCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("download", flag.ExitOnError)
+	userID := fs.String("user-id", os.Getenv("WHATSAPP_USER_ID"), "user ID that owns the task")
+	output := fs.String("o", "", "output file (default <task-id>.xlsx, or .csv with PII hashing)")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError("usage: wachecker download <task-id> [-o file] [--user-id id]")
+	}
+
+	taskID := positional[0]
+	if *output == "" {
+		*output = taskID + checker.resultsExt()
+	}
+
+	status, err := checker.DownloadTask(context.Background(), taskID, *userID, *output)
+	if err != nil {
+		return err
+	}
+	return printResult(map[string]interface{}{"task": status, "output": *output}, func() error {
+		fmt.Printf("Results saved to: %s\n", *output)
+		return nil
+	})
+}
+
+func summaryCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("summary", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "print the summary as JSON")
+	htmlPath := fs.String("html", "", "also write an HTML report to this file")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError("usage: wachecker summary <results.xlsx> [--json] [--html report.html]")
+	}
+
+	results, err := ParseResultsFile(positional[0])
+	if err != nil {
+		return err
+	}
+	summary := Summarize(results)
+	if *htmlPath != "" {
+		file, err := os.Create(*htmlPath)
+		if err != nil {
+			return fmt.Errorf("failed to create report: %v", err)
+		}
+		defer file.Close()
+		if err := summary.WriteHTML(file, "WhatsApp check: "+filepath.Base(positional[0])); err != nil {
+			return fmt.Errorf("failed to write report: %v", err)
+		}
+	}
+	if *asJSON || cliJSON {
+		return summary.WriteJSON(os.Stdout)
+	}
+	return summary.WriteText(os.Stdout)
+}
+
+func sheetsCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("sheets", flag.ExitOnError)
+	spreadsheet := fs.String("spreadsheet", "", "ID of an existing spreadsheet to append to; default creates one")
+	title := fs.String("title", "", "title of a new spreadsheet")
+	summaryOnly := fs.Bool("summary-only", false, "write only the summary tab, without numbers")
+	token := fs.String("token", os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"), "OAuth access token with the spreadsheets scope")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError("usage: wachecker sheets <results.xlsx> [--spreadsheet ID] [--title name] [--summary-only]")
+	}
+	if *token == "" {
+		return usageError("--token or GOOGLE_OAUTH_ACCESS_TOKEN is required, e.g. from gcloud auth print-access-token")
+	}
+
+	results, err := ParseResultsFile(positional[0])
+	if err != nil {
+		return err
+	}
+	sw := NewSheetsWriter(*token, *spreadsheet)
+	sw.SummaryOnly = *summaryOnly
+	if *title != "" {
+		sw.Title = *title
+	}
+	if !sw.SummaryOnly {
+		results = checker.redactResults(results)
+	}
+	if _, err := sw.Write(results); err != nil {
+		return err
+	}
+	return printResult(map[string]interface{}{"spreadsheet_id": sw.SpreadsheetID, "url": sw.SpreadsheetURL(), "results": len(results)}, func() error {
+		fmt.Printf("Wrote %d results to %s\n", len(results), sw.SpreadsheetURL())
+		return nil
+	})
+}
+
+func serveCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("serve", flag.ExitOnError)
+	addr := fs.String("addr", ":8080", "address to listen on")
+	token := fs.String("token", os.Getenv("WACHECKER_SERVER_TOKEN"), "bearer token clients must present")
+	drain := fs.Duration("drain", 5*time.Second, "on SIGTERM, fail /readyz this long before shutting down")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	server := NewServer(checker)
+	server.Token = *token
+	if server.Token == "" {
+		log.Printf("WARNING: serving without a bearer token; anyone who can reach %s can spend API credits", *addr)
+	}
+
+	log.Printf("Listening on %s", *addr)
+	srv := &http.Server{Addr: *addr, Handler: server, ReadHeaderTimeout: 10 * time.Second}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errc := make(chan error, 1)
+	go func() { errc <- srv.ListenAndServe() }()
+
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
 	}
+	log.Printf("Shutting down, draining for %s", *drain)
+	server.Drain()
+	time.Sleep(*drain)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	return srv.Shutdown(shutdownCtx)
 }
 
-func (wc *WhatsAppChecker) UploadFile(filePath string) (*WhatsAppResponse, error) {
-	file, err := os.Open(filePath)
+// lambdaMain picks the handler from the function's configured handler name,
+// "submit" or "complete", and reads its resources from the environment.
+func lambdaMain(checker *Checker) error {
+	tasks, err := NewDynamoTableFromEnv(os.Getenv("WACHECKER_TASKS_TABLE"))
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %v", err)
+		return err
+	}
+	h := &LambdaHandler{Checker: checker, Tasks: tasks, ResultKey: os.Getenv("WACHECKER_RESULTS_KEY")}
+	if h.Inputs, err = NewS3StoreFromEnv(""); err != nil {
+		return err
+	}
+	if bucket := os.Getenv("WACHECKER_RESULTS_BUCKET"); bucket != "" {
+		if h.Results, err = NewS3StoreFromEnv(bucket); err != nil {
+			return err
+		}
 	}
-	defer file.Close()
 
-	var buf bytes.Buffer
-	writer := multipart.NewWriter(&buf)
+	switch name := os.Getenv("_HANDLER"); name {
+	case "submit":
+		return RunLambda(h.Submit)
+	case "complete":
+		return RunLambda(h.Complete)
+	default:
+		return fmt.Errorf("unknown handler %q, expected submit or complete", name)
+	}
+}
 
-	part, err := writer.CreateFormFile("file", filepath.Base(filePath))
+func watchDirCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("watch-dir", flag.ExitOnError)
+	every := fs.Duration("every", 10*time.Second, "how often to scan the directory")
+	poll := fs.Duration("poll", defaultPollInterval(), "task status poll interval")
+	positional, err := parseArgs(fs, args)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create form file: %v", err)
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError("usage: wachecker watch-dir <dir> [--every 10s] [--poll 5s]")
 	}
 
-	_, err = io.Copy(part, file)
-	if err != nil {
-		return nil, fmt.Errorf("failed to copy file: %v", err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	folder := NewDropFolder(checker, positional[0])
+	folder.ScanInterval, folder.PollInterval = *every, *poll
+	log.Printf("Watching %s for .txt and .csv files", folder.Dir)
+	if err := folder.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		return err
 	}
+	return nil
+}
 
-	err = writer.Close()
+func scheduleCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("schedule", flag.ExitOnError)
+	name := fs.String("name", "recheck", "job name, used in result task IDs")
+	poll := fs.Duration("poll", 30*time.Second, "task status poll interval")
+	positional, err := parseArgs(fs, args)
 	if err != nil {
-		return nil, fmt.Errorf("failed to close writer: %v", err)
+		return err
+	}
+	if len(positional) != 3 {
+		return usageError(`usage: wachecker schedule "<cron>" <source> <sink> [--name recheck]` + "\n" +
+			`  e.g. wachecker schedule "0 2 * * *" s3:bucket/numbers.csv file:/data/{task_id}.csv`)
 	}
 
-	req, err := http.NewRequest("POST", wc.baseURL, &buf)
+	source, err := OpenSource(positional[1])
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
+		return err
+	}
+	sink, err := OpenSink(positional[2])
+	if err != nil {
+		return err
+	}
+
+	scheduler := NewScheduler(checker)
+	scheduler.PollInterval = *poll
+	if err := scheduler.Add(*name, positional[0], source, sink); err != nil {
+		return err
 	}
 
-	req.Header.Set("Content-Type", writer.FormDataContentType())
-	req.Header.Set("X-API-Key", wc.apiKey)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := scheduler.Run(ctx); err != nil && !errors.Is(err, context.Canceled) {
+		return err
+	}
+	return nil
+}
 
-	resp, err := wc.httpClient.Do(req)
+func submitCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("submit", flag.ExitOnError)
+	perFile := fs.Bool("per-file", false, "submit one task per file instead of one merged task")
+	positional, err := parseArgs(fs, args)
 	if err != nil {
-		return nil, fmt.Errorf("request failed: %v", err)
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError("usage: wachecker submit <file|dir|archive.zip> [--per-file]")
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP error: %d", resp.StatusCode)
+	tasks, err := checker.SubmitInputs(context.Background(), positional[0], *perFile)
+	if perr := printResult(tasks, func() error {
+		for _, task := range tasks {
+			fmt.Printf("Task %s submitted (%s)\n", task.TaskID, task.Status)
+		}
+		return nil
+	}); err == nil {
+		err = perr
 	}
+	return err
+}
 
-	var result WhatsAppResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %v", err)
+func balanceCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("balance", flag.ExitOnError)
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
 	}
 
-	return &result, nil
+	usage, err := checker.GetUsage(context.Background())
+	if err != nil {
+		return err
+	}
+	return printResult(usage, func() error {
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintf(tw, "Balance:\t%.2f %s\n", usage.Balance, usage.Currency)
+		if usage.Quota > 0 {
+			fmt.Fprintf(tw, "Quota:\t%d\n", usage.Quota)
+			fmt.Fprintf(tw, "Used:\t%d\n", usage.Used)
+			fmt.Fprintf(tw, "Remaining:\t%d\n", usage.Remaining)
+		}
+		return tw.Flush()
+	})
 }
 
-func (wc *WhatsAppChecker) CheckTaskStatus(taskID, userID string) (*WhatsAppResponse, error) {
-	url := fmt.Sprintf("%s/%s?user_id=%s", wc.baseURL, taskID, userID)
+func pingCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("ping", flag.ExitOnError)
+	timeout := fs.Duration("timeout", 10*time.Second, "give up after this long")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
 
-	req, err := http.NewRequest("GET", url, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	result, err := checker.Ping(ctx)
 	if err != nil {
-		return nil, fmt.Errorf("failed to create request: %v", err)
+		return err
 	}
+	return printResult(result, func() error {
+		fmt.Printf("OK %s in %s\n", result.Endpoint, result.Latency.Round(time.Millisecond))
+		return nil
+	})
+}
 
-	req.Header.Set("X-API-Key", wc.apiKey)
-
-	resp, err := wc.httpClient.Do(req)
+func checkCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("check", flag.ExitOnError)
+	chunkSize := fs.Int("chunk", 1000, "numbers per uploaded task")
+	parallel := fs.Int("parallel", 1, "chunks to upload and poll at the same time")
+	poll := fs.Duration("poll", defaultPollInterval(), "task status poll interval")
+	output := fs.String("o", "", "write results to this file (.csv, .json, .ndjson, optionally .gz), - for stdout")
+	format := fs.String("format", "csv", "result format when writing to stdout: csv, json or ndjson")
+	wait := fs.Bool("wait", true, "wait for results; with --wait=false print the task IDs and exit")
+	dryRun := fs.Bool("dry-run", false, "show what would be uploaded without calling the API")
+	incremental := fs.String("incremental", "", "reuse results from the local history newer than this, e.g. 30d")
+	dbPath := fs.String("db", os.Getenv("WACHECKER_DB"), "also store results in this SQLite database (needs whatsapp_checker_go_integrations.go)")
+	positional, err := parseArgs(fs, args)
 	if err != nil {
-		return nil, fmt.Errorf("request failed: %v", err)
+		return err
+	}
+	input := "-"
+	if len(positional) == 1 {
+		input = positional[0]
+	} else if len(positional) > 1 || stdinIsTerminal() {
+		return usageError("usage: wachecker check <numbers.txt|.csv|.xlsx|-> [-o results.csv|-] [--format csv] [--chunk 1000] [--parallel 4] [--wait] [--dry-run] [--incremental 30d] [--db results.db]")
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("HTTP error: %d", resp.StatusCode)
+	// Results may be streamed to stdout, so progress goes to stderr.
+	checker.statusOut = os.Stderr
+
+	var numbers []string
+	if input == "-" {
+		data, err := io.ReadAll(os.Stdin)
+		if err != nil {
+			return fmt.Errorf("failed to read stdin: %v", err)
+		}
+		numbers, err = numbersFromBytes("stdin.txt", data)
+		if err != nil {
+			return err
+		}
+	} else if numbers, err = LoadNumbersFile(input); err != nil {
+		return err
+	}
+	if *dryRun {
+		checker.dryRun = true
 	}
 
-	var result WhatsAppResponse
-	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-		return nil, fmt.Errorf("failed to decode response: %v", err)
+	var dbSink Sink
+	if *dbPath != "" && !checker.dryRun {
+		if dbSink, err = OpenSink("sqlite:" + *dbPath); err != nil {
+			return err
+		}
+		if c, ok := dbSink.(io.Closer); ok {
+			defer c.Close()
+		}
 	}
 
-	return &result, nil
-}
+	var inc *IncrementalChecker
+	var reused Results
+	allNumbers := numbers
+	if *incremental != "" {
+		staleness, err := parseRetention(*incremental)
+		if err != nil {
+			return usageError("invalid --incremental: " + err.Error())
+		}
+		history, err := OpenFileHistory(DefaultHistoryPath())
+		if err != nil {
+			return err
+		}
+		inc = NewIncrementalChecker(checker, history, staleness)
+		var report *IncrementalReport
+		reused, numbers, report = inc.Split(numbers)
+		fmt.Fprintf(os.Stderr, "Incremental check: %s\n", report)
+	}
 
-func (wc *WhatsAppChecker) PollTaskStatus(taskID, userID string, interval time.Duration) (*WhatsAppResponse, error) {
-	for {
-		resp, err := wc.CheckTaskStatus(taskID, userID)
+	if !*wait && !checker.dryRun {
+		var tasks []*WhatsAppResponse
+		for start := 0; start < len(numbers); start += *chunkSize {
+			task, err := checker.uploadNumbers(context.Background(), numbers[start:min(start+*chunkSize, len(numbers))], UploadOptions{})
+			if err != nil {
+				return err
+			}
+			if !cliJSON {
+				fmt.Println(task.TaskID)
+			}
+			tasks = append(tasks, task)
+		}
+		return printResult(tasks, func() error { return nil })
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	checker.parallelChunks = *parallel
+	job, err := checker.RunJobContext(ctx, numbers, *chunkSize, *poll)
+	if err != nil {
+		return err
+	}
+	if job.Interrupted {
+		return handOff(job)
+	}
+	if job.Plan != nil {
+		return printResult(job.Plan, func() error {
+			fmt.Println("Dry run, nothing will be uploaded.")
+			return job.Plan.WriteText(os.Stdout)
+		})
+	}
+	if job.RemoteSkipped {
+		return nil
+	}
+
+	var results Results
+	for _, chunk := range job.Chunks {
+		if chunk.Err != nil || chunk.Response.ResultURL == "" {
+			continue
+		}
+		chunkResults, err := checker.FetchResults(chunk.Response.ResultURL)
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("failed to fetch results for %s: %v", chunk.Range, err)
+		}
+		if dbSink != nil {
+			if err := dbSink.WriteResults(context.Background(), chunk.Response.TaskID, checker.redactResults(chunkResults)); err != nil {
+				return err
+			}
+		}
+		results = append(results, chunkResults...)
+	}
+	if inc != nil {
+		if err := inc.Record(results); err != nil {
+			return err
+		}
+		results = inInputOrder(allNumbers, append(reused, results...))
+	}
+
+	if *output == "" && cliProfile != nil && cliProfile.Sink != "" {
+		sink, err := OpenSink(cliProfile.Sink)
+		if err != nil {
+			return err
+		}
+		taskID := "job"
+		for _, chunk := range job.Chunks {
+			if chunk.Response != nil {
+				taskID = chunk.Response.TaskID
+				break
+			}
+		}
+		if err := checker.bindSink(sink).WriteResults(context.Background(), taskID, checker.redactResults(results)); err != nil {
+			return fmt.Errorf("failed to write results to %s: %v", cliProfile.Sink, err)
+		}
+		fmt.Fprintf(os.Stderr, "Results written to %s\n", cliProfile.Sink)
+	} else if *output != "" && *output != "-" {
+		if err := checker.ExportResultsFile(results, *output); err != nil {
+			return err
+		}
+		if err := printResult(map[string]interface{}{"output": *output, "results": len(results)}, func() error {
+			fmt.Fprintf(os.Stderr, "Results saved to: %s\n", *output)
+			return nil
+		}); err != nil {
+			return err
 		}
+	} else {
+		if cliJSON && !flagPassed(fs, "format") {
+			*format = "json"
+		}
+		if err := checker.redactResults(results).Export(os.Stdout, *format, ""); err != nil {
+			return err
+		}
+	}
+	if len(job.Missing) > 0 {
+		return fmt.Errorf("%w, no results for %v", ErrJobIncomplete, job.Missing)
+	}
+	if job.Truncated != nil {
+		return fmt.Errorf("job truncated, %s not submitted: %s", job.Truncated, job.TruncateReason)
+	}
+	return nil
+}
+
+func resumeCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("resume", flag.ExitOnError)
+	poll := fs.Duration("poll", defaultPollInterval(), "task status poll interval")
+	outputDir := fs.String("o", ".", "directory to download results to, as <task-id>.xlsx (.csv with PII hashing)")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageError("usage: wachecker resume [-o dir] [--poll 5s]")
+	}
 
-		fmt.Printf("Status: %s, Success: %d, Total: %d\n", resp.Status, resp.Success, resp.Total)
+	checker.statusOut = os.Stderr
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	resumed, err := checker.ResumeAll(ctx, *poll)
+	if err != nil {
+		return err
+	}
 
-		switch resp.Status {
-		case "exported":
-			fmt.Printf("Results available at: %s\n", resp.ResultURL)
-			return resp, nil
-		case "failed":
-			return nil, fmt.Errorf("task failed")
-		default:
-			time.Sleep(interval)
+	var pending []string
+	var errs []error
+	outputs := make(map[string]string)
+	for _, task := range resumed {
+		id := task.Record.TaskID
+		if task.Err == nil {
+			output := filepath.Join(*outputDir, id+checker.resultsExt())
+			if _, task.Err = checker.DownloadTask(ctx, id, task.Record.UserID, output); task.Err == nil {
+				outputs[id] = output
+				continue
+			}
 		}
+		if ctx.Err() != nil {
+			pending = append(pending, id)
+		} else {
+			errs = append(errs, fmt.Errorf("task %s: %w", id, task.Err))
+		}
+	}
+	if err := printResult(outputs, func() error {
+		if len(resumed) == 0 {
+			fmt.Println("No unfinished tasks.")
+		}
+		for _, id := range sortedKeys(outputs) {
+			fmt.Printf("Task %s: results saved to %s\n", id, outputs[id])
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	if len(pending) > 0 {
+		return fmt.Errorf("interrupted, tasks %v left running, run resume again to continue: %w", pending, context.Canceled)
 	}
+	return errors.Join(errs...)
 }
 
-func (wc *WhatsAppChecker) CreateInputFile(phoneNumbers []string, filePath string) error {
-	content := strings.Join(phoneNumbers, "\n")
-	return os.WriteFile(filePath, []byte(content), 0644)
+func purgeCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("purge", flag.ExitOnError)
+	olderThan := fs.String("older-than", "", "retention window, e.g. 720h or 30d")
+	dryRun := fs.Bool("dry-run", false, "list what would be removed without deleting")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	retention, err := parseRetention(*olderThan)
+	if err != nil || len(positional) != 0 {
+		return usageError("usage: wachecker purge --older-than 30d [--dry-run]")
+	}
+	if *dryRun {
+		checker.dryRun = true
+	}
+
+	summary, err := checker.Purge(retention)
+	if err != nil {
+		return err
+	}
+	return printResult(summary, func() error {
+		if checker.dryRun {
+			fmt.Println("Dry run, nothing was deleted.")
+		}
+		return summary.WriteText(os.Stdout)
+	})
 }
 
-func (wc *WhatsAppChecker) CreateInputFileFromString(content, filePath string) error {
-	return os.WriteFile(filePath, []byte(content), 0644)
+// parseRetention accepts Go durations plus a "d" suffix for days.
+func parseRetention(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid retention: %q", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err == nil && d <= 0 {
+		err = fmt.Errorf("invalid retention: %q", value)
+	}
+	return d, err
 }
 
-func (wc *WhatsAppChecker) DownloadResults(resultURL, outputPath string) error {
-	resp, err := http.Get(resultURL)
+func decryptCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	output := fs.String("o", "", "output file (default: input without .enc), - for stdout")
+	positional, err := parseArgs(fs, args)
 	if err != nil {
-		return fmt.Errorf("failed to download results: %v", err)
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError("usage: wachecker decrypt <results.xlsx.enc> [-o file|-]")
 	}
-	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("HTTP error: %d", resp.StatusCode)
+	key, err := checker.encryptionKey(context.Background())
+	if err != nil {
+		return err
+	}
+	if key == nil {
+		return fmt.Errorf("%w, set WACHECKER_ENCRYPTION_KEY", ErrNoEncryptionKey)
+	}
+
+	input := positional[0]
+	if *output == "" {
+		*output = strings.TrimSuffix(input, ".enc")
+		if *output == input {
+			return usageError("input has no .enc suffix, pass -o")
+		}
+	}
+	if *output != "-" {
+		return DecryptFile(input, *output, key)
 	}
 
-	file, err := os.Create(outputPath)
+	file, err := os.Open(input)
 	if err != nil {
-		return fmt.Errorf("failed to create output file: %v", err)
+		return fmt.Errorf("failed to open file: %v", err)
 	}
 	defer file.Close()
+	r, err := NewDecryptReader(bufio.NewReader(file), key)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(os.Stdout, r)
+	return err
+}
 
-	_, err = io.Copy(file, resp.Body)
+func convertCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("convert", flag.ExitOnError)
+	to := fs.String("to", "csv", "output format: csv, json, ndjson or parquet (needs whatsapp_checker_go_integrations.go)")
+	output := fs.String("o", "-", "output file, format and compression taken from the name; - for stdout")
+	positional, err := parseArgs(fs, args)
 	if err != nil {
-		return fmt.Errorf("failed to write to file: %v", err)
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError("usage: wachecker convert <results.xlsx> [--to csv|json|ndjson|parquet] [-o results.csv.gz|-]")
+	}
+
+	results, err := ParseResultsFile(positional[0])
+	if err != nil {
+		return err
+	}
+	if *output == "-" {
+		return results.Export(os.Stdout, *to, "")
+	}
+	if format, _ := exportFormatFromPath(*output); flagPassed(fs, "to") && format != *to && !(format == "jsonl" && *to == "ndjson") {
+		return usageError(fmt.Sprintf("--to %s does not match output file %s", *to, *output))
+	}
+	if err := checker.ExportResultsFile(results, *output); err != nil {
+		return err
+	}
+	return printResult(map[string]interface{}{"output": *output, "results": len(results)}, func() error {
+		fmt.Fprintf(os.Stderr, "Converted %d results to %s\n", len(results), *output)
+		return nil
+	})
+}
+
+func validateCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	region := fs.String("region", "", "country of national numbers without a calling code, e.g. NL")
+	assumeIntl := fs.Bool("assume-international", false, "restore a lost + on digit-only international numbers")
+	rejects := fs.String("rejects", "", "write rejected values to this CSV file")
+	output := fs.String("o", "", "write the unique, repaired numbers to this file")
+	strict := fs.Bool("strict", false, "fail when any value is rejected")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError("usage: wachecker validate <numbers.txt|.csv|.xlsx> [--region NL] [--assume-international] [--rejects rejects.csv] [-o clean.txt] [--strict]")
 	}
 
+	loader := NumberLoader{Repair: RepairOptions{AssumeInternational: *assumeIntl}}
+	if *region != "" {
+		code, ok := CallingCodeForCountry(*region)
+		if !ok {
+			return usageError("unknown region: " + *region)
+		}
+		loader.Repair.DefaultCallingCode = code
+	}
+
+	numbers, report, err := loader.Preflight(positional[0])
+	if err != nil {
+		return err
+	}
+	if checker.piiSalt != nil {
+		report.ValidationReport = report.Hashed(checker.piiSalt)
+	}
+	if *rejects != "" {
+		if err := report.WriteRejectsFile(*rejects); err != nil {
+			return err
+		}
+	}
+	if *output != "" {
+		if err := checker.CreateInputFile(numbers, *output); err != nil {
+			return err
+		}
+	}
+	if err := printResult(report, func() error { return report.WriteText(os.Stdout) }); err != nil {
+		return err
+	}
+	if n := report.Count(ActionRejected); *strict && n > 0 {
+		return fmt.Errorf("%w: %d of %s", ErrRejectedNumbers, n, positional[0])
+	}
 	return nil
 }
 
+func watchCommand(checker *Checker, args []string) error {
+	fs := flag.NewFlagSet("watch", flag.ExitOnError)
+	userID := fs.String("user-id", os.Getenv("WHATSAPP_USER_ID"), "user ID that owns the task")
+	poll := fs.Duration("poll", defaultPollInterval(), "task status poll interval")
+	plain := fs.Bool("plain", false, "print one line per poll instead of a progress bar")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageError("usage: wachecker watch <task-id> [--poll 5s] [--user-id id] [--plain]")
+	}
+
+	bar := &progressBar{w: os.Stderr, tty: !*plain && !cliJSON && isTerminal(os.Stderr), width: 30}
+	checker.statusOut = io.Discard
+	onProgress := checker.onProgress
+	checker.onProgress = func(ev ProgressEvent) {
+		bar.Update(ev)
+		if onProgress != nil {
+			onProgress(ev)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	status, err := checker.PollTaskStatusContext(ctx, positional[0], *userID, *poll)
+	bar.Finish()
+	if err != nil && ctx.Err() != nil {
+		checker.recordEvent(positional[0], "detached", "watch interrupted, task left running")
+		return handOff(&JobResult{
+			Interrupted: true,
+			Chunks:      []ChunkResult{{Response: &WhatsAppResponse{TaskID: positional[0], UserID: *userID}, Err: err}},
+		})
+	}
+	if err != nil {
+		return err
+	}
+	return printResult(status, func() error {
+		fmt.Printf("Results available at: %s\n", status.ResultURL)
+		return nil
+	})
+}
+
+// handOff tells the user how to pick up an interrupted job: tasks already
+// submitted keep running on the server and are recorded in the task store.
+func handOff(job *JobResult) error {
+	var pending []string
+	for _, chunk := range job.Chunks {
+		if chunk.Response == nil {
+			continue
+		}
+		resume := "wachecker download " + chunk.Response.TaskID
+		if chunk.Err != nil {
+			resume = "wachecker watch " + chunk.Response.TaskID
+			if chunk.Response.UserID != "" {
+				resume += " --user-id " + chunk.Response.UserID
+			}
+			pending = append(pending, chunk.Response.TaskID)
+		}
+		if !cliJSON {
+			fmt.Fprintf(os.Stderr, "Task %s (%s): %s\n", chunk.Response.TaskID, chunk.Range, resume)
+		}
+	}
+	if job.Truncated != nil && !cliJSON {
+		fmt.Fprintf(os.Stderr, "Not submitted: %s\n", job.Truncated)
+	}
+	return fmt.Errorf("interrupted, tasks %v left running: %w", pending, context.Canceled)
+}
+
+// progressBar renders ProgressEvents as a single redrawn line on a
+// terminal, or as one plain log line per poll otherwise.
+type progressBar struct {
+	w     io.Writer
+	tty   bool
+	width int
+	drawn bool
+}
+
+func (pb *progressBar) Update(ev ProgressEvent) {
+	var pct float64
+	if ev.Total > 0 {
+		pct = min(float64(ev.Success)/float64(ev.Total), 1) * 100
+	}
+	stats := fmt.Sprintf("%5.1f%% %d/%d", pct, ev.Success, ev.Total)
+	if ev.Rate > 0 {
+		stats += fmt.Sprintf(", %.1f/s", ev.Rate)
+	}
+	if ev.ETA > 0 {
+		stats += ", ETA " + ev.ETA.Round(time.Second).String()
+	}
+
+	if !pb.tty {
+		log.Printf("%s %s %s", ev.TaskID, ev.Status, stats)
+		return
+	}
+	filled := int(pct / 100 * float64(pb.width))
+	bar := strings.Repeat("=", filled) + strings.Repeat(" ", pb.width-filled)
+	fmt.Fprintf(pb.w, "\r\x1b[K%-10s [%s] %s", ev.Status, bar, stats)
+	pb.drawn = true
+}
+
+// Finish ends the bar's line so later output starts on a fresh one.
+func (pb *progressBar) Finish() {
+	if pb.drawn {
+		fmt.Fprintln(pb.w)
+	}
+}
+
+func flagPassed(fs *flag.FlagSet, name string) bool {
+	passed := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			passed = true
+		}
+	})
+	return passed
+}
+
+func stdinIsTerminal() bool {
+	info, err := os.Stdin.Stat()
+	return err != nil || info.Mode()&os.ModeCharDevice != 0
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
 func main() {
+	var args []string
+	profileName := os.Getenv("WACHECKER_PROFILE")
+	for i := 1; i < len(os.Args); i++ {
+		switch arg := os.Args[i]; {
+		case arg == "--json" || arg == "-json":
+			cliJSON = true
+		case (arg == "--profile" || arg == "-profile") && i+1 < len(os.Args):
+			i++
+			profileName = os.Args[i]
+		case strings.HasPrefix(arg, "--profile="):
+			profileName = strings.TrimPrefix(arg, "--profile=")
+		default:
+			args = append(args, arg)
+		}
+	}
+
+	configPath := DefaultConfigPath()
+	if cfg, err := LoadConfig(configPath); err == nil {
+		if cliProfile, err = cfg.Profile(profileName); err != nil {
+			log.Print(err)
+			os.Exit(ExitUsage)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) || profileName != "" {
+		log.Fatalf("Config %s: %v", configPath, err)
+	}
+
 	apiKey := os.Getenv("WHATSAPP_API_KEY")
-	if apiKey == "" {
-		apiKey = "YOUR_API_KEY"
+	credentials := credentialsFromEnv()
+	if apiKey == "" && credentials == nil && os.Getenv("WHATSAPP_API_KEYS") == "" && cliProfile != nil {
+		apiKey, credentials = cliProfile.credentials()
+	}
+	if apiKey == "" && credentials == nil && os.Getenv("WHATSAPP_API_KEYS") == "" {
+		log.Println("WHATSAPP_API_KEY is not set: running local validation only, remote checks are skipped")
+	}
+
+	var opts []Option
+	if credentials != nil {
+		opts = append(opts, WithCredentials(credentials))
+	}
+	if keys := os.Getenv("WHATSAPP_API_KEYS"); keys != "" {
+		opts = append(opts, WithKeyPool(NewKeyPool(strings.Split(keys, ",")...)))
+	}
+	if path := os.Getenv("WACHECKER_AUDIT_LOG"); path != "" {
+		audit, file, err := OpenAuditLog(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer file.Close()
+		opts = append(opts, WithAuditLog(audit))
+	}
+	if salt := os.Getenv("WACHECKER_PII_SALT"); salt != "" {
+		opts = append(opts, WithPIIHashing([]byte(salt)))
+	}
+	if keys := encryptionKeysFromEnv(); keys != nil {
+		opts = append(opts, WithEncryption(keys))
+	}
+	if store, err := OpenTaskStore(DefaultTaskStorePath()); err != nil {
+		log.Printf("Task store unavailable: %v", err)
+	} else {
+		opts = append(opts, WithTaskStore(store))
+	}
+
+	service := os.Getenv("WACHECKER_SERVICE")
+	baseURL := os.Getenv("WACHECKER_BASE_URL")
+	if cliProfile != nil {
+		service = cmp.Or(service, cliProfile.Service)
+		baseURL = cmp.Or(baseURL, cliProfile.BaseURL)
+	}
+	if urls := strings.Split(baseURL, ","); len(urls) > 1 {
+		opts = append(opts, WithEndpointPool(NewEndpointPool(urls...)))
+	} else if baseURL != "" {
+		opts = append(opts, WithBaseURL(baseURL))
+	}
+	checker := NewServiceChecker(cmp.Or(service, ServiceWhatsApp), apiKey, opts...)
+
+	if os.Getenv("AWS_LAMBDA_RUNTIME_API") != "" {
+		if err := lambdaMain(checker); err != nil {
+			log.Fatalf("Lambda runtime: %v", err)
+		}
+		return
 	}
 
-	checker := NewWhatsAppChecker(apiKey)
+	if len(args) > 0 {
+		if err := runCommand(checker, args[0], args[1:]); err != nil {
+			code := exitCode(err)
+			if cliJSON {
+				json.NewEncoder(os.Stdout).Encode(map[string]interface{}{"error": err.Error(), "exit_code": code})
+			} else {
+				log.Printf("%s failed: %v", args[0], err)
+			}
+			os.Exit(code)
+		}
+		return
+	}
 
 	// Example phone numbers
 	phoneNumbers := []string{
@@ -191,6 +11413,17 @@ func main() {
 		"+1122334455",
 	}
 
+	if checker.LocalOnly() {
+		results, err := checker.CheckNumbers(phoneNumbers, 5*time.Second)
+		if err != nil {
+			log.Fatalf("Local check failed: %v", err)
+		}
+		if err := Summarize(results).WriteText(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	// Create input file
 	inputFile := "input.txt"
 	err := checker.CreateInputFile(phoneNumbers, inputFile)
@@ -220,7 +11453,7 @@ func main() {
 	// Download results if available
 	if finalResponse.ResultURL != "" {
 		fmt.Println("Downloading results...")
-		resultsFile := "whatsapp_results.xlsx"
+		resultsFile := "whatsapp_results" + checker.resultsExt()
 		err := checker.DownloadResults(finalResponse.ResultURL, resultsFile)
 		if err != nil {
 			log.Printf("Failed to download results: %v", err)
@@ -0,0 +1,798 @@
+package main
+
+// This file holds the integrations that speak third-party wire formats
+// without their SDKs: Parquet export, the Redis result cache and the
+// database/sql sources and sinks. whatsapp_checker_go.go runs without it;
+// build both files together to enable them:
+//
+//	go run examples/whatsapp_checker_go.go examples/whatsapp_checker_go_integrations.go
+
+import (
+	"bufio"
+	"bytes"
+	"cmp"
+	"context"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	RegisterExporter("parquet", func(rs Results, w io.Writer) error {
+		return rs.ExportParquet(w, "", time.Now())
+	})
+	RegisterSource("sql", newSQLSource)
+	RegisterSink("postgres", newPostgresSink)
+	RegisterSink("sqlite", newResultDBSink)
+}
+
+// Parquet physical and converted types used by ExportParquet.
+const (
+	parquetInt64     = 2
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetTimestampMillis = 9
+)
+
+// parquetSchema is the stable column layout of ExportParquet. All columns
+// are required; unknown values are empty strings.
+var parquetSchema = []struct {
+	name      string
+	typ       int32
+	converted int32
+}{
+	{"number", parquetByteArray, parquetUTF8},
+	{"status", parquetByteArray, parquetUTF8},
+	{"country", parquetByteArray, parquetUTF8},
+	{"task_id", parquetByteArray, parquetUTF8},
+	{"checked_at", parquetInt64, parquetTimestampMillis},
+}
+
+// ExportParquet writes results as an uncompressed Parquet file with one row
+// group and the columns number, status, country, task_id and checked_at
+// (UTC milliseconds), in that order. Country falls back to the number's
+// calling code when results were not enriched.
+func (rs Results) ExportParquet(w io.Writer, taskID string, checkedAt time.Time) error {
+	pages := make([][]byte, len(parquetSchema))
+	for _, r := range rs {
+		country := r.Country
+		if country == "" {
+			country = CountryForNumber(NormalizeNumber(r.Number))
+		}
+		for i, v := range []string{r.Number, r.WhatsApp, country, taskID} {
+			pages[i] = binary.LittleEndian.AppendUint32(pages[i], uint32(len(v)))
+			pages[i] = append(pages[i], v...)
+		}
+		pages[4] = binary.LittleEndian.AppendUint64(pages[4], uint64(checkedAt.UnixMilli()))
+	}
+
+	file := []byte("PAR1")
+	offsets := make([]int64, len(pages))
+	sizes := make([]int64, len(pages))
+	for i, page := range pages {
+		header := newThriftCompact()
+		header.I32(1, 0) // DATA_PAGE
+		header.I32(2, int32(len(page)))
+		header.I32(3, int32(len(page)))
+		header.Struct(5)
+		header.I32(1, int32(len(rs)))
+		header.I32(2, 0) // PLAIN
+		header.I32(3, 3) // RLE
+		header.I32(4, 3)
+		header.End()
+		header.End()
+
+		offsets[i] = int64(len(file))
+		sizes[i] = int64(header.Len() + len(page))
+		file = append(append(file, header.Bytes()...), page...)
+	}
+
+	meta := newThriftCompact()
+	meta.I32(1, 1)
+	meta.List(2, thriftStruct, len(parquetSchema)+1)
+	meta.Element()
+	meta.String(4, "schema")
+	meta.I32(5, int32(len(parquetSchema)))
+	meta.End()
+	for _, col := range parquetSchema {
+		meta.Element()
+		meta.I32(1, col.typ)
+		meta.I32(3, 0) // REQUIRED
+		meta.String(4, col.name)
+		meta.I32(6, col.converted)
+		meta.End()
+	}
+	meta.I64(3, int64(len(rs)))
+	meta.List(4, thriftStruct, 1)
+	meta.Element()
+	meta.List(1, thriftStruct, len(parquetSchema))
+	var total int64
+	for i, col := range parquetSchema {
+		meta.Element()
+		meta.I64(2, offsets[i])
+		meta.Struct(3)
+		meta.I32(1, col.typ)
+		meta.List(2, thriftI32, 1)
+		meta.varint(0) // PLAIN
+		meta.List(3, thriftBinary, 1)
+		meta.binary(col.name)
+		meta.I32(4, 0) // UNCOMPRESSED
+		meta.I64(5, int64(len(rs)))
+		meta.I64(6, sizes[i])
+		meta.I64(7, sizes[i])
+		meta.I64(9, offsets[i])
+		meta.End()
+		meta.End()
+		total += sizes[i]
+	}
+	meta.I64(2, total)
+	meta.I64(3, int64(len(rs)))
+	meta.End()
+	meta.String(6, "wachecker")
+	meta.End()
+
+	file = append(file, meta.Bytes()...)
+	file = binary.LittleEndian.AppendUint32(file, uint32(meta.Len()))
+	file = append(file, "PAR1"...)
+	if _, err := w.Write(file); err != nil {
+		return fmt.Errorf("failed to write parquet: %v", err)
+	}
+	return nil
+}
+
+// Thrift compact protocol type IDs.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftCompact encodes structs in the Thrift compact protocol, which
+// Parquet uses for its page headers and footer. Fields must be written in
+// increasing ID order and every struct closed with End.
+type thriftCompact struct {
+	bytes.Buffer
+	lastIDs []int16
+}
+
+func newThriftCompact() *thriftCompact {
+	return &thriftCompact{lastIDs: []int16{0}}
+}
+
+func (t *thriftCompact) varint(v int64) {
+	t.Write(binary.AppendUvarint(nil, uint64(v<<1^v>>63)))
+}
+
+func (t *thriftCompact) binary(s string) {
+	t.Write(binary.AppendUvarint(nil, uint64(len(s))))
+	t.WriteString(s)
+}
+
+func (t *thriftCompact) field(id int16, typ byte) {
+	last := &t.lastIDs[len(t.lastIDs)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		t.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		t.WriteByte(typ)
+		t.varint(int64(id))
+	}
+	*last = id
+}
+
+func (t *thriftCompact) I32(id int16, v int32) {
+	t.field(id, thriftI32)
+	t.varint(int64(v))
+}
+
+func (t *thriftCompact) I64(id int16, v int64) {
+	t.field(id, thriftI64)
+	t.varint(v)
+}
+
+func (t *thriftCompact) String(id int16, s string) {
+	t.field(id, thriftBinary)
+	t.binary(s)
+}
+
+// List starts a list field of n elements; elements follow as raw values, or
+// as Element ... End for structs.
+func (t *thriftCompact) List(id int16, elem byte, n int) {
+	t.field(id, thriftList)
+	if n < 15 {
+		t.WriteByte(byte(n)<<4 | elem)
+	} else {
+		t.WriteByte(0xf0 | elem)
+		t.Write(binary.AppendUvarint(nil, uint64(n)))
+	}
+}
+
+func (t *thriftCompact) Struct(id int16) {
+	t.field(id, thriftStruct)
+	t.lastIDs = append(t.lastIDs, 0)
+}
+
+func (t *thriftCompact) Element() {
+	t.lastIDs = append(t.lastIDs, 0)
+}
+
+func (t *thriftCompact) End() {
+	t.WriteByte(0)
+	t.lastIDs = t.lastIDs[:len(t.lastIDs)-1]
+}
+
+// RedisCache is a ResultCache shared between processes through Redis. It
+// speaks the RESP protocol directly over a single connection.
+// Entries expire after TTL; with no TTL they are kept until evicted.
+type RedisCache struct {
+	Addr     string
+	Password string
+	TTL      time.Duration
+	Prefix   string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func NewRedisCache(addr, password string, ttl time.Duration) *RedisCache {
+	return &RedisCache{Addr: addr, Password: password, TTL: ttl, Prefix: "wachecker:result:"}
+}
+
+func (c *RedisCache) Get(number string) (NumberResult, bool) {
+	reply, err := c.command("GET", c.Prefix+number)
+	if err != nil {
+		log.Printf("Redis cache get failed: %v", err)
+		return NumberResult{}, false
+	}
+	data, ok := reply.(string)
+	if !ok {
+		return NumberResult{}, false
+	}
+
+	var result NumberResult
+	if err := json.Unmarshal([]byte(data), &result); err != nil {
+		return NumberResult{}, false
+	}
+	return result, true
+}
+
+func (c *RedisCache) Set(number string, result NumberResult) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return
+	}
+	args := []string{"SET", c.Prefix + number, string(data)}
+	if c.TTL > 0 {
+		args = append(args, "EX", strconv.Itoa(int(math.Ceil(c.TTL.Seconds()))))
+	}
+	if _, err := c.command(args...); err != nil {
+		log.Printf("Redis cache set failed: %v", err)
+	}
+}
+
+func (c *RedisCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	return err
+}
+
+func (c *RedisCache) command(args ...string) (interface{}, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		if err := c.connectLocked(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := c.roundTripLocked(args)
+	if err != nil {
+		c.conn.Close()
+		c.conn = nil
+	}
+	return reply, err
+}
+
+func (c *RedisCache) connectLocked() error {
+	conn, err := net.DialTimeout("tcp", c.Addr, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("failed to connect to redis: %v", err)
+	}
+	c.conn, c.reader = conn, bufio.NewReader(conn)
+
+	if c.Password != "" {
+		if _, err := c.roundTripLocked([]string{"AUTH", c.Password}); err != nil {
+			conn.Close()
+			c.conn = nil
+			return fmt.Errorf("redis auth failed: %v", err)
+		}
+	}
+	return nil
+}
+
+func (c *RedisCache) roundTripLocked(args []string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(c.conn, b.String()); err != nil {
+		return nil, err
+	}
+
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("empty redis reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, errors.New(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.reader, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	default:
+		return nil, fmt.Errorf("unsupported redis reply: %q", line)
+	}
+}
+
+// SQLSource reads numbers from the first column of a query, e.g. a nightly
+// re-verification list kept in the CRM database.
+type SQLSource struct {
+	DB    *sql.DB
+	Query string
+}
+
+// newSQLSource accepts "driver:dsn#query", e.g.
+// "pgx:postgres://crm/db#SELECT phone FROM customers", for a driver linked
+// into the program.
+func newSQLSource(location string) (Source, error) {
+	driverName, rest, _ := strings.Cut(location, ":")
+	dsn, query, ok := strings.Cut(rest, "#")
+	if driverName == "" || !ok || strings.TrimSpace(query) == "" {
+		return nil, fmt.Errorf("invalid SQL source %q: expected driver:dsn#query", location)
+	}
+	db, err := openSQL(dsn, driverName)
+	if err != nil {
+		return nil, err
+	}
+	return SQLSource{DB: db, Query: query}, nil
+}
+
+func (src SQLSource) Numbers(ctx context.Context) ([]string, error) {
+	rows, err := src.DB.QueryContext(ctx, src.Query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query numbers: %v", err)
+	}
+	defer rows.Close()
+
+	var numbers []string
+	for rows.Next() {
+		var number sql.NullString
+		if err := rows.Scan(&number); err != nil {
+			return nil, fmt.Errorf("failed to scan number: %v", err)
+		}
+		if number.Valid {
+			numbers = append(numbers, number.String)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read numbers: %v", err)
+	}
+	return numbers, nil
+}
+
+// PostgresSink upserts parsed results into a Postgres table. It works with
+// any database/sql Postgres driver (lib/pq, pgx/stdlib) opened by the caller.
+type PostgresSink struct {
+	DB        *sql.DB
+	Table     string
+	BatchSize int
+}
+
+func NewPostgresSink(db *sql.DB, table string) *PostgresSink {
+	return &PostgresSink{DB: db, Table: table, BatchSize: 1000}
+}
+
+func (p *PostgresSink) EnsureTable(ctx context.Context) error {
+	_, err := p.DB.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	number     TEXT        NOT NULL,
+	status     TEXT        NOT NULL,
+	checked_at TIMESTAMPTZ NOT NULL,
+	task_id    TEXT        NOT NULL,
+	PRIMARY KEY (number, task_id)
+)`, quoteIdentifier(p.Table)))
+	if err != nil {
+		return fmt.Errorf("failed to create table: %v", err)
+	}
+	return nil
+}
+
+// WriteResults inserts results in batches within one transaction, updating
+// rows already stored for the same number and task. When a number repeats,
+// its last result wins, since one INSERT cannot update a row twice.
+func (p *PostgresSink) WriteResults(ctx context.Context, taskID string, checkedAt time.Time, results Results) error {
+	batchSize := p.BatchSize
+	if batchSize <= 0 {
+		batchSize = 1000
+	}
+
+	index := make(map[string]int, len(results))
+	unique := make(Results, 0, len(results))
+	for _, r := range results {
+		if i, ok := index[r.Number]; ok {
+			unique[i] = r
+			continue
+		}
+		index[r.Number] = len(unique)
+		unique = append(unique, r)
+	}
+	results = unique
+
+	tx, err := p.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for start := 0; start < len(results); start += batchSize {
+		end := start + batchSize
+		if end > len(results) {
+			end = len(results)
+		}
+
+		var query strings.Builder
+		fmt.Fprintf(&query, "INSERT INTO %s (number, status, checked_at, task_id) VALUES ", quoteIdentifier(p.Table))
+		args := make([]interface{}, 0, 4*(end-start))
+		for i, r := range results[start:end] {
+			if i > 0 {
+				query.WriteString(", ")
+			}
+			n := len(args)
+			fmt.Fprintf(&query, "($%d, $%d, $%d, $%d)", n+1, n+2, n+3, n+4)
+			args = append(args, r.Number, r.WhatsApp, checkedAt, taskID)
+		}
+		query.WriteString(" ON CONFLICT (number, task_id) DO UPDATE SET status = EXCLUDED.status, checked_at = EXCLUDED.checked_at")
+
+		if _, err := tx.ExecContext(ctx, query.String(), args...); err != nil {
+			return fmt.Errorf("failed to insert rows %d-%d: %v", start, end, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit results: %v", err)
+	}
+	return nil
+}
+
+// ResultSink upserts results for taskID as a ResultSink, one transaction of
+// BatchSize rows at a time.
+func (p *PostgresSink) ResultSink(taskID string) *BufferedSink {
+	return &BufferedSink{BatchSize: p.BatchSize, FlushFunc: func(ctx context.Context, results Results) error {
+		return p.WriteResults(ctx, taskID, time.Now(), results)
+	}}
+}
+
+// newPostgresSink serves "postgres:<dsn>#table" sink specs, with the table
+// defaulting to whatsapp_results, through a lib/pq or pgx driver linked into
+// the program.
+func newPostgresSink(location string) (Sink, error) {
+	dsn, table, _ := strings.Cut(location, "#")
+	db, err := openSQL(dsn, "pgx", "postgres")
+	if err != nil {
+		return nil, err
+	}
+	return postgresPluginSink{NewPostgresSink(db, cmp.Or(table, "whatsapp_results"))}, nil
+}
+
+type postgresPluginSink struct {
+	*PostgresSink
+}
+
+func (p postgresPluginSink) WriteResults(ctx context.Context, taskID string, results Results) error {
+	if err := p.EnsureTable(ctx); err != nil {
+		return err
+	}
+	return p.PostgresSink.WriteResults(ctx, taskID, time.Now(), results)
+}
+
+// ResultDB keeps every parsed result in a local SQLite database, indexed by
+// number and check time, for queries such as the latest status of a number.
+// It works with any database/sql SQLite driver (modernc.org/sqlite,
+// mattn/go-sqlite3) linked into the program; see OpenResultDB, which
+// "wachecker check --db" uses. A ResultDB is also a ResultHistory for
+// IncrementalChecker.
+type ResultDB struct {
+	DB    *sql.DB
+	Table string
+}
+
+func NewResultDB(db *sql.DB) *ResultDB {
+	return &ResultDB{DB: db, Table: "results"}
+}
+
+// OpenResultDB opens the SQLite database at path with whichever SQLite
+// driver is linked into the program and creates the schema.
+func OpenResultDB(ctx context.Context, path string) (*ResultDB, error) {
+	db, err := openSQL(path, "sqlite", "sqlite3")
+	if err != nil {
+		return nil, err
+	}
+	d := NewResultDB(db)
+	if err := d.EnsureSchema(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return d, nil
+}
+
+// openSQL opens dsn with the first of drivers that is registered. The
+// example is stdlib-only, so drivers come from a blank import such as
+// _ "modernc.org/sqlite" in the program that builds it.
+func openSQL(dsn string, drivers ...string) (*sql.DB, error) {
+	registered := sql.Drivers()
+	for _, name := range drivers {
+		if i := sort.SearchStrings(registered, name); i < len(registered) && registered[i] == name {
+			db, err := sql.Open(name, dsn)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open database: %v", err)
+			}
+			return db, nil
+		}
+	}
+	return nil, fmt.Errorf("no database/sql driver registered for %s (have %v); link one in with a blank import", strings.Join(drivers, " or "), registered)
+}
+
+// StoredResult is a result row with the task and time it was checked.
+type StoredResult struct {
+	NumberResult
+	TaskID    string    `json:"task_id,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// ResultFilter selects rows for QueryResults; zero fields match everything.
+// Number is normalized before matching. With Latest only the most recent
+// row per number is returned. Rows come newest first.
+type ResultFilter struct {
+	Number  string
+	Status  string
+	Country string
+	TaskID  string
+	Since   time.Time
+	Until   time.Time
+	Latest  bool
+	Limit   int
+}
+
+func (d *ResultDB) EnsureSchema(ctx context.Context) error {
+	table := quoteIdentifier(d.Table)
+	for _, stmt := range []string{
+		fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+	number     TEXT    NOT NULL,
+	status     TEXT    NOT NULL,
+	country    TEXT    NOT NULL DEFAULT '',
+	task_id    TEXT    NOT NULL DEFAULT '',
+	checked_at INTEGER NOT NULL
+)`, table),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (number, checked_at)", quoteIdentifier(d.Table+"_number"), table),
+		fmt.Sprintf("CREATE INDEX IF NOT EXISTS %s ON %s (checked_at)", quoteIdentifier(d.Table+"_checked_at"), table),
+	} {
+		if _, err := d.DB.ExecContext(ctx, stmt); err != nil {
+			return fmt.Errorf("failed to create schema: %v", err)
+		}
+	}
+	return nil
+}
+
+// Insert adds results checked at checkedAt in one transaction. Earlier rows
+// for the same numbers are kept as history.
+func (d *ResultDB) Insert(ctx context.Context, taskID string, checkedAt time.Time, results Results) error {
+	tx, err := d.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.PrepareContext(ctx, fmt.Sprintf("INSERT INTO %s (number, status, country, task_id, checked_at) VALUES (?, ?, ?, ?, ?)", quoteIdentifier(d.Table)))
+	if err != nil {
+		return fmt.Errorf("failed to prepare insert: %v", err)
+	}
+	defer stmt.Close()
+	for _, r := range results {
+		number := resultKey(r.Number)
+		country := cmp.Or(r.Country, CountryForNumber(number))
+		if _, err := stmt.ExecContext(ctx, number, r.WhatsApp, country, taskID, checkedAt.UnixMilli()); err != nil {
+			return fmt.Errorf("failed to insert %s: %v", number, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit results: %v", err)
+	}
+	return nil
+}
+
+func (d *ResultDB) QueryResults(ctx context.Context, filter ResultFilter) ([]StoredResult, error) {
+	var where []string
+	var args []interface{}
+	add := func(cond string, arg interface{}) {
+		where = append(where, cond)
+		args = append(args, arg)
+	}
+	if filter.Number != "" {
+		add("number = ?", resultKey(filter.Number))
+	}
+	if filter.Status != "" {
+		add("status = ?", filter.Status)
+	}
+	if filter.Country != "" {
+		add("country = ?", strings.ToUpper(filter.Country))
+	}
+	if filter.TaskID != "" {
+		add("task_id = ?", filter.TaskID)
+	}
+	if !filter.Since.IsZero() {
+		add("checked_at >= ?", filter.Since.UnixMilli())
+	}
+	if !filter.Until.IsZero() {
+		add("checked_at < ?", filter.Until.UnixMilli())
+	}
+	table := quoteIdentifier(d.Table)
+	if filter.Latest {
+		where = append(where, fmt.Sprintf("checked_at = (SELECT MAX(checked_at) FROM %s AS l WHERE l.number = r.number)", table))
+	}
+
+	query := fmt.Sprintf("SELECT number, status, country, task_id, checked_at FROM %s AS r", table)
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY checked_at DESC, number"
+	if filter.Limit > 0 {
+		query += fmt.Sprintf(" LIMIT %d", filter.Limit)
+	}
+
+	rows, err := d.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query results: %v", err)
+	}
+	defer rows.Close()
+
+	var results []StoredResult
+	for rows.Next() {
+		var r StoredResult
+		var checkedAt int64
+		if err := rows.Scan(&r.Number, &r.WhatsApp, &r.Country, &r.TaskID, &checkedAt); err != nil {
+			return nil, fmt.Errorf("failed to read result: %v", err)
+		}
+		r.CheckedAt = time.UnixMilli(checkedAt)
+		results = append(results, r)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read results: %v", err)
+	}
+	return results, nil
+}
+
+// Latest returns the most recent result stored for number.
+func (d *ResultDB) Latest(ctx context.Context, number string) (StoredResult, bool, error) {
+	results, err := d.QueryResults(ctx, ResultFilter{Number: number, Latest: true, Limit: 1})
+	if err != nil || len(results) == 0 {
+		return StoredResult{}, false, err
+	}
+	return results[0], true, nil
+}
+
+func (d *ResultDB) Last(key string) (HistoryEntry, bool) {
+	r, ok, err := d.Latest(context.Background(), key)
+	if err != nil {
+		log.Printf("Failed to look up %s in result database: %v", key, err)
+	}
+	return HistoryEntry{Result: r.NumberResult, CheckedAt: r.CheckedAt}, ok
+}
+
+func (d *ResultDB) Record(checkedAt time.Time, results Results) error {
+	return d.Insert(context.Background(), "", checkedAt, results)
+}
+
+// BloomFilter over numbers, from ResultDB.BloomFilter or filled with Add,
+// with the false positive rate it was sized for.
+func (d *ResultDB) BloomFilter(ctx context.Context, fpRate float64) (*BloomFilter, error) {
+	table := quoteIdentifier(d.Table)
+	var count int
+	if err := d.DB.QueryRowContext(ctx, fmt.Sprintf("SELECT COUNT(DISTINCT number) FROM %s", table)).Scan(&count); err != nil {
+		return nil, fmt.Errorf("failed to count numbers: %v", err)
+	}
+	rows, err := d.DB.QueryContext(ctx, fmt.Sprintf("SELECT DISTINCT number FROM %s", table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query numbers: %v", err)
+	}
+	defer rows.Close()
+
+	bf := NewBloomFilter(count, fpRate)
+	for rows.Next() {
+		var number string
+		if err := rows.Scan(&number); err != nil {
+			return nil, fmt.Errorf("failed to read number: %v", err)
+		}
+		bf.Add(number)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read numbers: %v", err)
+	}
+	return bf, nil
+}
+
+// ResultSink stores results for taskID as a ResultSink.
+func (d *ResultDB) ResultSink(taskID string) *BufferedSink {
+	return &BufferedSink{FlushFunc: func(ctx context.Context, results Results) error {
+		return d.Insert(ctx, taskID, time.Now(), results)
+	}}
+}
+
+// quoteIdentifier quotes each part of a possibly schema-qualified name.
+func quoteIdentifier(name string) string {
+	parts := strings.Split(name, ".")
+	for i, part := range parts {
+		parts[i] = `"` + strings.ReplaceAll(part, `"`, `""`) + `"`
+	}
+	return strings.Join(parts, ".")
+}
+
+// newResultDBSink opens the SQLite database at location as a Sink, as used by
+// "check --db".
+func newResultDBSink(location string) (Sink, error) {
+	d, err := OpenResultDB(context.Background(), location)
+	if err != nil {
+		return nil, err
+	}
+	return resultDBSink{d}, nil
+}
+
+type resultDBSink struct {
+	*ResultDB
+}
+
+func (s resultDBSink) WriteResults(ctx context.Context, taskID string, results Results) error {
+	return s.Insert(ctx, taskID, time.Now(), results)
+}
+
+func (s resultDBSink) Close() error {
+	return s.DB.Close()
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// execLog is a database/sql driver that records executed statements.
+type execLog struct {
+	stmts [][]driver.Value
+}
+
+func (l *execLog) Open(string) (driver.Conn, error) { return execConn{l}, nil }
+
+type execConn struct{ log *execLog }
+
+func (c execConn) Prepare(query string) (driver.Stmt, error) { return execStmt{c.log}, nil }
+func (c execConn) Close() error                              { return nil }
+func (c execConn) Begin() (driver.Tx, error)                 { return c, nil }
+func (c execConn) Commit() error                             { return nil }
+func (c execConn) Rollback() error                           { return nil }
+
+type execStmt struct{ log *execLog }
+
+func (s execStmt) Close() error  { return nil }
+func (s execStmt) NumInput() int { return -1 }
+func (s execStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.log.stmts = append(s.log.stmts, args)
+	return driver.RowsAffected(0), nil
+}
+func (s execStmt) Query([]driver.Value) (driver.Rows, error) {
+	return nil, errors.New("not supported")
+}
+
+func TestPostgresSinkDedupesBatch(t *testing.T) {
+	log := &execLog{}
+	sql.Register("execlog-postgres", log)
+	db, err := sql.Open("execlog-postgres", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := NewPostgresSink(db, "results")
+	results := Results{
+		{Number: "+14155550100", WhatsApp: "no"},
+		{Number: "+14155550101", WhatsApp: "yes"},
+		{Number: "+14155550100", WhatsApp: "yes"},
+	}
+	if err := sink.WriteResults(context.Background(), "t1", time.Now(), results); err != nil {
+		t.Fatal(err)
+	}
+	if len(log.stmts) != 1 || len(log.stmts[0]) != 8 {
+		t.Fatalf("executed %v, want one insert of 2 rows", log.stmts)
+	}
+	if got := log.stmts[0][1]; got != "yes" {
+		t.Fatalf("status for repeated number = %v, want the last one", got)
+	}
+}
+
+func TestSQLSourceRegistered(t *testing.T) {
+	_, err := OpenSource("sql:no-such-driver:db#SELECT phone FROM customers")
+	if err == nil || !strings.Contains(err.Error(), "no database/sql driver") {
+		t.Fatalf("OpenSource(sql:...) = %v, want a missing driver error", err)
+	}
+}
+
+func TestRedisCacheSetWithoutTTL(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	commands := make(chan []string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		var n int
+		fmt.Fscanf(r, "*%d\r\n", &n)
+		args := make([]string, n)
+		for i := range args {
+			var size int
+			fmt.Fscanf(r, "$%d\r\n", &size)
+			buf := make([]byte, size+2)
+			io.ReadFull(r, buf)
+			args[i] = string(buf[:size])
+		}
+		conn.Write([]byte("+OK\r\n"))
+		commands <- args
+	}()
+
+	c := NewRedisCache(ln.Addr().String(), "", 0)
+	defer c.Close()
+	c.Set("+14155550100", NumberResult{Number: "+14155550100", WhatsApp: "yes"})
+	if args := <-commands; len(args) != 3 || args[0] != "SET" {
+		t.Fatalf("sent %q, want SET without EX", args)
+	}
+}
+
+func TestIntegrationsRegistered(t *testing.T) {
+	var buf strings.Builder
+	if err := (Results{{Number: "+14155550100", WhatsApp: "yes"}}).Export(&buf, "parquet", ""); err != nil || !strings.HasPrefix(buf.String(), "PAR1") {
+		t.Fatalf("parquet export: %v", err)
+	}
+	if _, err := OpenSink("sqlite:" + t.TempDir() + "/results.db"); err == nil || !strings.Contains(err.Error(), "no database/sql driver") {
+		t.Fatalf("OpenSink(sqlite:...) = %v, want a missing driver error", err)
+	}
+}
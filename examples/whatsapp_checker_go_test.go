@@ -0,0 +1,665 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestKeyPoolRotatesOnGET(t *testing.T) {
+	var seen []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("X-API-Key")
+		seen = append(seen, key)
+		if key == "bad" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"task_id":"t1","status":"processing"}`)
+	}))
+	defer srv.Close()
+
+	wc := NewWhatsAppChecker("", WithKeyPool(NewKeyPool("bad", "good")))
+	wc.baseURL = srv.URL + "/tasks"
+	for i := 0; i < 2; i++ {
+		resp, err := wc.CheckTaskStatusContext(context.Background(), "t1", "u1")
+		if err != nil {
+			t.Fatalf("status: %v (keys tried %v)", err, seen)
+		}
+		if resp.Status != "processing" {
+			t.Fatalf("status = %q, want processing", resp.Status)
+		}
+	}
+	if seen[len(seen)-1] != "good" {
+		t.Fatalf("last key = %q, want good", seen[len(seen)-1])
+	}
+}
+
+func TestBreakerProbeReleasedWhenRateLimitWaitFails(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"task_id":"t1","status":"processing"}`)
+	}))
+	defer srv.Close()
+
+	cb := NewCircuitBreaker(1, time.Millisecond)
+	cb.state, cb.openedAt = CircuitOpen, time.Now().Add(-time.Second)
+	rl := NewRateLimiter(20, 1)
+	rl.Wait(context.Background())
+	wc := NewWhatsAppChecker("k", WithCircuitBreaker(cb), WithRateLimiter(rl), WithRetryPolicy(0, 0))
+	wc.baseURL = srv.URL + "/tasks"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	if _, err := wc.CheckTaskStatusContext(ctx, "t1", "u1"); err == nil {
+		t.Fatal("expected rate limiter error")
+	}
+	if _, err := wc.CheckTaskStatusContext(context.Background(), "t1", "u1"); err != nil {
+		t.Fatalf("probe after cancelled wait: %v", err)
+	}
+	if got := cb.State(); got != CircuitClosed {
+		t.Fatalf("breaker state = %s, want %s", got, CircuitClosed)
+	}
+}
+
+func TestDetectSequentialRunsEndingInDuplicate(t *testing.T) {
+	for _, input := range [][]string{
+		{"+14155550001", "+14155550002", "+14155550003", "+14155550003"},
+		{"+14155550003", "+14155550001", "+14155550002", "+14155550002", "+14155550003"},
+	} {
+		runs := DetectSequentialRuns(input, 3)
+		if len(runs) != 1 || runs[0].Count != 3 {
+			t.Errorf("DetectSequentialRuns(%v) = %v, want one run of 3", input, runs)
+		}
+	}
+}
+
+func TestBufferedSinkKeepsResultsOnFailedFlush(t *testing.T) {
+	var got Results
+	fail := true
+	sink := &BufferedSink{FlushFunc: func(ctx context.Context, results Results) error {
+		if fail {
+			return errors.New("unavailable")
+		}
+		got = append(got, results...)
+		return nil
+	}}
+	sink.Write(context.Background(), NumberResult{Number: "+14155550100", WhatsApp: "yes"})
+	if err := sink.Flush(context.Background()); err == nil {
+		t.Fatal("expected flush error")
+	}
+	fail = false
+	if err := sink.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("flushed %v after retry, want the pending result", got)
+	}
+}
+
+func TestResultCacheHoldsHashedNumbers(t *testing.T) {
+	salt := []byte("salt")
+	cache := NewLRUCache(10, time.Hour)
+	wc := NewWhatsAppChecker("k", WithResultCache(cache), WithPIIHashing(salt))
+	wc.cacheSet("+1 (415) 555-0100", NumberResult{Number: "+14155550100", WhatsApp: "yes"})
+
+	key := HashNumber("+14155550100", salt)
+	stored, ok := cache.Get(key)
+	if !ok || stored.Number != key {
+		t.Fatalf("cache entry = %+v, %v; want number stored as %s", stored, ok, key)
+	}
+	if _, ok := cache.Get("+14155550100"); ok {
+		t.Fatal("cache is keyed by the raw number")
+	}
+	r, ok := wc.cacheGet("+1 415 555 0100")
+	if !ok || r.Number != "+14155550100" || r.WhatsApp != "yes" {
+		t.Fatalf("cacheGet = %+v, %v", r, ok)
+	}
+}
+
+func TestNumbersFromReader(t *testing.T) {
+	for name, input := range map[string]string{
+		"numbers.txt": "\xEF\xBB\xBF+14155550100\r\n\n +14155550101 \r+14155550102\n",
+		"numbers.csv": "phone,name\n+14155550100,a\n+14155550101,b\n+14155550102,\"c, d\"\n",
+	} {
+		got, err := numbersFromReader(name, strings.NewReader(input))
+		want := []string{"+14155550100", "+14155550101", "+14155550102"}
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("numbersFromReader(%s) = %v, %v; want %v", name, got, err, want)
+		}
+	}
+
+	r := &sizeLimitReader{r: strings.NewReader("+14155550100\n+14155550101\n"), limit: 10}
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("sizeLimitReader read past its limit without an error")
+	}
+}
+
+func TestGzipUploadFallback(t *testing.T) {
+	for _, tc := range []struct {
+		status   int
+		message  string
+		attempts int
+	}{
+		{http.StatusUnsupportedMediaType, "unsupported media type", 2},
+		{http.StatusBadRequest, "Content-Encoding gzip is not supported", 2},
+		{http.StatusBadRequest, "invalid user_id", 1},
+		{http.StatusRequestEntityTooLarge, "file too large", 1},
+	} {
+		attempts := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			if r.Header.Get("Content-Encoding") == "gzip" {
+				http.Error(w, tc.message, tc.status)
+				return
+			}
+			fmt.Fprint(w, `{"task_id":"t1","status":"pending"}`)
+		}))
+		wc := NewWhatsAppChecker("k", WithGzipUpload(), WithRetryPolicy(0, 0))
+		wc.baseURL = srv.URL + "/tasks"
+		_, err := wc.uploadData(context.Background(), "numbers.txt", []byte("+14155550100\n"), UploadOptions{})
+		srv.Close()
+		if attempts != tc.attempts || (err == nil) != (tc.attempts == 2) {
+			t.Errorf("HTTP %d %q: %d attempts, err %v; want %d attempts", tc.status, tc.message, attempts, err, tc.attempts)
+		}
+	}
+}
+
+func TestPurgeKeepsForeignTempFilesAndRecentResults(t *testing.T) {
+	t.Setenv("TMPDIR", t.TempDir())
+	old := time.Now().Add(-48 * time.Hour)
+	touch := func(path string, mtime time.Time) {
+		if err := os.WriteFile(path, []byte("x"), 0600); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(path, mtime, mtime)
+	}
+	foreign := filepath.Join(os.TempDir(), "whatsapp_other.txt")
+	touch(foreign, old)
+	own := filepath.Join(tempDir(), "whatsapp_input_1.txt")
+	touch(own, old)
+
+	dir := t.TempDir()
+	ts, err := OpenTaskStore(filepath.Join(dir, "tasks.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	recentResult := filepath.Join(dir, "t1.xlsx")
+	touch(recentResult, time.Now())
+	ts.Put(TaskRecord{TaskID: "t1", UpdatedAt: old, Events: []TaskEvent{{Kind: "delivered", Detail: recentResult}}})
+
+	wc := NewWhatsAppChecker("k", WithTaskStore(ts))
+	summary, err := wc.Purge(24 * time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(summary.Temp, []string{own}) {
+		t.Errorf("purged temp files %v, want only %s", summary.Temp, own)
+	}
+	if _, err := os.Stat(foreign); err != nil {
+		t.Errorf("foreign temp file removed: %v", err)
+	}
+	if _, ok := ts.Get("t1"); !ok || len(summary.Tasks) != 0 {
+		t.Errorf("task record with a recent result file was purged: %v", summary.Tasks)
+	}
+}
+
+func TestReadyzPingOutlivesProbeDeadline(t *testing.T) {
+	pings := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pings++
+		time.Sleep(200 * time.Millisecond)
+		http.NotFound(w, r)
+	}))
+	defer upstream.Close()
+	wc := NewWhatsAppChecker("k")
+	wc.baseURL = upstream.URL + "/tasks"
+	s := NewServer(wc)
+
+	probe := func(timeout time.Duration) error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return s.upstreamReady(ctx)
+	}
+	if err := probe(20 * time.Millisecond); err == nil {
+		t.Fatal("probe returned ready before the first ping finished")
+	}
+	if err := probe(time.Second); err != nil {
+		t.Fatalf("probe after ping finished: %v", err)
+	}
+	if err := probe(time.Millisecond); err != nil {
+		t.Fatalf("cached probe: %v", err)
+	}
+	if pings != 1 {
+		t.Fatalf("%d pings, want 1 shared by all probes", pings)
+	}
+}
+
+func TestHeartbeatGatedOnProgress(t *testing.T) {
+	for _, progressing := range []bool{false, true} {
+		var mu sync.Mutex
+		pings := 0
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			pings++
+			mu.Unlock()
+		}))
+		wc := NewWhatsAppChecker("k", WithHeartbeat(10*time.Millisecond, srv.URL))
+		wc.httpClient.Timeout = 0
+		hb := wc.startHeartbeat("task t1", time.Millisecond)
+		for i := 0; i < 40; i++ {
+			detail := "processing, success 0/10"
+			if progressing {
+				detail = fmt.Sprintf("processing, success %d/40", i)
+			}
+			hb.Touch(detail)
+			time.Sleep(5 * time.Millisecond)
+		}
+		hb.Stop(nil)
+		srv.Close()
+
+		mu.Lock()
+		got := pings - 1 // the completion ping
+		mu.Unlock()
+		if progressing && got < 10 {
+			t.Errorf("%d heartbeats while progressing, want at least 10", got)
+		}
+		if !progressing && got > 5 {
+			t.Errorf("%d heartbeats without progress, want them withheld", got)
+		}
+	}
+}
+
+func TestCronDayFields(t *testing.T) {
+	from := time.Date(2026, 6, 1, 12, 0, 0, 0, time.Local) // a Monday
+	for _, tc := range []struct {
+		expr string
+		want time.Time
+	}{
+		// Both restricted: the 10th or any Wednesday.
+		{"0 0 10 * 3", time.Date(2026, 6, 3, 0, 0, 0, 0, time.Local)},
+		// A stepped "*" is unrestricted, so both fields must match.
+		{"0 0 */5 * 3", time.Date(2026, 7, 1, 0, 0, 0, 0, time.Local)},
+		{"0 0 10 * */7", time.Date(2027, 1, 10, 0, 0, 0, 0, time.Local)},
+	} {
+		c, err := ParseCron(tc.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := c.Next(from); !got.Equal(tc.want) {
+			t.Errorf("%s: Next = %s, want %s", tc.expr, got, tc.want)
+		}
+	}
+}
+
+func TestRateLimiterWithoutRateIsUnlimited(t *testing.T) {
+	for _, rps := range []float64{0, -1, math.Inf(1), math.NaN()} {
+		rl := NewRateLimiter(rps, 1)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		for i := 0; i < 3; i++ {
+			if err := rl.Wait(ctx); err != nil {
+				t.Errorf("rps %v: wait %d: %v", rps, i, err)
+			}
+		}
+		cancel()
+	}
+}
+
+func TestPreviewReadsOnlyWhatItNeeds(t *testing.T) {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, body := range map[string]string{
+		"xl/workbook.xml":            `<workbook xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships"><sheets><sheet name="Results" r:id="rId1"/></sheets></workbook>`,
+		"xl/_rels/workbook.xml.rels": `<Relationships><Relationship Id="rId1" Target="worksheets/sheet1.xml"/></Relationships>`,
+	} {
+		w, _ := zw.Create(name)
+		io.WriteString(w, body)
+	}
+	w, _ := zw.CreateHeader(&zip.FileHeader{Name: "xl/worksheets/sheet1.xml", Method: zip.Store})
+	io.WriteString(w, `<worksheet><sheetData><row><c t="inlineStr"><is><t>Number</t></is></c><c t="inlineStr"><is><t>WhatsApp</t></is></c></row>`)
+	for i := 0; i < 50000; i++ {
+		fmt.Fprintf(w, `<row><c t="inlineStr"><is><t>+1415%07d</t></is></c><c t="inlineStr"><is><t>yes</t></is></c></row>`, i)
+	}
+	io.WriteString(w, `</sheetData></worksheet>`)
+	zw.Close()
+	file := buf.Bytes()
+
+	for _, ranges := range []bool{true, false} {
+		var served atomic.Int64
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !ranges {
+				r.Header.Del("Range")
+			}
+			cw := &countingWriter{ResponseWriter: w}
+			http.ServeContent(cw, r, "results.xlsx", time.Time{}, bytes.NewReader(file))
+			served.Add(cw.n)
+		}))
+		wc := NewWhatsAppChecker("k")
+		results, err := wc.previewResults(context.Background(), srv.URL, 3)
+		srv.Close()
+		if err != nil || len(results) != 3 || results[2].Number != "+14150000002" {
+			t.Fatalf("ranges=%v: results %v, err %v", ranges, results, err)
+		}
+		if ranges && served.Load() > int64(len(file))/4 {
+			t.Errorf("served %d of %d bytes for a 3-row preview", served.Load(), len(file))
+		}
+	}
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+func TestSharedOutputAppendAfterClose(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.csv")
+	out, err := OpenSharedOutput(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Append(Results{{Number: "+14155550100", WhatsApp: "yes"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := out.Append(Results{{Number: "+14155550101", WhatsApp: "no"}}); !errors.Is(err, ErrSharedOutputClosed) {
+		t.Fatalf("Append after Close: %v", err)
+	}
+	if err := out.Close(); !errors.Is(err, ErrSharedOutputClosed) {
+		t.Fatalf("second Close: %v", err)
+	}
+	data, _ := os.ReadFile(path)
+	if !strings.Contains(string(data), "+14155550100") || strings.Contains(string(data), "+14155550101") {
+		t.Fatalf("output = %q", data)
+	}
+}
+
+func TestZstdExportNeedsRegisteredCodec(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "results.csv.zst")
+	results := Results{{Number: "+14155550100", WhatsApp: "yes"}}
+	if err := results.ExportFile(path); err == nil || !strings.Contains(err.Error(), "RegisterCodec") {
+		t.Fatalf("ExportFile without zstd codec: %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("failed export left %s behind", path)
+	}
+
+	var used bool
+	RegisterCodec("zstd", func(w io.Writer) (io.WriteCloser, error) {
+		used = true
+		return nopWriteCloser{w}, nil
+	})
+	defer func() {
+		codecsMu.Lock()
+		delete(codecs, "zstd")
+		codecsMu.Unlock()
+	}()
+	if err := results.ExportFile(path); err != nil || !used {
+		t.Fatalf("ExportFile with zstd codec: used %v, err %v", used, err)
+	}
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+func TestWatchListMatchesE164(t *testing.T) {
+	var posted []StatusChange
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var changes []StatusChange
+		json.NewDecoder(r.Body).Decode(&changes)
+		posted = append(posted, changes...)
+	}))
+	defer srv.Close()
+
+	cache := NewLRUCache(10, time.Hour)
+	wc := NewWhatsAppChecker("k", WithResultCache(cache))
+	watch := NewWatchList(wc, time.Millisecond)
+	watch.WebhookURL = srv.URL
+	watch.Add("1 415 555 0100", "+14155550100", "0014155550100")
+	if got := watch.Numbers(); !reflect.DeepEqual(got, []string{"+14155550100"}) {
+		t.Fatalf("Numbers() = %v", got)
+	}
+
+	for _, status := range []string{"no", "yes"} {
+		wc.cacheSet("+14155550100", NumberResult{Number: "14155550100", WhatsApp: status})
+		if _, err := watch.CheckOnce(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := StatusChange{Number: "+14155550100", Previous: "no", Current: "yes"}
+	if len(posted) != 1 || posted[0].Number != want.Number || posted[0].Previous != want.Previous || posted[0].Current != want.Current {
+		t.Fatalf("posted %+v, want %+v", posted, want)
+	}
+}
+
+func TestStallDetectionOnlyWhileProcessing(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		polls   []string
+		stalled bool
+	}{
+		{"queued then exported", []string{
+			`"status":"pending","success":0`, `"status":"pending","success":0`, `"status":"pending","success":0`,
+			`"status":"processing","success":10`, `"status":"processing","success":10`, `"status":"processing","success":10`,
+			`"status":"completed","success":10`, `"status":"completed","success":10`, `"status":"completed","success":10`,
+			`"status":"exported","success":10,"result_url":"https://example.com/r.xlsx"`,
+		}, false},
+		{"stuck while processing", []string{
+			`"status":"processing","success":3`, `"status":"processing","success":3`, `"status":"processing","success":3`,
+			`"status":"processing","success":3`,
+		}, true},
+	} {
+		var mu sync.Mutex
+		var gets int
+		var deleted bool
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if r.Method == http.MethodDelete {
+				deleted = true
+				return
+			}
+			poll := tc.polls[min(gets, len(tc.polls)-1)]
+			gets++
+			fmt.Fprintf(w, `{"task_id":"t1","total":10,%s}`, poll)
+		}))
+		wc := NewWhatsAppChecker("k", WithStallDetection(2, true))
+		wc.baseURL = srv.URL + "/tasks"
+		wc.statusOut = io.Discard
+		_, err := wc.PollTaskStatusContext(context.Background(), "t1", "u1", time.Millisecond)
+		srv.Close()
+		if errors.Is(err, ErrTaskStalled) != tc.stalled || deleted != tc.stalled {
+			t.Errorf("%s: err %v, cancelled %v; want stalled %v", tc.name, err, deleted, tc.stalled)
+		}
+	}
+}
+
+func TestCachedResultsKeepInputOrder(t *testing.T) {
+	cache := NewLRUCache(10, time.Hour)
+	wc := NewWhatsAppChecker("", WithResultCache(cache))
+	wc.cacheSet("+14155550102", NumberResult{Number: "+14155550102", WhatsApp: "yes"})
+	numbers := []string{"+14155550100", "+1 415 555 0102", "+14155550101"}
+	results, err := wc.checkNumbersCached(numbers, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range results {
+		got = append(got, NormalizeNumber(r.Number))
+	}
+	if want := []string{"+14155550100", "+14155550102", "+14155550101"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("order = %v, want %v", got, want)
+	}
+}
+
+func TestIncrementalResultsKeepInputOrder(t *testing.T) {
+	history, err := OpenFileHistory(filepath.Join(t.TempDir(), "history.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := history.Record(time.Now(), Results{{Number: "+14155550102", WhatsApp: "yes"}}); err != nil {
+		t.Fatal(err)
+	}
+	ic := NewIncrementalChecker(NewWhatsAppChecker(""), history, time.Hour)
+	results, _, err := ic.Check([]string{"+14155550100", "+14155550102", "+14155550101"}, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, r := range results {
+		got = append(got, r.Number)
+	}
+	if want := []string{"+14155550100", "+14155550102", "+14155550101"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("order = %v, want %v", got, want)
+	}
+}
+
+type staticSource []string
+
+func (s staticSource) Numbers(context.Context) ([]string, error) { return s, nil }
+
+func TestPIIHashingCoversScheduledAndDropFolderOutput(t *testing.T) {
+	dir := t.TempDir()
+	wc := NewWhatsAppChecker("", WithPIIHashing([]byte("salt")))
+	sink, err := OpenSink("file:" + filepath.Join(dir, "{task_id}.csv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := ScheduledJob{Name: "nightly", Source: staticSource{"+14155550100"}, Sink: sink}
+	if err := NewScheduler(wc).RunNow(context.Background(), job); err != nil {
+		t.Fatal(err)
+	}
+
+	drop := NewDropFolder(wc, dir)
+	os.WriteFile(filepath.Join(dir, "in.txt"), []byte("+14155550100\n"), 0644)
+	if err := drop.process("in.txt"); err != nil {
+		t.Fatal(err)
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "nightly-*.csv"))
+	files = append(files, filepath.Join(dir, "done", "in.results.csv"))
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Contains(string(data), "4155550100") || !strings.Contains(string(data), "h:") {
+			t.Errorf("%s holds raw numbers:\n%s", filepath.Base(path), data)
+		}
+	}
+	if len(files) != 2 {
+		t.Fatalf("wrote %v", files)
+	}
+}
+
+func TestEncryptionRoundTripAndTampering(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	seal := func(plaintext []byte) []byte {
+		var buf bytes.Buffer
+		ew, err := NewEncryptWriter(&buf, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ew.Write(plaintext)
+		if err := ew.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	open := func(sealed []byte) ([]byte, error) {
+		r, err := NewDecryptReader(bytes.NewReader(sealed), key)
+		if err != nil {
+			return nil, err
+		}
+		return io.ReadAll(r)
+	}
+
+	for _, size := range []int{0, 1, encryptionSegment, 3*encryptionSegment + 17} {
+		plaintext := make([]byte, size)
+		for i := range plaintext {
+			plaintext[i] = byte(i * 31)
+		}
+		got, err := open(seal(plaintext))
+		if err != nil || !bytes.Equal(got, plaintext) {
+			t.Fatalf("round trip of %d bytes: %d bytes back, err %v", size, len(got), err)
+		}
+	}
+
+	sealed := seal(bytes.Repeat([]byte("+14155550100,yes\n"), encryptionSegment/8))
+	header := len(encryptionMagic) + 7
+	firstSegment := header + 5 + encryptionSegment + 16
+	flipped := bytes.Clone(sealed)
+	flipped[firstSegment+100] ^= 1
+	for name, damaged := range map[string][]byte{
+		"flipped byte":      flipped,
+		"last byte cut":     sealed[:len(sealed)-1],
+		"final segment cut": sealed[:firstSegment],
+		"trailing data":     append(bytes.Clone(sealed), 0),
+		"header only":       sealed[:header],
+	} {
+		if _, err := open(damaged); err == nil {
+			t.Errorf("%s: decrypted without error", name)
+		}
+	}
+	if _, err := open(sealed); err != nil {
+		t.Fatalf("intact file: %v", err)
+	}
+	r, _ := NewDecryptReader(bytes.NewReader(sealed), bytes.Repeat([]byte{8}, 32))
+	if _, err := io.ReadAll(r); err == nil {
+		t.Error("wrong key: decrypted without error")
+	}
+}
+
+func TestEncryptionCoversDropFolderAndCountrySummary(t *testing.T) {
+	t.Setenv("TEST_ENCRYPTION_KEY", strings.Repeat("ab", 32))
+	key, _ := ParseEncryptionKey(strings.Repeat("ab", 32))
+	wc := NewWhatsAppChecker("", WithEncryption(EnvCredentials("TEST_ENCRYPTION_KEY")))
+	dir := t.TempDir()
+
+	os.WriteFile(filepath.Join(dir, "in.txt"), []byte("+14155550100\n"), 0644)
+	if err := NewDropFolder(wc, dir).process("in.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if err := wc.writeCountrySummary(filepath.Join(dir, "summary.csv"), []CountryResult{{Country: "US", Numbers: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{
+		filepath.Join(dir, "done", "in.results.csv"): "+14155550100",
+		filepath.Join(dir, "summary.csv"):            "US,",
+	} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := NewDecryptReader(bytes.NewReader(data), key)
+		if err != nil {
+			t.Fatalf("%s is not encrypted: %v", filepath.Base(path), err)
+		}
+		plaintext, err := io.ReadAll(r)
+		if err != nil || !strings.Contains(string(plaintext), want) {
+			t.Fatalf("%s decrypts to %q, %v", filepath.Base(path), plaintext, err)
+		}
+	}
+}